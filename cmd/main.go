@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/majlu/my-cubefs-csi/pkg/cubefs"
+	"github.com/majlu/my-cubefs-csi/pkg/fakemaster"
 
 	"github.com/spf13/cobra"
 	"k8s.io/klog/v2"
@@ -21,23 +26,105 @@ var (
 )
 
 var (
-	endpoint   string
-	nodeId     string
-	mode       string
-	version    string
-	driverName string
-	kubeConfig string
+	endpoint     string
+	nodeId       string
+	mode         string
+	version      string
+	driverName   string
+	kubeConfig   string
+	httpEndpoint string
+
+	masterLimits cubefs.MasterLimits
+
+	volumeReadyTimeout        time.Duration
+	minWritableDataPartitions int
+
+	mountCheckInterval time.Duration
+
+	mountMode         string
+	mountPodImage     string
+	mountPodNamespace string
+	mountPodTimeout   time.Duration
+
+	nodeMaxConcurrentOperations int
+	nodeOperationTimeout        time.Duration
+
+	nodeMaxVolumes       int64
+	clientMemoryEstimate string
+
+	clientConfigFile string
+
+	clientBin     string
+	clientConfDir string
+	clientLogDir  string
+	clientLogHost string
+	kubeletDir    string
+
+	shutdownGracePeriod time.Duration
+
+	ephemeralMaxSizeGB     int64
+	ephemeralMasterAddr    string
+	ephemeralOwner         string
+	ephemeralMasterVersion string
+	ephemeralNamespaces    []string
+	ephemeralSweepInterval time.Duration
+)
+
+var (
+	fakeMasterConf fakemaster.Config
 )
 
 func init() {
 	klog.InitFlags(nil)
-	cmd.Flags().AddGoFlagSet(flag.CommandLine)
-	cmd.PersistentFlags().StringVar(&nodeId, "nodeid", "", "This node's ID")
-	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "unix:///csi/csi.sock", "CSI endpoint, must be a UNIX socket")
-	cmd.PersistentFlags().StringVar(&version, "version", defaultVersion, "Driver version")
-	cmd.PersistentFlags().StringVar(&mode, "mode", string(cubefs.AllMode), "Driver mode, k8s or standalone, supports: controller, node, all")
-	cmd.PersistentFlags().StringVar(&driverName, "driver-name", cubefs.DriverName, "Driver name")
-	cmd.PersistentFlags().StringVar(&kubeConfig, "kubeconfig", "", "Kubernetes config file, default we assume in cluster mode")
+	// klog flags apply to every subcommand, the driver flags only to the driver
+	cmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+	cmd.Flags().StringVar(&nodeId, "nodeid", "", "This node's ID")
+	cmd.Flags().StringVar(&endpoint, "endpoint", "unix:///csi/csi.sock", "CSI endpoint, must be a UNIX socket")
+	cmd.Flags().StringVar(&version, "version", defaultVersion, "Driver version")
+	cmd.Flags().StringVar(&mode, "mode", string(cubefs.AllMode), "Driver mode, k8s or standalone, supports: controller, node, all")
+	cmd.Flags().StringVar(&driverName, "driver-name", cubefs.DriverName, "Driver name")
+	cmd.Flags().StringVar(&kubeConfig, "kubeconfig", "", "Kubernetes config file, default we assume in cluster mode")
+	cmd.Flags().StringVar(&httpEndpoint, "http-endpoint", "", "TCP address the metrics HTTP server listens on, disabled if empty")
+	cmd.Flags().Float64Var(&masterLimits.QPS, "master-qps", 10, "Max requests per second to the masters of one CubeFS cluster, unlimited if <= 0")
+	cmd.Flags().IntVar(&masterLimits.Burst, "master-burst", 20, "Burst of requests allowed above --master-qps")
+	cmd.Flags().IntVar(&masterLimits.MaxInflight, "master-max-inflight", 16, "Max concurrent requests to the masters of one CubeFS cluster, unlimited if <= 0")
+	cmd.Flags().DurationVar(&volumeReadyTimeout, "volume-ready-timeout", 2*time.Minute, "How long CreateVolume waits for a new volume to become writable, 0 disables the wait")
+	cmd.Flags().IntVar(&minWritableDataPartitions, "min-writable-dp", 1, "Writable data partitions a new volume needs to be considered ready")
+	cmd.Flags().DurationVar(&mountCheckInterval, "mount-check-interval", 30*time.Second, "How often the node looks for corrupted client mounts to recover, 0 disables the check")
+	cmd.Flags().StringVar(&mountMode, "mount-mode", string(cubefs.ProcessMountMode), "Where the node runs the cubefs clients, supports: process (in the driver container, the mounts are lost while it restarts), pod (one mount pod per volume, the mounts survive restarts)")
+	cmd.Flags().StringVar(&mountPodImage, "mount-pod-image", "", "Image of the mount pods, it must contain the cubefs client at "+cubefs.CfsClientBin)
+	cmd.Flags().StringVar(&mountPodNamespace, "mount-pod-namespace", "kube-system", "Namespace the mount pods are created in")
+	cmd.Flags().DurationVar(&mountPodTimeout, "mount-pod-timeout", 2*time.Minute, "How long NodeStageVolume waits for a mount pod to mount the volume")
+	cmd.Flags().IntVar(&nodeMaxConcurrentOperations, "node-max-concurrent-ops", 16, "Max volume operations running concurrently on the node")
+	cmd.Flags().DurationVar(&nodeOperationTimeout, "node-operation-timeout", 2*time.Minute, "Deadline of every volume operation on the node, on top of the caller's one, 0 keeps the caller's deadline only")
+
+	cmd.Flags().Int64Var(&nodeMaxVolumes, "max-volumes-per-node", 0, "Most volumes the node stages, reported to the scheduler, 0 is no limit")
+	cmd.Flags().StringVar(&clientMemoryEstimate, "client-memory-estimate", "", "Memory a cubefs client is estimated to use, e.g. 512Mi, if set the node stages no more volumes than its allocatable memory allows")
+	cmd.Flags().StringVar(&clientConfigFile, "client-config", "", "Node-level cubefs client configuration file with defaults and overrides, see the README")
+	cmd.Flags().StringVar(&clientBin, "client-bin", cubefs.DefaultClientBin, "Cubefs client the node runs in the process mount mode")
+	cmd.Flags().StringVar(&clientConfDir, "client-conf-dir", cubefs.DefaultClientConfDir, "Directory of the client configs of the node, the driver keeps its own below <dir>/<driver-name>")
+	cmd.Flags().StringVar(&clientLogDir, "client-log-dir", cubefs.DefaultClientLogDir, "Directory of the client logs of the node, the driver keeps its own below <dir>/<driver-name>")
+	cmd.Flags().StringVar(&clientLogHost, "client-log-host-dir", "", "Host path of --client-log-dir, the mount pods write their client logs there, defaults to --client-log-dir")
+	cmd.Flags().StringVar(&kubeletDir, "kubelet-dir", cubefs.DefaultKubeletDir, "Root directory of kubelet")
+	cmd.Flags().DurationVar(&shutdownGracePeriod, "shutdown-grace-period", 20*time.Second, "How long the driver lets the operations in flight finish on SIGTERM, keep it below the terminationGracePeriodSeconds of the pod")
+	cmd.Flags().Int64Var(&ephemeralMaxSizeGB, "ephemeral-max-size-gb", 100, "Largest ephemeral inline volume in GB the node creates, 0 disables inline volumes")
+	cmd.Flags().StringVar(&ephemeralMasterAddr, "ephemeral-master-addr", "", "Master addresses of the CubeFS cluster of the ephemeral inline volumes, empty disables inline volumes")
+	cmd.Flags().StringVar(&ephemeralMasterVersion, "ephemeral-master-version", "", "Master version of the cluster of the ephemeral inline volumes, needed when its masters do not report it, e.g. 2.4.0")
+	cmd.Flags().StringVar(&ephemeralOwner, "ephemeral-owner", "", "Owner of the ephemeral inline volumes, required to mount existing volumes, every created volume gets its own if empty")
+	cmd.Flags().StringSliceVar(&ephemeralNamespaces, "ephemeral-allowed-namespaces", nil, "Namespaces whose pods may use ephemeral inline volumes, all if empty")
+	cmd.Flags().DurationVar(&ephemeralSweepInterval, "ephemeral-sweep-interval", 10*time.Minute, "How often the node deletes the inline volumes of pods which are gone, 0 only sweeps on startup")
+
+	fakeMasterCmd.Flags().StringSliceVar(&fakeMasterConf.Addrs, "listen", []string{"127.0.0.1:17010"}, "Listen addresses of the emulated masters, the first one is the leader")
+	fakeMasterCmd.Flags().Uint64Var(&fakeMasterConf.CapacityGB, "capacity-gb", 1024, "Total capacity of the emulated cluster in GB")
+	fakeMasterCmd.Flags().StringVar(&fakeMasterConf.StateFile, "state-file", "", "File to keep the volumes in across restarts, in memory only if empty")
+	fakeMasterCmd.Flags().StringVar(&fakeMasterConf.Version, "master-version", "3.3.0", "Master version to emulate, a 2.x version or empty emulates a master before 3.x")
+	fakeMasterCmd.Flags().DurationVar(&fakeMasterConf.ReadyDelay, "ready-delay", 0, "How long a new volume reports no writable data partitions")
+	fakeMasterCmd.Flags().DurationVar(&fakeMasterConf.Faults.Latency, "latency", 0, "Latency added to every request")
+	fakeMasterCmd.Flags().IntVar(&fakeMasterConf.Faults.ErrorCode, "error-code", 0, "Master error code to inject")
+	fakeMasterCmd.Flags().Float64Var(&fakeMasterConf.Faults.ErrorRate, "error-rate", 0, "Probability in [0, 1] of injecting --error-code")
+	fakeMasterCmd.Flags().StringSliceVar(&fakeMasterConf.Faults.Paths, "error-paths", nil, "Endpoints the errors are injected into, all if empty")
+	fakeMasterCmd.Flags().BoolVar(&fakeMasterConf.Faults.RedirectFollowers, "redirect-followers", false, "Make the non-leader addresses redirect to the leader")
+	cmd.AddCommand(fakeMasterCmd)
 }
 
 var cmd = &cobra.Command{
@@ -45,9 +132,44 @@ var cmd = &cobra.Command{
 	Short: "CSI based CFS driver",
 	Run: func(cmd *cobra.Command, args []string) {
 		opts := cubefs.Options{
-			Mode:       cubefs.Mode(mode),
-			Kubeconfig: kubeConfig,
-			Endpoint:   endpoint,
+			Mode:         cubefs.Mode(mode),
+			Kubeconfig:   kubeConfig,
+			Endpoint:     endpoint,
+			HttpEndpoint: httpEndpoint,
+			MasterLimits: masterLimits,
+
+			VolumeReadyTimeout:        volumeReadyTimeout,
+			MinWritableDataPartitions: minWritableDataPartitions,
+
+			MountCheckInterval: mountCheckInterval,
+
+			MountMode:         cubefs.MountMode(mountMode),
+			MountPodImage:     mountPodImage,
+			MountPodNamespace: mountPodNamespace,
+			MountPodTimeout:   mountPodTimeout,
+
+			NodeMaxConcurrentOperations: nodeMaxConcurrentOperations,
+			NodeOperationTimeout:        nodeOperationTimeout,
+
+			NodeMaxVolumes:       nodeMaxVolumes,
+			ClientMemoryEstimate: clientMemoryEstimate,
+
+			ClientConfigFile: clientConfigFile,
+
+			ClientBin:        clientBin,
+			ClientConfDir:    clientConfDir,
+			ClientLogDir:     clientLogDir,
+			ClientLogHostDir: clientLogHost,
+			KubeletDir:       kubeletDir,
+
+			ShutdownGracePeriod: shutdownGracePeriod,
+
+			EphemeralMaxSizeGB:         ephemeralMaxSizeGB,
+			EphemeralMasterAddr:        ephemeralMasterAddr,
+			EphemeralOwner:             ephemeralOwner,
+			EphemeralMasterVersion:     ephemeralMasterVersion,
+			EphemeralAllowedNamespaces: ephemeralNamespaces,
+			EphemeralSweepInterval:     ephemeralSweepInterval,
 		}
 		drv, err := cubefs.NewCSIDriver(driverName, nodeId, version, &opts)
 		if err != nil {
@@ -61,6 +183,24 @@ var cmd = &cobra.Command{
 	},
 }
 
+var fakeMasterCmd = &cobra.Command{
+	Use:   "fake-master --listen=<addr>[,<addr>...]",
+	Short: "Run an in-process CubeFS master emulator for development and testing",
+	Run: func(cmd *cobra.Command, args []string) {
+		srv, err := fakemaster.NewServer(fakeMasterConf)
+		if err != nil {
+			klog.ErrorS(err, "failed to create fake master")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err = srv.Run(ctx); err != nil {
+			klog.ErrorS(err, "failed to run fake master")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+	},
+}
+
 func main() {
 	klog.InfoS("System build info", "BuildTime", BuildTime,
 		"Branch", Branch, "CommitID", CommitID)
@@ -0,0 +1,306 @@
+package cubefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+// nodeClientConfig is the node-level cubefs client configuration file, usually
+// mounted from a ConfigMap. Values are Go templates rendered per volume.
+//
+// The client config of a volume is built with this precedence, lowest first:
+//  1. the driver's built-in defaults, e.g. logLevel info
+//  2. defaults of the node config
+//  3. StorageClass parameters or PV attributes
+//  4. mount flags
+//  5. overrides of the node config
+//
+// mountPoint is always set by the driver, volName and owner cannot be
+// overridden, and logDir can only be changed by the overrides.
+type nodeClientConfig struct {
+	Defaults  clientOptions `json:"defaults"`
+	Overrides clientOptions `json:"overrides"`
+}
+
+// clientOptions are client options given as strings, numbers or booleans.
+type clientOptions map[string]string
+
+func (o *clientOptions) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*o = make(clientOptions, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			(*o)[key] = v
+		case float64:
+			(*o)[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			(*o)[key] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("client option %s must be a string, number or boolean", key)
+		}
+	}
+	return nil
+}
+
+// clientConfData is what the templates of the node config can use.
+type clientConfData struct {
+	VolumeId   string
+	VolumeName string
+	NodeId     string
+	MountPoint string
+}
+
+// Client keys the node config cannot set
+var (
+	noDefaultKeys  = []string{KMountPoint, KLogDir}
+	noOverrideKeys = []string{KMountPoint, KVolumeName, KOwner}
+)
+
+// Client options validated before a client is launched
+var (
+	clientPortKeys = []string{"profPort", "exporterPort"}
+	clientIntKeys  = []string{"readRate", "writeRate", "buffersTotalLimit", "maxStreamerLimit", "maxcpus",
+		KAttrValid, KEntryValid, KICacheTimeout, KLookupValid}
+	clientBoolKeys = []string{KReadOnly, KWriteCache, KKeepCache, KEnablePosixACL, "followerRead", "enableXattr",
+		"autoInvalData", "enSyncWrite", "fsyncOnClose"}
+	clientLogLevels = []string{"debug", "info", "warn", "error"}
+)
+
+// loadNodeClientConfig reads the node config file, YAML or JSON, an empty
+// path is an empty config. Every template is parsed so errors show up early.
+func loadNodeClientConfig(path string) (*nodeClientConfig, error) {
+	config := &nodeClientConfig{}
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("decode client config %s: %w", path, err)
+	}
+	for key, value := range config.Defaults {
+		if slices.Contains(noDefaultKeys, key) {
+			return nil, fmt.Errorf("client config %s: %s cannot have a default", path, key)
+		}
+		if _, err = newClientConfTemplate(key, value, &clientConfData{}); err != nil {
+			return nil, fmt.Errorf("client config %s: %w", path, err)
+		}
+	}
+	for key, value := range config.Overrides {
+		if slices.Contains(noOverrideKeys, key) {
+			return nil, fmt.Errorf("client config %s: %s cannot be overridden", path, key)
+		}
+		if _, err = newClientConfTemplate(key, value, &clientConfData{}); err != nil {
+			return nil, fmt.Errorf("client config %s: %w", path, err)
+		}
+	}
+	return config, nil
+}
+
+// newClientConfTemplate parses the template of a client option. Besides the
+// clientConfData fields it can call port, which allocates a port in
+// [from, to] no other client of the node uses, e.g. {{ port 17510 17610 }}.
+func newClientConfTemplate(key, value string, data *clientConfData) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"port": func(from, to int) (int, error) {
+			return allocateClientPort(key, data.VolumeId, from, to)
+		},
+	}
+	tmpl, err := template.New(key).Option("missingkey=error").Funcs(funcs).Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template of %s: %w", key, err)
+	}
+	return tmpl, nil
+}
+
+func renderClientConfValue(key, value string, data *clientConfData) (string, error) {
+	tmpl, err := newClientConfTemplate(key, value, data)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("render %s: %w", key, err)
+	}
+	return out.String(), nil
+}
+
+// applyDefaults fills the keys the volume parameters do not set.
+func (c *nodeClientConfig) applyDefaults(param map[string]string, data *clientConfData) error {
+	for key, value := range c.Defaults {
+		if _, ok := param[key]; ok {
+			continue
+		}
+		rendered, err := renderClientConfValue(key, value, data)
+		if err != nil {
+			return err
+		}
+		param[key] = rendered
+	}
+	return nil
+}
+
+// applyOverrides sets the keys the node enforces whatever the volume parameters say.
+func (c *nodeClientConfig) applyOverrides(conf map[string]string, data *clientConfData) error {
+	for key, value := range c.Overrides {
+		rendered, err := renderClientConfValue(key, value, data)
+		if err != nil {
+			return err
+		}
+		conf[key] = rendered
+	}
+	return nil
+}
+
+// validateClientConf checks the final client config of a volume before its
+// client is launched.
+func validateClientConf(volumeId string, conf map[string]string) error {
+	for _, key := range []string{KMasterAddr, KVolumeName, KMountPoint, KLogDir} {
+		if conf[key] == "" {
+			return fmt.Errorf("client option %s is missing", key)
+		}
+	}
+	if level := conf[KLogLevel]; level != "" && !slices.Contains(clientLogLevels, strings.ToLower(level)) {
+		return fmt.Errorf("client option %s %q must be one of %v", KLogLevel, level, clientLogLevels)
+	}
+	for _, key := range clientIntKeys {
+		if value, ok := conf[key]; ok {
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("client option %s %q must be an integer", key, value)
+			}
+		}
+	}
+	for _, key := range clientBoolKeys {
+		if value, ok := conf[key]; ok {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("client option %s %q must be true or false", key, value)
+			}
+		}
+	}
+	for _, key := range clientPortKeys {
+		value, ok := conf[key]
+		if !ok {
+			continue
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("client option %s %q must be a port", key, value)
+		}
+		if err = clientPorts.claim(key, volumeId, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientPortTable serializes the port allocations of the node. The ports of
+// a client config being built are reserved in memory until it is persisted,
+// so concurrent stages cannot pick the same one.
+type clientPortTable struct {
+	mutex sync.Mutex
+	// reserved maps the port keys to the ports of configs not persisted yet, and those to their volume
+	reserved map[string]map[string]string
+}
+
+var clientPorts = &clientPortTable{reserved: make(map[string]map[string]string)}
+
+// usedLocked returns the values of key in the client configs of the other
+// volumes of the node, persisted or reserved, mapped to their volume.
+func (t *clientPortTable) usedLocked(key, volumeId string) map[string]string {
+	confs, _ := listClientConfs()
+	used := make(map[string]string)
+	for otherId, conf := range confs {
+		if otherId != volumeId && conf[key] != "" {
+			used[conf[key]] = otherId
+		}
+	}
+	for port, otherId := range t.reserved[key] {
+		if otherId != volumeId {
+			used[port] = otherId
+		}
+	}
+	return used
+}
+
+func (t *clientPortTable) reserveLocked(key, volumeId, port string) {
+	if t.reserved[key] == nil {
+		t.reserved[key] = make(map[string]string)
+	}
+	t.reserved[key][port] = volumeId
+}
+
+// claim reserves port for key of the volume, it fails if another client uses it.
+func (t *clientPortTable) claim(key, volumeId, port string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if owner, ok := t.usedLocked(key, volumeId)[port]; ok {
+		return fmt.Errorf("client option %s %s is already used by the client of volume %s", key, port, owner)
+	}
+	t.reserveLocked(key, volumeId, port)
+	return nil
+}
+
+// release drops the reservations of a volume, once its client config is
+// persisted or given up.
+func (t *clientPortTable) release(volumeId string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, ports := range t.reserved {
+		for port, owner := range ports {
+			if owner == volumeId {
+				delete(ports, port)
+			}
+		}
+	}
+}
+
+// allocateClientPort returns a port in [from, to] not used for key by another
+// client config of the node and free on the host network, and reserves it
+// until the volume releases its ports. A volume mounted again keeps its port.
+//
+// The node driver and the mount pods both run on the host network, so the
+// listen probe sees the ports of both mount modes; it only catches other
+// programs, as a client starting at the same time has not bound its port yet
+// and is known by its config.
+func allocateClientPort(key, volumeId string, from, to int) (int, error) {
+	if from < 1 || to > 65535 || from > to {
+		return 0, fmt.Errorf("invalid port range %d-%d", from, to)
+	}
+	clientPorts.mutex.Lock()
+	defer clientPorts.mutex.Unlock()
+	confs, _ := listClientConfs()
+	if port, err := strconv.Atoi(confs[volumeId][key]); err == nil && port >= from && port <= to {
+		clientPorts.reserveLocked(key, volumeId, strconv.Itoa(port))
+		return port, nil
+	}
+	used := clientPorts.usedLocked(key, volumeId)
+	for port := from; port <= to; port++ {
+		if _, ok := used[strconv.Itoa(port)]; ok {
+			continue
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		_ = listener.Close()
+		clientPorts.reserveLocked(key, volumeId, strconv.Itoa(port))
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port for %s in %d-%d", key, from, to)
+}
@@ -0,0 +1,203 @@
+package cubefs
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useTestLayout points the node layout at a temporary directory for the test.
+func useTestLayout(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	saved := layout
+	layout = newNodeLayout(DriverName, &Options{
+		ClientConfDir: filepath.Join(dir, "conf"),
+		ClientLogDir:  filepath.Join(dir, "logs"),
+		KubeletDir:    filepath.Join(dir, "kubelet"),
+	})
+	t.Cleanup(func() { layout = saved })
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadNodeClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"valid", "defaults:\n  logLevel: warn\n  readRate: 100\n  enableXattr: true\noverrides:\n  logDir: /logs/{{ .VolumeName }}\n", ""},
+		{"default logDir", "defaults:\n  logDir: /logs\n", "logDir cannot have a default"},
+		{"override owner", "overrides:\n  owner: root\n", "owner cannot be overridden"},
+		{"bad template", "defaults:\n  profPort: '{{ port 1 '\n", "invalid template of profPort"},
+		{"unknown field", "default:\n  logLevel: warn\n", "unknown field"},
+		{"nested value", "defaults:\n  logLevel:\n    level: warn\n", "must be a string, number or boolean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".yaml")
+			writeFile(t, path, tt.content)
+			config, err := loadNodeClientConfig(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if config.Defaults["readRate"] != "100" || config.Defaults["enableXattr"] != "true" {
+					t.Errorf("defaults = %v, want the numbers and booleans as strings", config.Defaults)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadNodeClientConfig() err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if config, err := loadNodeClientConfig(""); err != nil || len(config.Defaults) != 0 {
+		t.Errorf("loadNodeClientConfig(\"\") = %v, %v, want an empty config", config, err)
+	}
+}
+
+func TestValidateClientConf(t *testing.T) {
+	useTestLayout(t)
+	valid := func() map[string]string {
+		return map[string]string{
+			KMasterAddr: "127.0.0.1:17010",
+			KVolumeName: "pvc-1",
+			KMountPoint: "/mnt/pvc-1",
+			KLogDir:     "/cfs/logs/pvc-1",
+			KLogLevel:   "WARN",
+		}
+	}
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{"valid", "", "", false},
+		{"missing master", KMasterAddr, "", true},
+		{"bad log level", KLogLevel, "verbose", true},
+		{"bad integer", "readRate", "fast", true},
+		{"bad boolean", KKeepCache, "maybe", true},
+		{"bad port", "profPort", "70000", true},
+		{"port", "profPort", "17510", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := valid()
+			if tt.key != "" {
+				conf[tt.key] = tt.value
+			}
+			err := validateClientConf("vol-"+strings.ReplaceAll(tt.name, " ", "-"), conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateClientConf() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	clientPorts.release("vol-port")
+}
+
+func TestValidateClientConfPortInUse(t *testing.T) {
+	useTestLayout(t)
+	conf := func() map[string]string {
+		return map[string]string{
+			KMasterAddr: "127.0.0.1:17010",
+			KVolumeName: "pvc-1",
+			KMountPoint: "/mnt/pvc-1",
+			KLogDir:     "/cfs/logs/pvc-1",
+			"profPort":  "17520",
+		}
+	}
+	// the config of vol-a is not persisted yet, its port is only reserved
+	if err := validateClientConf("vol-a", conf()); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateClientConf("vol-b", conf()); err == nil || !strings.Contains(err.Error(), "vol-a") {
+		t.Fatalf("validateClientConf(vol-b) err = %v, want the port of vol-a refused", err)
+	}
+	// the volume itself may use its port again
+	if err := validateClientConf("vol-a", conf()); err != nil {
+		t.Fatal(err)
+	}
+
+	// once persisted, the config keeps the port taken
+	writeFile(t, clientConfFilePath("vol-a"), `{"profPort":"17520"}`)
+	clientPorts.release("vol-a")
+	if err := validateClientConf("vol-b", conf()); err == nil {
+		t.Fatal("validateClientConf(vol-b) accepted the port of the persisted config of vol-a")
+	}
+	if err := removeClientConf("vol-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateClientConf("vol-b", conf()); err != nil {
+		t.Fatal(err)
+	}
+	clientPorts.release("vol-b")
+}
+
+func TestAllocateClientPortConcurrently(t *testing.T) {
+	useTestLayout(t)
+	const volumes = 8
+	ports := make([]int, volumes)
+	errs := make([]error, volumes)
+	var wg sync.WaitGroup
+	for i := 0; i < volumes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ports[i], errs[i] = allocateClientPort("profPort", "vol-"+strconv.Itoa(i), 27510, 27610)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	for i, port := range ports {
+		if errs[i] != nil {
+			t.Fatalf("allocateClientPort(vol-%d): %v", i, errs[i])
+		}
+		if seen[port] {
+			t.Fatalf("port %d allocated twice: %v", port, ports)
+		}
+		seen[port] = true
+	}
+
+	// a volume allocating again keeps its reservation
+	port, err := allocateClientPort("profPort", "vol-0", 27510, 27610)
+	if err != nil || port != ports[0] {
+		t.Errorf("allocateClientPort(vol-0) again = %d, %v, want %d", port, err, ports[0])
+	}
+	for i := 0; i < volumes; i++ {
+		clientPorts.release("vol-" + strconv.Itoa(i))
+	}
+	if len(clientPorts.reserved["profPort"]) != 0 {
+		t.Errorf("reservations left after release: %v", clientPorts.reserved)
+	}
+}
+
+func TestAllocateClientPortKeepsPersistedPort(t *testing.T) {
+	useTestLayout(t)
+	writeFile(t, clientConfFilePath("vol-1"), `{"profPort":"27590"}`)
+	port, err := allocateClientPort("profPort", "vol-1", 27510, 27610)
+	clientPorts.release("vol-1")
+	if err != nil || port != 27590 {
+		t.Fatalf("allocateClientPort() = %d, %v, want the persisted 27590", port, err)
+	}
+	if _, err = allocateClientPort("profPort", "vol-1", 20, 10); err == nil {
+		t.Fatal("allocateClientPort accepted an empty range")
+	}
+}
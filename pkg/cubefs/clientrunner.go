@@ -0,0 +1,36 @@
+package cubefs
+
+import (
+	"context"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// MountMode is where the cubefs clients serving the node's volumes run.
+type MountMode string
+
+const (
+	// ProcessMountMode runs the cubefs clients inside the node driver container.
+	ProcessMountMode MountMode = "process"
+	// PodMountMode runs every cubefs client in a dedicated pod, so the clients
+	// survive restarts and upgrades of the node driver.
+	PodMountMode MountMode = "pod"
+)
+
+// clientRunner starts and stops the cubefs client mounting a volume from its
+// persisted client config.
+type clientRunner interface {
+	// start returns once the volume is mounted at mountPath.
+	start(ctx context.Context, volumeId, mountPath string) error
+	// stop releases what start created, the mount itself is unmounted by the caller.
+	stop(ctx context.Context, volumeId string) error
+}
+
+// newClientRunner runs the clients in mount pods or under a supervisor in the
+// driver container, onRestart is called when the supervisor restarted a crashed client.
+func newClientRunner(nodeId string, clientSet kubernetes.Interface, opts *Options, onRestart func(volumeId, mountPath string)) clientRunner {
+	if opts.MountMode == PodMountMode {
+		return newPodRunner(nodeId, clientSet, opts)
+	}
+	return newClientSupervisor(onRestart)
+}
@@ -3,8 +3,13 @@ package cubefs
 import (
 	"context"
 	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/majlu/my-cubefs-csi/pkg/mounter"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -12,24 +17,34 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
+	mountutils "k8s.io/mount-utils"
 )
 
 var (
 	controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 	}
 )
 
 type ControllerService struct {
-	ClientSet *kubernetes.Clientset
+	ClientSet kubernetes.Interface
+	options   *Options
+	// runner and mounter mount shared volumes to delete the directory of a PV
+	runner  clientRunner
+	mounter mounter.Mounter
 	csi.UnimplementedControllerServer
 }
 
 var _ csi.ControllerServer = (*ControllerService)(nil)
 
-func NewControllerService(clientSet *kubernetes.Clientset) *ControllerService {
+func NewControllerService(clientSet kubernetes.Interface, opts *Options) *ControllerService {
 	return &ControllerService{
 		ClientSet: clientSet,
+		options:   opts,
+		runner:    newClientSupervisor(nil),
+		mounter:   mounter.NewNodeMounter(),
 	}
 }
 
@@ -39,33 +54,67 @@ func (cs ControllerService) CreateVolume(ctx context.Context, request *csi.Creat
 		return nil, err
 	}
 
+	if err := validateVolumeCapabilities(request.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	start := time.Now()
 	capRange := request.GetCapacityRange()
 	if capRange == nil {
 		return nil, status.Error(codes.InvalidArgument, "apply for capacity range is nil")
 	}
-	// GB
-	capacityGB := (capRange.GetRequiredBytes()) >> 30
+	// GB, rounded up so the volume is at least as large as required
+	capacityGB := (capRange.GetRequiredBytes() + 1<<30 - 1) >> 30
 	if capacityGB == 0 {
 		return nil, status.Error(codes.InvalidArgument, "apply for at least 1GB of space")
 	}
 
 	volName := request.GetName()
 	klog.InfoS("Get request vol name", "volName", volName)
+	// the PVs of a StorageClass with a base directory share the volume it names
+	if request.Parameters[KBaseDir] != "" && request.Parameters[KVolumeName] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s needs %s, the volume the PVs share", KBaseDir, KVolumeName)
+	}
+	ownerGiven := request.Parameters[KOwner] != ""
 	cfsServer, err := NewCfsServer(volName, request.Parameters)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	if err = setVolumeSubdir(cfsServer.clientConf, volName); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err = subdirOnDelete(cfsServer.clientConf); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err = volumeOwnership(cfsServer.clientConf); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err = parseAllowedNamespaces(cfsServer.clientConf); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err = mountPodResources(request.Parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	if err = cfsServer.createVolume(capacityGB); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if cfsServer.clientConf[KBaseDir] != "" {
+		if err = useSharedVolumeOwner(ctx, cfsServer, ownerGiven); err != nil {
+			return nil, toGRPCError(err, codes.Internal)
+		}
+	}
+	if err = cfsServer.createVolume(ctx, capacityGB); err != nil {
+		return nil, toGRPCError(err, codes.Internal)
+	}
+	if cs.options.VolumeReadyTimeout > 0 {
+		if err = cfsServer.waitVolumeReady(ctx, cs.options.VolumeReadyTimeout, cs.options.MinWritableDataPartitions); err != nil {
+			return nil, toGRPCError(err, codes.Internal)
+		}
 	}
 	duration := time.Since(start)
 	klog.InfoS("Created volume success", "volName", volName, "cost", duration)
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volName,
-			CapacityBytes: capRange.RequiredBytes,
+			CapacityBytes: capacityGB << 30,
 			VolumeContext: cfsServer.clientConf,
 		},
 	}
@@ -85,15 +134,26 @@ func (cs ControllerService) DeleteVolume(ctx context.Context, request *csi.Delet
 		return nil, status.Errorf(codes.InvalidArgument, "not found PersistentVolume[%v], error:%v", volumeName, err)
 	}
 
+	subdir, err := persistentVolumeSubdir(persistentVolume)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	param := persistentVolume.Spec.CSI.VolumeAttributes
 	cfsServer, err := NewCfsServer(volumeName, param)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	// the volume may be shared with other PVs, only the directory is the PV's own
+	if subdir != "" {
+		if err = cs.reclaimSubdir(ctx, volumeName, cfsServer, subdir); err != nil {
+			return nil, toGRPCError(err, codes.Internal)
+		}
+		return &csi.DeleteVolumeResponse{}, nil
+	}
 
-	err = cfsServer.deleteVolume()
+	err = cfsServer.deleteVolume(ctx)
 	if err != nil {
-		return nil, status.Error(codes.Unknown, err.Error())
+		return nil, toGRPCError(err, codes.Internal)
 	} else {
 		klog.V(0).InfoS("Deleted volume", "volName", volumeName)
 	}
@@ -101,6 +161,85 @@ func (cs ControllerService) DeleteVolume(ctx context.Context, request *csi.Delet
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// useSharedVolumeOwner gives a PV the owner of the volume it shares with the
+// other PVs of its StorageClass, a random owner would only fit the PV which
+// created the volume. A given owner must be the volume's.
+func useSharedVolumeOwner(ctx context.Context, cfsServer *CfsServer, ownerGiven bool) error {
+	view, err := cfsServer.getVolume(ctx)
+	if IsVolNotExists(err) {
+		// the first PV creates the volume
+		return nil
+	} else if err != nil {
+		return err
+	}
+	volName := cfsServer.clientConf[KVolumeName]
+	if !ownerGiven {
+		klog.InfoS("Using the owner of the shared volume", "volName", volName)
+		cfsServer.clientConf[KOwner] = view.Owner
+		return nil
+	}
+	if view.Owner != cfsServer.clientConf[KOwner] {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is not owned by the %s parameter", volName, KOwner)
+	}
+	return nil
+}
+
+// reclaimSubdir deletes the directory of a deleted PV from its volume or keeps
+// it, as KOnDelete says. The directory is deleted with a client the controller
+// runs for the time of the call.
+func (cs ControllerService) reclaimSubdir(ctx context.Context, volumeId string, cfsServer *CfsServer, subdir string) error {
+	volName := cfsServer.clientConf[KVolumeName]
+	policy, err := subdirOnDelete(cfsServer.clientConf)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if policy == onDeleteRetain {
+		klog.InfoS("Deleted volume, its directory is retained", "volumeId", volumeId, "volName", volName, "subdir", subdir)
+		return nil
+	}
+
+	mountPath := filepath.Join(layout.reclaimMountDir(), volumeId)
+	if err = os.MkdirAll(mountPath, 0755); err != nil {
+		return status.Errorf(codes.Internal, "create mount path: %v", err)
+	}
+	for _, key := range driverAttributes {
+		delete(cfsServer.clientConf, key)
+	}
+	if err = cfsServer.persistClientConf(mountPath); err != nil {
+		return err
+	}
+	defer func() {
+		// the client must not outlive the request
+		stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), clientStopTimeout)
+		defer cancel()
+		if err := cs.runner.stop(stopCtx, volumeId); err != nil {
+			klog.ErrorS(err, "Failed to stop cubefs client", "volumeId", volumeId)
+		}
+		if err := mountutils.CleanupMountPoint(mountPath, cs.mounter, false); err != nil {
+			klog.ErrorS(err, "Failed to clean up mount path", "volumeId", volumeId, "mountPath", mountPath)
+		}
+		if err := removeClientConf(volumeId); err != nil {
+			klog.ErrorS(err, "Failed to remove client config file", "volumeId", volumeId)
+		}
+	}()
+	if err = cs.runner.start(ctx, volumeId, mountPath); err != nil {
+		return fmt.Errorf("mount volume %s: %w", volName, err)
+	}
+
+	dir, err := ensureSubdir(mountPath, subdir, false)
+	if status.Code(err) == codes.NotFound {
+		klog.InfoS("Deleted volume, its directory is already gone", "volumeId", volumeId, "volName", volName, "subdir", subdir)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return status.Errorf(codes.Internal, "delete directory %s of volume %s: %v", subdir, volName, err)
+	}
+	klog.InfoS("Deleted volume and its directory", "volumeId", volumeId, "volName", volName, "subdir", subdir)
+	return nil
+}
+
 func (cs ControllerService) ControllerPublishVolume(ctx context.Context, request *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	//TODO implement me
 	panic("implement me")
@@ -112,8 +251,39 @@ func (cs ControllerService) ControllerUnpublishVolume(ctx context.Context, reque
 }
 
 func (cs ControllerService) ValidateVolumeCapabilities(ctx context.Context, request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	//TODO implement me
-	panic("implement me")
+	klog.V(4).InfoS("ValidateVolumeCapabilities: called", "args", request)
+	volumeId := request.GetVolumeId()
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing in request")
+	}
+	if len(request.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities missing in request")
+	}
+
+	// the master addresses are only known from the volume context
+	if request.GetVolumeContext()[KMasterAddr] != "" {
+		cfsServer, err := NewCfsServer(volumeId, maps.Clone(request.GetVolumeContext()))
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if _, err = cfsServer.getVolume(ctx); err != nil {
+			if IsVolNotExists(err) {
+				return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeId)
+			}
+			return nil, toGRPCError(err, codes.Internal)
+		}
+	}
+
+	if err := validateVolumeCapabilities(request.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      request.GetVolumeContext(),
+			VolumeCapabilities: request.GetVolumeCapabilities(),
+			Parameters:         request.GetParameters(),
+		},
+	}, nil
 }
 
 func (cs ControllerService) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
@@ -155,7 +325,47 @@ func (cs ControllerService) ListSnapshots(ctx context.Context, request *csi.List
 }
 
 func (cs ControllerService) ControllerExpandVolume(ctx context.Context, request *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return &csi.ControllerExpandVolumeResponse{}, nil
+	klog.V(4).InfoS("ControllerExpandVolume: called", "args", request)
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		return nil, err
+	}
+
+	capRange := request.GetCapacityRange()
+	if capRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "apply for capacity range is nil")
+	}
+	// GB, rounded up so the volume is at least as large as required
+	capacityGB := (capRange.GetRequiredBytes() + 1<<30 - 1) >> 30
+	if capacityGB == 0 {
+		return nil, status.Error(codes.InvalidArgument, "apply for at least 1GB of space")
+	}
+
+	volumeName := request.GetVolumeId()
+	persistentVolume, err := cs.queryPersistentVolumes(ctx, volumeName)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "not found PersistentVolume[%v], error:%v", volumeName, err)
+	}
+
+	// the capacity is the volume's, which other PVs may share
+	if subdir, err := persistentVolumeSubdir(persistentVolume); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	} else if subdir != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s exposes the directory %s of its volume, it cannot be expanded", volumeName, subdir)
+	}
+	cfsServer, err := NewCfsServer(volumeName, persistentVolume.Spec.CSI.VolumeAttributes)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err = cfsServer.expandVolume(ctx, capacityGB); err != nil {
+		return nil, toGRPCError(err, codes.Internal)
+	}
+	klog.InfoS("Expanded volume", "volName", volumeName, "capacityGB", capacityGB)
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacityGB << 30,
+		NodeExpansionRequired: false,
+	}, nil
 }
 
 func (cs ControllerService) ControllerGetVolume(ctx context.Context, request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
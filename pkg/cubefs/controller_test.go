@@ -0,0 +1,347 @@
+package cubefs
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/majlu/my-cubefs-csi/pkg/fakemaster"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// startFakeMaster serves a fake master for the test and returns its address.
+func startFakeMaster(t *testing.T, cfg fakemaster.Config) string {
+	t.Helper()
+	cfg.Addrs = []string{"127.0.0.1:0"}
+	fm, err := fakemaster.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(fm.Handler())
+	t.Cleanup(ts.Close)
+	return strings.TrimPrefix(ts.URL, "http://")
+}
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func newTestControllerService(opts *Options) *ControllerService {
+	return NewControllerService(fake.NewSimpleClientset(), opts)
+}
+
+// addPersistentVolume records the PV the provisioner creates for a volume.
+func addPersistentVolume(t *testing.T, cs *ControllerService, volume *csi.Volume) {
+	t.Helper()
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: volume.VolumeId},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:           DriverName,
+					VolumeHandle:     volume.VolumeId,
+					VolumeAttributes: volume.VolumeContext,
+				},
+			},
+		},
+	}
+	if _, err := cs.ClientSet.CoreV1().PersistentVolumes().Create(context.Background(), pv, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerVolumeLifecycle(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		pinned  string
+	}{
+		{"master 3.3.0", "3.3.0", ""},
+		{"master 2.4.0", "2.4.0", ""},
+		{"master without version", "", "2.4.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			masterAddr := startFakeMaster(t, fakemaster.Config{Version: tt.version})
+			cs := newTestControllerService(&Options{})
+			caps := []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+			params := map[string]string{KMasterAddr: masterAddr, KOwner: "csi-test"}
+			if tt.pinned != "" {
+				params[KMasterVersion] = tt.pinned
+			}
+			createReq := &csi.CreateVolumeRequest{
+				Name:               "pvc-0b7a3c1e",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 10<<30 - 1},
+				VolumeCapabilities: caps,
+				Parameters:         params,
+			}
+
+			created, err := cs.CreateVolume(ctx, createReq)
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			volume := created.GetVolume()
+			if volume.VolumeId != "pvc-0b7a3c1e" || volume.VolumeContext[KOwner] != "csi-test" || volume.VolumeContext[KMasterAddr] != masterAddr {
+				t.Fatalf("CreateVolume volume = %+v", volume)
+			}
+			if volume.CapacityBytes != 10<<30 {
+				t.Errorf("CreateVolume capacity = %d, want the required bytes rounded up to 10GiB", volume.CapacityBytes)
+			}
+			// a retry of the provisioner finds the volume created
+			if _, err = cs.CreateVolume(ctx, createReq); err != nil {
+				t.Fatalf("CreateVolume again: %v", err)
+			}
+			addPersistentVolume(t, cs, volume)
+
+			validateReq := &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           volume.VolumeId,
+				VolumeContext:      volume.VolumeContext,
+				VolumeCapabilities: caps,
+			}
+			validated, err := cs.ValidateVolumeCapabilities(ctx, validateReq)
+			if err != nil || validated.GetConfirmed() == nil {
+				t.Fatalf("ValidateVolumeCapabilities = %v, %v, want confirmed", validated, err)
+			}
+
+			expanded, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+				VolumeId:      volume.VolumeId,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 20<<30 - 1},
+			})
+			if err != nil {
+				t.Fatalf("ControllerExpandVolume: %v", err)
+			}
+			if expanded.CapacityBytes != 20<<30 {
+				t.Errorf("ControllerExpandVolume capacity = %d, want 20GiB", expanded.CapacityBytes)
+			}
+
+			if _, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.VolumeId}); err != nil {
+				t.Fatalf("DeleteVolume: %v", err)
+			}
+			// deleting a deleted volume succeeds
+			if _, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.VolumeId}); err != nil {
+				t.Fatalf("DeleteVolume again: %v", err)
+			}
+			if _, err = cs.ValidateVolumeCapabilities(ctx, validateReq); status.Code(err) != codes.NotFound {
+				t.Fatalf("ValidateVolumeCapabilities after delete: err = %v, want NotFound", err)
+			}
+		})
+	}
+}
+
+func TestControllerCreateVolumeErrors(t *testing.T) {
+	ctx := context.Background()
+	v3 := startFakeMaster(t, fakemaster.Config{Version: "3.3.0", CapacityGB: 100})
+	v2 := startFakeMaster(t, fakemaster.Config{Version: "2.4.0"})
+	unversioned := startFakeMaster(t, fakemaster.Config{})
+	cs := newTestControllerService(&Options{})
+	caps := []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}
+
+	tests := []struct {
+		name       string
+		volName    string
+		capacityGB int64
+		params     map[string]string
+		want       codes.Code
+	}{
+		{"cluster full", "pvc-full", 200, map[string]string{KMasterAddr: v3}, codes.ResourceExhausted},
+		{"volume type on 2.x", "pvc-ec", 1, map[string]string{KMasterAddr: v2, KVolType: "1"}, codes.InvalidArgument},
+		{"no version", "pvc-noversion", 1, map[string]string{KMasterAddr: unversioned}, codes.FailedPrecondition},
+		{"invalid version", "pvc-badversion", 1, map[string]string{KMasterAddr: v3, KMasterVersion: "latest"}, codes.InvalidArgument},
+		{"invalid name", "pvc;x", 1, map[string]string{KMasterAddr: v3}, codes.InvalidArgument},
+		{"no master", "pvc-nomaster", 1, map[string]string{}, codes.InvalidArgument},
+		{"less than 1GB", "pvc-small", 0, map[string]string{KMasterAddr: v3}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:               tt.volName,
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: tt.capacityGB << 30},
+				VolumeCapabilities: caps,
+				Parameters:         tt.params,
+			})
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("CreateVolume code = %v, want %v (err %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestControllerDeleteVolumeWrongOwner(t *testing.T) {
+	ctx := context.Background()
+	masterAddr := startFakeMaster(t, fakemaster.Config{Version: "3.3.0"})
+	cs := newTestControllerService(&Options{})
+	created, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-owned",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{KMasterAddr: masterAddr, KOwner: "owner-a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := created.GetVolume()
+	volume.VolumeContext[KOwner] = "owner-b"
+	addPersistentVolume(t, cs, volume)
+
+	if _, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.VolumeId}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("DeleteVolume with another owner: err = %v, want PermissionDenied", err)
+	}
+}
+
+func TestControllerSharedVolume(t *testing.T) {
+	ctx := context.Background()
+	useTestLayout(t)
+	masterAddr := startFakeMaster(t, fakemaster.Config{Version: "3.3.0"})
+	cs := newTestControllerService(&Options{})
+	m := &fakeMounter{mountPoints: make(map[string]error)}
+	runner := &fakeRunner{mounter: m}
+	cs.runner, cs.mounter = runner, m
+
+	create := func(name string, params map[string]string) (*csi.Volume, error) {
+		created, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+			Parameters:         params,
+		})
+		return created.GetVolume(), err
+	}
+	class := func(extra ...string) map[string]string {
+		params := map[string]string{KMasterAddr: masterAddr, KVolumeName: "shared", KBaseDir: "pvs"}
+		for i := 0; i < len(extra); i += 2 {
+			params[extra[i]] = extra[i+1]
+		}
+		return params
+	}
+
+	volA, err := create("pvc-a", class(KOnDelete, onDeleteDelete))
+	if err != nil {
+		t.Fatal(err)
+	}
+	volB, err := create("pvc-b", class())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volA.VolumeContext[KOwner] == "" || volB.VolumeContext[KOwner] != volA.VolumeContext[KOwner] {
+		t.Fatalf("owners = %q and %q, want the owner of the shared volume for both", volA.VolumeContext[KOwner], volB.VolumeContext[KOwner])
+	}
+	if _, err = create("pvc-c", class(KOwner, "someone-else")); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CreateVolume with another owner: err = %v, want FailedPrecondition", err)
+	}
+	if _, err = create("pvc-d", map[string]string{KMasterAddr: masterAddr, KBaseDir: "pvs"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateVolume with a base dir and no volume name: err = %v, want InvalidArgument", err)
+	}
+	if _, err = create("pvc-e", class(KOnDelete, "archive")); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateVolume with an unknown onDelete: err = %v, want InvalidArgument", err)
+	}
+	addPersistentVolume(t, cs, volA)
+	addPersistentVolume(t, cs, volB)
+
+	_, err = cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volA.VolumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ControllerExpandVolume of a shared volume: err = %v, want InvalidArgument", err)
+	}
+
+	// the fake runner mounts nothing, the mount path stands for the volume
+	mountPath := filepath.Join(layout.reclaimMountDir(), volA.VolumeId)
+	writeFile(t, filepath.Join(mountPath, "pvs", "pvc-a", "data"), "a")
+	writeFile(t, filepath.Join(mountPath, "pvs", "pvc-b", "data"), "b")
+	if _, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volA.VolumeId}); err != nil {
+		t.Fatalf("DeleteVolume: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(mountPath, "pvs", "pvc-a")); !os.IsNotExist(err) {
+		t.Errorf("directory of the deleted volume: stat err = %v, want it deleted", err)
+	}
+	if _, err = os.Stat(filepath.Join(mountPath, "pvs", "pvc-b", "data")); err != nil {
+		t.Errorf("directory of the other volume: %v", err)
+	}
+	if !slices.Equal(runner.started, []string{"pvc-a"}) || !slices.Equal(runner.stopped, []string{"pvc-a"}) || len(m.mountPoints) != 0 {
+		t.Errorf("clients started %v, stopped %v, mounts left %v, want one client for the delete", runner.started, runner.stopped, m.mountPoints)
+	}
+	if _, err = os.Stat(clientConfFilePath(volA.VolumeId)); !os.IsNotExist(err) {
+		t.Errorf("client config of the delete: stat err = %v, want it removed", err)
+	}
+
+	// the directory of pvc-b is retained by default
+	if _, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volB.VolumeId}); err != nil {
+		t.Fatalf("DeleteVolume: %v", err)
+	}
+	if len(runner.started) != 1 {
+		t.Errorf("clients started %v, want none for a retained directory", runner.started)
+	}
+	validated, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volB.VolumeId,
+		VolumeContext:      volB.VolumeContext,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+	})
+	if err != nil || validated.GetConfirmed() == nil {
+		t.Fatalf("ValidateVolumeCapabilities after deleting the PVs = %v, %v, want the shared volume kept", validated, err)
+	}
+}
+
+func TestControllerCreateVolumeWaitsReady(t *testing.T) {
+	interval := volumeReadyPollInterval
+	volumeReadyPollInterval = 50 * time.Millisecond
+	t.Cleanup(func() { volumeReadyPollInterval = interval })
+
+	tests := []struct {
+		name       string
+		readyDelay time.Duration
+		timeout    time.Duration
+		minRwDp    int
+		want       codes.Code
+	}{
+		{"ready at once", 0, time.Second, 1, codes.OK},
+		{"ready later", time.Second, 10 * time.Second, 1, codes.OK},
+		{"never ready", time.Hour, time.Second, 1, codes.DeadlineExceeded},
+		{"too few partitions", 0, time.Second, 1000, codes.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			masterAddr := startFakeMaster(t, fakemaster.Config{Version: "3.3.0", ReadyDelay: tt.readyDelay})
+			cs := newTestControllerService(&Options{VolumeReadyTimeout: tt.timeout, MinWritableDataPartitions: tt.minRwDp})
+			_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "pvc-ready",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+				Parameters:         map[string]string{KMasterAddr: masterAddr},
+			})
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("CreateVolume code = %v, want %v (err %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestWaitVolumeReadyMissingVolume(t *testing.T) {
+	interval := volumeReadyPollInterval
+	volumeReadyPollInterval = 50 * time.Millisecond
+	t.Cleanup(func() { volumeReadyPollInterval = interval })
+
+	masterAddr := startFakeMaster(t, fakemaster.Config{Version: "3.3.0"})
+	cfsServer, err := NewCfsServer("pvc-missing", map[string]string{KMasterAddr: masterAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfsServer.waitVolumeReady(context.Background(), 300*time.Millisecond, 1)
+	if status.Code(err) != codes.DeadlineExceeded || !strings.Contains(err.Error(), "last error") {
+		t.Fatalf("waitVolumeReady() = %v, want DeadlineExceeded with the last error", err)
+	}
+}
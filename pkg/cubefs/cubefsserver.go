@@ -1,13 +1,14 @@
 package cubefs
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 )
 
@@ -30,30 +32,49 @@ const (
 )
 
 const (
-	defaultClientConfPath = "/cfs/conf/"
-	defaultLogDir         = "/cfs/logs/"
-	defaultLogLevel       = "info"
-	jsonFileSuffix        = ".json"
-	defaultConsulAddr     = "http://consul-service.cubefs.svc.cluster.local:8500"
-	defaultVolType        = "0"
+	defaultLogLevel   = "info"
+	jsonFileSuffix    = ".json"
+	defaultConsulAddr = "http://consul-service.cubefs.svc.cluster.local:8500"
+	defaultVolType    = "0"
 )
-const (
-	ErrCodeVolNotExists = 7
 
-	ErrDuplicateVolMsg = "duplicate vol"
-)
+// volumeReadyPollInterval is how often waitVolumeReady asks the master, tests shorten it.
+var volumeReadyPollInterval = time.Second
+
+// volumeNameRe is the rule of the masters for volume names, the name also ends
+// up in the paths of the client logs.
+var volumeNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{1,61}[a-zA-Z0-9]$`)
 
 type CfsServer struct {
 	clientConfFile string
-	masterAddrs    []string
+	client         *masterClient
 	clientConf     map[string]string
 }
 
-// Create and Delete Volume Response
+// Master Response, Data is a message string or a JSON object depending on the API
 type cfsServerResponse struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
-	Data string `json:"data,omitempty"`
+	Code int             `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// volumeView is the part of the master's SimpleVolView the driver uses
+type volumeView struct {
+	Name     string `json:"Name"`
+	Owner    string `json:"Owner"`
+	Status   uint8  `json:"Status"`
+	Capacity uint64 `json:"Capacity"`
+	DpCnt    int    `json:"DpCnt"`
+	RwDpCnt  int    `json:"RwDpCnt"`
+	MpCnt    int    `json:"MpCnt"`
+}
+
+const (
+	volStatusNormal = 0
+)
+
+func (v *volumeView) String() string {
+	return fmt.Sprintf("status(%d) rwDpCnt(%d/%d) mpCnt(%d)", v.Status, v.RwDpCnt, v.DpCnt, v.MpCnt)
 }
 
 func NewCfsServer(volName string, param map[string]string) (cs *CfsServer, err error) {
@@ -63,84 +84,141 @@ func NewCfsServer(volName string, param map[string]string) (cs *CfsServer, err e
 	}
 
 	newVolName := getValueWithDefault(param, KVolumeName, volName)
-	clientConfFile := defaultClientConfPath + newVolName + jsonFileSuffix
+	if !volumeNameRe.MatchString(newVolName) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume name %q, it must match %s", newVolName, volumeNameRe)
+	}
+	clientConfFile := clientConfFilePath(volName)
 	// Owner ID can be a random string
 	newOwner := util.ShortenString(fmt.Sprintf("csi_%d", time.Now().UnixNano()), 20)
 	param[KMasterAddr] = masterAddr
 	param[KVolumeName] = newVolName
 	param[KOwner] = getValueWithDefault(param, KOwner, newOwner)
 	param[KLogLevel] = getValueWithDefault(param, KLogLevel, defaultLogLevel)
-	param[KLogDir] = defaultLogDir + newVolName
+	param[KLogDir] = clientConfLogDir(param)
 	// Consul address may be no effect if storage class is not set the param
 	param[KConsulAddr] = getValueWithDefault(param, KConsulAddr, defaultConsulAddr)
 	param[KVolType] = getValueWithDefault(param, KVolType, defaultVolType)
 	return &CfsServer{
 		clientConfFile: clientConfFile,
-		masterAddrs:    strings.Split(masterAddr, ","),
+		client:         masterClients.get(masterAddr),
 		clientConf:     param,
 	}, err
 }
 
-func (cs *CfsServer) createVolume(capacityGB int64) (err error) {
+func (cs *CfsServer) createVolume(ctx context.Context, capacityGB int64) (err error) {
 	valName := cs.clientConf[KVolumeName]
 	owner := cs.clientConf[KOwner]
 	volType := cs.clientConf[KVolType]
 
-	return cs.forEachMasterAddr("CreateVolume", func(addr string) error {
-		url := fmt.Sprintf("http://%s/admin/createVol?name=%s&capacity=%v&owner=%v&volType=%v",
-			addr, valName, capacityGB, owner, volType)
+	dialect, version, err := cs.client.getDialect(ctx, cs.clientConf[KMasterVersion])
+	if err != nil {
+		return err
+	}
+	if unsupported := dialect.unsupportedFeatures(cs.clientConf); len(unsupported) > 0 {
+		return status.Errorf(codes.InvalidArgument, "master version %s of cluster %s does not support: %s",
+			version, cs.client.cluster, strings.Join(unsupported, ", "))
+	}
+
+	return cs.client.forEachMasterAddr(ctx, "CreateVolume", func(addr string) error {
+		url := dialect.createVolURL(addr, valName, owner, volType, capacityGB)
 		klog.InfoS("createVol url", "url", url)
-		resp, err := cs.executeRequest(url)
+		resp, err := cs.client.executeDialectRequest(ctx, url)
 		if err != nil {
 			return err
 		}
 
-		if resp.Code != 0 {
-			if strings.Contains(resp.Msg, ErrDuplicateVolMsg) {
+		if resp.Code != ErrCodeSuccess {
+			err := NewCfsError(resp.Code, resp.Msg)
+			if IsDuplicateVol(err) {
 				klog.InfoS("duplicate to create volume. ", "url", url, "msg", resp.Msg)
 				return nil
 			}
 
-			return fmt.Errorf("create volume failed: url(%v) code=(%v), msg: %v", url, resp.Code, resp.Msg)
+			return fmt.Errorf("create volume failed: url(%v): %w", url, err)
 		}
 
 		return nil
 	})
 }
 
-func (cs *CfsServer) executeRequest(url string) (*cfsServerResponse, error) {
-	httpResp, err := http.Get(url)
+func (cs *CfsServer) getVolume(ctx context.Context) (view *volumeView, err error) {
+	valName := cs.clientConf[KVolumeName]
+	dialect, _, err := cs.client.getDialect(ctx, cs.clientConf[KMasterVersion])
 	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "request url failed, url(%v) err(%v)", url, err)
+		return nil, err
 	}
 
-	defer httpResp.Body.Close()
-	body, err := io.ReadAll(httpResp.Body)
-	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "read http response body, url(%v) bodyLen(%v) err(%v)", url, len(body), err)
-	}
+	err = cs.client.forEachMasterAddr(ctx, "GetVolume", func(addr string) error {
+		url := dialect.getVolURL(addr, valName)
+		klog.V(5).InfoS("getVol url", "url", url)
+		resp, err := cs.client.executeDialectRequest(ctx, url)
+		if err != nil {
+			return err
+		}
 
-	resp := &cfsServerResponse{}
-	if err = json.Unmarshal(body, resp); err != nil {
-		return nil, status.Errorf(codes.Unavailable, "unmarshal http response body, url(%v) msg(%v) err(%v)", url, resp.Msg, err)
-	}
-	return resp, nil
+		if resp.Code != ErrCodeSuccess {
+			return fmt.Errorf("get volume[%s] is failed: %w", valName, NewCfsError(resp.Code, resp.Msg))
+		}
+
+		view = &volumeView{}
+		if err = json.Unmarshal(resp.Data, view); err != nil {
+			return status.Errorf(codes.Internal, "unmarshal volume[%s] view, data(%s) err(%v)",
+				valName, util.ShortenString(string(resp.Data), 256), err)
+		}
+		return nil
+	})
+	return view, err
 }
 
-func (cs *CfsServer) forEachMasterAddr(stage string, f func(addr string) error) (err error) {
-	for _, addr := range cs.masterAddrs {
-		if err = f(addr); err == nil {
-			break
+// waitVolumeReady polls the master until the volume is normal and has at least
+// minRwDp writable data partitions, so the first mount does not fail.
+func (cs *CfsServer) waitVolumeReady(ctx context.Context, timeout time.Duration, minRwDp int) error {
+	valName := cs.clientConf[KVolumeName]
+	var view *volumeView
+	var lastErr error
+	err := wait.PollUntilContextTimeout(ctx, volumeReadyPollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		v, err := cs.getVolume(ctx)
+		if err != nil && (ctx.Err() != nil || status.Code(err) == codes.DeadlineExceeded) {
+			// cut by the deadline, reported below
+			return false, nil
+		}
+		if err != nil {
+			lastErr = err
+			// the volume may not be visible yet on the master we asked
+			if IsVolNotExists(err) || isRetryable(err) {
+				return false, nil
+			}
+			return false, err
 		}
-		klog.ErrorS(err, "try master addr failed", "stage", stage, "addr", addr)
-	}
 
-	if err != nil {
-		klog.ErrorS(err, "Failed with all masters", "stage", stage)
+		view, lastErr = v, nil
+		klog.V(4).InfoS("Waiting for volume ready", "volName", valName, "view", view.String())
+		return view.Status == volStatusNormal && view.RwDpCnt >= minRwDp, nil
+	})
+	if err == nil {
+		return nil
+	}
+	if !wait.Interrupted(err) {
 		return err
 	}
 
-	return nil
+	state := "unknown"
+	if view != nil {
+		state = view.String()
+	}
+	if lastErr != nil {
+		state = fmt.Sprintf("%s, last error: %v", state, lastErr)
+	}
+	return status.Errorf(codes.DeadlineExceeded, "volume[%s] not ready after %v, want status(%d) and at least %d writable data partitions, got %s",
+		valName, timeout, volStatusNormal, minRwDp, state)
+}
+
+// clientConfLogDir is the log directory of a client, per pod if the client only serves one pod.
+func clientConfLogDir(param map[string]string) string {
+	if param[KPodName] != "" {
+		return filepath.Join(layout.logDir, param[KPodNamespace], param[KPodName], param[KVolumeName])
+	}
+	return filepath.Join(layout.logDir, param[KVolumeName])
 }
 
 func getValueWithDefault(param map[string]string, key string, defaultValue string) string {
@@ -154,7 +232,10 @@ func getValueWithDefault(param map[string]string, key string, defaultValue strin
 
 func (cs *CfsServer) persistClientConf(mountPoint string) error {
 	cs.clientConf[KMountPoint] = mountPoint
-	_ = os.Mkdir(cs.clientConf[KLogDir], 0777)
+	_ = os.MkdirAll(cs.clientConf[KLogDir], 0777)
+	if err := os.MkdirAll(filepath.Dir(cs.clientConfFile), 0755); err != nil {
+		return status.Errorf(codes.Internal, "create client config directory fail. err: %v", err.Error())
+	}
 	clientConfBytes, _ := json.Marshal(cs.clientConf)
 	err := os.WriteFile(cs.clientConfFile, clientConfBytes, 0444)
 	if err != nil {
@@ -165,32 +246,115 @@ func (cs *CfsServer) persistClientConf(mountPoint string) error {
 	return nil
 }
 
-func (cs *CfsServer) runClient() error {
-	return MountVolume(cs.clientConfFile)
+// clientConfFilePath is the client config file of a volume, named after the
+// volume ID so NodeUnstageVolume can find it.
+func clientConfFilePath(volumeId string) string {
+	return filepath.Join(layout.confDir, volumeId+jsonFileSuffix)
 }
 
-func (cs *CfsServer) deleteVolume() (err error) {
+func removeClientConf(volumeId string) error {
+	if err := os.Remove(clientConfFilePath(volumeId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// listClientConfs reads every persisted client config, keyed by volume ID.
+func listClientConfs() (map[string]map[string]string, error) {
+	entries, err := os.ReadDir(layout.confDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	confs := make(map[string]map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), jsonFileSuffix) {
+			continue
+		}
+		volumeId := strings.TrimSuffix(entry.Name(), jsonFileSuffix)
+		data, err := os.ReadFile(clientConfFilePath(volumeId))
+		if err != nil {
+			klog.ErrorS(err, "Failed to read client config file", "volumeId", volumeId)
+			continue
+		}
+		conf := make(map[string]string)
+		if err = json.Unmarshal(data, &conf); err != nil {
+			klog.ErrorS(err, "Failed to decode client config file", "volumeId", volumeId)
+			continue
+		}
+		confs[volumeId] = conf
+	}
+	return confs, nil
+}
+
+func (cs *CfsServer) deleteVolume(ctx context.Context) (err error) {
 	ownerMd5, err := cs.getOwnerMd5()
 	if err != nil {
 		return err
 	}
 
 	valName := cs.clientConf[KVolumeName]
-	return cs.forEachMasterAddr("DeleteVolume", func(addr string) error {
-		url := fmt.Sprintf("http://%s/vol/delete?name=%s&authKey=%v", addr, valName, ownerMd5)
+	dialect, _, err := cs.client.getDialect(ctx, cs.clientConf[KMasterVersion])
+	if err != nil {
+		return err
+	}
+
+	return cs.client.forEachMasterAddr(ctx, "DeleteVolume", func(addr string) error {
+		url := dialect.deleteVolURL(addr, valName, ownerMd5)
 		klog.InfoS("deleteVol url", "url", url)
-		resp, err := cs.executeRequest(url)
+		resp, err := cs.client.executeDialectRequest(ctx, url)
 		if err != nil {
 			return err
 		}
 
-		if resp.Code != 0 {
-			if resp.Code == ErrCodeVolNotExists {
+		if resp.Code != ErrCodeSuccess {
+			err := NewCfsError(resp.Code, resp.Msg)
+			if IsVolNotExists(err) {
 				klog.InfoS("volume not exists, assuming the volume has already been deleted.",
 					"volName", valName, "respCode", resp.Code, "msg", resp.Msg)
 				return nil
 			}
-			return fmt.Errorf("delete volume[%s] is failed. code:%v, msg:%v", valName, resp.Code, resp.Msg)
+			return fmt.Errorf("delete volume[%s] is failed: %w", valName, err)
+		}
+
+		return nil
+	})
+}
+
+// expandVolume grows the volume to capacityGB, a volume already that large is left alone.
+func (cs *CfsServer) expandVolume(ctx context.Context, capacityGB int64) error {
+	view, err := cs.getVolume(ctx)
+	if err != nil {
+		return err
+	}
+	valName := cs.clientConf[KVolumeName]
+	if int64(view.Capacity) >= capacityGB {
+		klog.InfoS("volume capacity is already enough, skip expanding", "volName", valName,
+			"capacityGB", view.Capacity, "requiredGB", capacityGB)
+		return nil
+	}
+
+	ownerMd5, err := cs.getOwnerMd5()
+	if err != nil {
+		return err
+	}
+	dialect, _, err := cs.client.getDialect(ctx, cs.clientConf[KMasterVersion])
+	if err != nil {
+		return err
+	}
+
+	return cs.client.forEachMasterAddr(ctx, "ExpandVolume", func(addr string) error {
+		url := dialect.expandVolURL(addr, valName, ownerMd5, capacityGB)
+		klog.InfoS("expandVol url", "url", url)
+		resp, err := cs.client.executeDialectRequest(ctx, url)
+		if err != nil {
+			return err
+		}
+
+		if resp.Code != ErrCodeSuccess {
+			return fmt.Errorf("expand volume[%s] is failed: %w", valName, NewCfsError(resp.Code, resp.Msg))
 		}
 
 		return nil
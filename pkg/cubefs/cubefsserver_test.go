@@ -0,0 +1,36 @@
+package cubefs
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewCfsServerVolumeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		volName string
+		wantErr bool
+	}{
+		{"pv name", "pvc-0b7a3c1e-5f3d-4d8c-9a55-1c2f9a4b7e10", false},
+		{"dots and underscores", "team_a.data-1", false},
+		{"shell", "x;reboot", true},
+		{"command substitution", "$(id)", true},
+		{"path", "../etc", true},
+		{"too short", "ab", true},
+		{"leading dash", "-vol", true},
+		{"too long", "a23456789012345678901234567890123456789012345678901234567890123x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCfsServer("vol-1", map[string]string{KMasterAddr: "127.0.0.1:17010", KVolumeName: tt.volName})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewCfsServer(volName %q) err = %v, wantErr %v", tt.volName, err, tt.wantErr)
+			}
+			if err != nil && status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("NewCfsServer(volName %q) code = %v, want InvalidArgument", tt.volName, status.Code(err))
+			}
+		})
+	}
+}
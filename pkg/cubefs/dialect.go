@@ -0,0 +1,117 @@
+package cubefs
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	masterVersionPath = "/version"
+	// KMasterVersion is the master version of a cluster whose masters do not
+	// report it, the driver does not guess the dialect of such masters
+	KMasterVersion = "masterVersion"
+)
+
+// masterDialect is how one release line of the CubeFS master expects its
+// requests to be sent. Both release lines answer in the same {code, msg, data}
+// envelope, only the version reply differs, see parseMasterVersion. There is
+// no shrink endpoint: CSI only ever grows volumes.
+type masterDialect struct {
+	name          string
+	createVolPath string
+	deleteVolPath string
+	getVolPath    string
+	expandVolPath string
+	// volTypeParam is the createVol parameter selecting the volume type, empty
+	// when the release only knows replicated volumes.
+	volTypeParam string
+}
+
+var (
+	masterDialectV2 = &masterDialect{
+		name:          "v2",
+		createVolPath: "/admin/createVol",
+		deleteVolPath: "/vol/delete",
+		getVolPath:    "/admin/getVol",
+		expandVolPath: "/vol/update",
+	}
+	masterDialectV3 = &masterDialect{
+		name:          "v3",
+		createVolPath: "/admin/createVol",
+		deleteVolPath: "/vol/delete",
+		getVolPath:    "/admin/getVol",
+		expandVolPath: "/vol/expand",
+		volTypeParam:  "volType",
+	}
+)
+
+// masterVersionInfo is the data of the master's version reply
+type masterVersionInfo struct {
+	Model    string `json:"Model"`
+	Version  string `json:"Version"`
+	CommitID string `json:"CommitID"`
+}
+
+// dialectForVersion picks the dialect of a master version such as "3.3.0",
+// "v2.4.0" or "release-3.2.1", newer versions get the latest one.
+func dialectForVersion(version string) (*masterDialect, error) {
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(version, "release-"), "v")
+	major, err := strconv.Atoi(strings.SplitN(trimmed, ".", 2)[0])
+	switch {
+	case err != nil || major < 1:
+		return nil, fmt.Errorf("unrecognized master version %q", version)
+	case major < 3:
+		return masterDialectV2, nil
+	default:
+		return masterDialectV3, nil
+	}
+}
+
+// unsupportedFeatures lists the volume parameters asking for something the
+// dialect cannot express. The volume type is the only parameter the driver
+// sends which not every release line knows.
+func (d *masterDialect) unsupportedFeatures(param map[string]string) []string {
+	var unsupported []string
+	if volType := param[KVolType]; d.volTypeParam == "" && volType != defaultVolType {
+		unsupported = append(unsupported, fmt.Sprintf("%s=%s", KVolType, volType))
+	}
+	return unsupported
+}
+
+func (d *masterDialect) createVolURL(addr, name, owner, volType string, capacityGB int64) string {
+	query := url.Values{}
+	query.Set("name", name)
+	query.Set("capacity", strconv.FormatInt(capacityGB, 10))
+	query.Set("owner", owner)
+	if d.volTypeParam != "" {
+		query.Set(d.volTypeParam, volType)
+	}
+	return d.url(addr, d.createVolPath, query)
+}
+
+func (d *masterDialect) deleteVolURL(addr, name, authKey string) string {
+	query := url.Values{}
+	query.Set("name", name)
+	query.Set("authKey", authKey)
+	return d.url(addr, d.deleteVolPath, query)
+}
+
+func (d *masterDialect) getVolURL(addr, name string) string {
+	query := url.Values{}
+	query.Set("name", name)
+	return d.url(addr, d.getVolPath, query)
+}
+
+func (d *masterDialect) expandVolURL(addr, name, authKey string, capacityGB int64) string {
+	query := url.Values{}
+	query.Set("name", name)
+	query.Set("authKey", authKey)
+	query.Set("capacity", strconv.FormatInt(capacityGB, 10))
+	return d.url(addr, d.expandVolPath, query)
+}
+
+func (d *masterDialect) url(addr, path string, query url.Values) string {
+	return fmt.Sprintf("http://%s%s?%s", addr, path, query.Encode())
+}
@@ -0,0 +1,174 @@
+package cubefs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/majlu/my-cubefs-csi/pkg/fakemaster"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDialectForVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    *masterDialect
+	}{
+		{"2.4.0", masterDialectV2},
+		{"v2.5.1", masterDialectV2},
+		{"release-2.3.0", masterDialectV2},
+		{"3.3.0", masterDialectV3},
+		{"v3.2.1", masterDialectV3},
+		{"release-3.4.0", masterDialectV3},
+		{"4.0.0", masterDialectV3},
+		{"unknown", nil},
+		{"2.x", masterDialectV2},
+		{"0.9", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := dialectForVersion(tt.version)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("dialectForVersion(%q) = %s, want an error", tt.version, got.name)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("dialectForVersion(%q) = %v, %v, want %s", tt.version, got, err, tt.want.name)
+		}
+	}
+}
+
+func TestParseMasterVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"bare", `{"Model":"master","Version":"3.3.0","CommitID":"abc","BranchName":"release-3.3.0","BuildTime":"now"}`, "3.3.0", false},
+		{"envelope", `{"code":0,"msg":"success","data":{"Model":"master","Version":"2.4.0"}}`, "2.4.0", false},
+		{"envelope error", `{"code":1,"msg":"internal error"}`, "", true},
+		{"no version", `{"Model":"master"}`, "", true},
+		{"not json", `3.3.0`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMasterVersion([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMasterVersion() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("parseMasterVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func newFakeMaster(t *testing.T, version string) http.Handler {
+	t.Helper()
+	fm, err := fakemaster.NewServer(fakemaster.Config{Addrs: []string{"127.0.0.1:0"}, Version: version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fm.Handler()
+}
+
+// newSwitchableMaster serves the handler stored in current, so a test can
+// replace the masters of the cluster.
+func newSwitchableMaster(t *testing.T, current *atomic.Value) *masterClient {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current.Load().(http.Handler).ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return newMasterClient(strings.TrimPrefix(ts.URL, "http://"), MasterLimits{})
+}
+
+func TestGetDialect(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		pinned  string
+		want    *masterDialect
+		wantErr codes.Code
+	}{
+		{name: "3.x master", version: "3.3.0", want: masterDialectV3},
+		{name: "2.x master", version: "2.4.0", want: masterDialectV2},
+		{name: "pinned version wins", version: "3.3.0", pinned: "2.4.0", want: masterDialectV2},
+		{name: "master without version endpoint", version: "", wantErr: codes.FailedPrecondition},
+		{name: "master without version endpoint pinned", version: "", pinned: "2.5.0", want: masterDialectV2},
+		{name: "invalid pinned version", version: "3.3.0", pinned: "latest", wantErr: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := &atomic.Value{}
+			current.Store(newFakeMaster(t, tt.version))
+			c := newSwitchableMaster(t, current)
+			dialect, _, err := c.getDialect(context.Background(), tt.pinned)
+			if tt.wantErr != codes.OK {
+				if status.Code(err) != tt.wantErr || !strings.Contains(err.Error(), KMasterVersion) {
+					t.Fatalf("getDialect() err = %v, want %v naming %s", err, tt.wantErr, KMasterVersion)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dialect != tt.want {
+				t.Fatalf("dialect = %s, want %s", dialect.name, tt.want.name)
+			}
+		})
+	}
+}
+
+func TestGetDialectAfterDowngrade(t *testing.T) {
+	current := &atomic.Value{}
+	current.Store(newFakeMaster(t, "3.3.0"))
+	c := newSwitchableMaster(t, current)
+	ctx := context.Background()
+	dialect, _, err := c.getDialect(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialect != masterDialectV3 {
+		t.Fatalf("dialect = %s, want v3", dialect.name)
+	}
+
+	// the 2.x masters have no expand endpoint, which drops the cached dialect
+	current.Store(newFakeMaster(t, "2.4.0"))
+	if _, err = c.executeDialectRequest(ctx, dialect.expandVolURL(c.addrs[0], "vol", "key", 10)); err == nil {
+		t.Fatal("expand with the v3 dialect on a 2.x master succeeded")
+	}
+	dialect, version, err := c.getDialect(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialect != masterDialectV2 || version != "2.4.0" {
+		t.Fatalf("dialect = %s version %s, want v2 version 2.4.0", dialect.name, version)
+	}
+}
+
+func TestGetDialectExpires(t *testing.T) {
+	current := &atomic.Value{}
+	current.Store(newFakeMaster(t, "2.4.0"))
+	c := newSwitchableMaster(t, current)
+	ctx := context.Background()
+	if _, _, err := c.getDialect(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	current.Store(newFakeMaster(t, "3.3.0"))
+	if dialect, _, _ := c.getDialect(ctx, ""); dialect != masterDialectV2 {
+		t.Fatalf("dialect = %s before it expired, want the cached v2", dialect.name)
+	}
+	c.dialectExpiry = c.dialectExpiry.Add(-masterDialectTTL)
+	if dialect, _, _ := c.getDialect(ctx, ""); dialect != masterDialectV3 {
+		t.Fatalf("dialect = %s after it expired, want v3", dialect.name)
+	}
+}
@@ -2,9 +2,16 @@ package cubefs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/majlu/my-cubefs-csi/pkg/metrics"
 	"github.com/majlu/my-cubefs-csi/pkg/util"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -17,14 +24,18 @@ import (
 
 const (
 	DriverName = "mycubefs.csi.cubefs.com"
+
+	// httpShutdownTimeout bounds the wait for the metrics and debug requests in flight on shutdown
+	httpShutdownTimeout = 5 * time.Second
 )
 
 type CSIDriver struct {
 	*IdentityService
-	cs      *ControllerService
-	ns      *NodeService
-	gsrv    *grpc.Server
-	options *Options
+	cs         *ControllerService
+	ns         *NodeService
+	gsrv       *grpc.Server
+	httpServer *http.Server
+	options    *Options
 }
 
 func NewCSIDriver(name, nodeId, version string, opts *Options) (*CSIDriver, error) {
@@ -53,6 +64,8 @@ func NewCSIDriver(name, nodeId, version string, opts *Options) (*CSIDriver, erro
 		IdentityService: NewIdentityService(name, version),
 		options:         opts,
 	}
+	SetMasterLimits(opts.MasterLimits)
+	setNodeLayout(name, opts)
 
 	k8sClient, err := driver.NewK8SClientSet()
 	if err != nil {
@@ -61,18 +74,26 @@ func NewCSIDriver(name, nodeId, version string, opts *Options) (*CSIDriver, erro
 
 	switch opts.Mode {
 	case ControllerMode:
-		driver.cs = NewControllerService(k8sClient)
+		driver.cs = NewControllerService(k8sClient, opts)
 	case NodeMode:
-		driver.ns = NewNodeService(nodeId, k8sClient)
+		driver.ns = NewNodeService(name, nodeId, k8sClient, opts)
 	case AllMode:
-		driver.cs = NewControllerService(k8sClient)
-		driver.ns = NewNodeService(nodeId, k8sClient)
+		driver.cs = NewControllerService(k8sClient, opts)
+		driver.ns = NewNodeService(name, nodeId, k8sClient, opts)
+	}
+	if driver.ns != nil {
+		driver.ready = driver.ns.preflight
 	}
 
 	return driver, nil
 }
 
+// Run serves the CSI services until the driver gets SIGTERM or SIGINT, then
+// stops gracefully, see shutdown.
 func (d *CSIDriver) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
 	scheme, addr, err := util.ParseEndpoint(d.options.Endpoint)
 	if err != nil {
 		return err
@@ -110,8 +131,91 @@ func (d *CSIDriver) Run() error {
 	default:
 		return fmt.Errorf("unknown mode: %s", d.options.Mode)
 	}
+	if d.options.HttpEndpoint != "" {
+		d.runHttpServer()
+	}
+	if d.ns != nil {
+		d.ns.logPreflight(ctx)
+		// fix the mounts left behind by the previous instance before serving kubelet
+		d.ns.reconcile(ctx)
+		go d.ns.Run(ctx)
+	}
+
 	klog.V(4).InfoS("Listening for connections", "address", listener.Addr())
-	return d.gsrv.Serve(listener)
+	served := make(chan error, 1)
+	go func() {
+		served <- d.gsrv.Serve(listener)
+	}()
+	select {
+	case err = <-served:
+		return err
+	case <-ctx.Done():
+	}
+	d.shutdown(scheme, addr)
+	return nil
+}
+
+// shutdown stops accepting RPCs and lets the ones in flight finish within the
+// grace period, then cuts them off. The cubefs clients are left running: mount
+// pods keep serving their volumes while the driver is upgraded and the next
+// instance takes them over on startup. The clients of the process mount mode
+// outlive the driver process but not its container, the container runtime
+// stops them with it and the next instance remounts their volumes.
+func (d *CSIDriver) shutdown(scheme, addr string) {
+	klog.InfoS("Shutting down, waiting for the operations in flight", "gracePeriod", d.options.ShutdownGracePeriod)
+	stopped := make(chan struct{})
+	go func() {
+		d.gsrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(d.options.ShutdownGracePeriod):
+		klog.InfoS("Grace period is over, cancelling the operations in flight")
+		d.gsrv.Stop()
+		<-stopped
+	}
+
+	if scheme == "unix" {
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			klog.ErrorS(err, "Failed to remove the CSI socket", "address", addr)
+		}
+	}
+	if d.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		if err := d.httpServer.Shutdown(ctx); err != nil {
+			klog.ErrorS(err, "Failed to stop the HTTP server", "address", d.httpServer.Addr)
+		}
+		cancel()
+	}
+	if d.ns != nil {
+		volumes := len(d.ns.refs.mountPaths())
+		if d.options.MountMode == PodMountMode {
+			klog.InfoS("Leaving the mount pods and their mounts running", "volumes", volumes)
+		} else if volumes > 0 {
+			klog.InfoS("The cubefs clients stop with the driver container in process mount mode, "+
+				"their volumes are unavailable to the pods until the next instance remounts them", "volumes", volumes)
+		}
+	}
+	klog.InfoS("Driver stopped")
+	klog.Flush()
+}
+
+// runHttpServer serves the metrics and the debug endpoints in the background
+// until shutdown.
+func (d *CSIDriver) runHttpServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	if d.ns != nil {
+		mux.Handle("/debug/clients", d.ns.clientsHandler())
+	}
+	d.httpServer = &http.Server{Addr: d.options.HttpEndpoint, Handler: mux}
+	go func() {
+		klog.InfoS("HTTP server listening", "address", d.httpServer.Addr)
+		if err := d.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.ErrorS(err, "HTTP server stopped", "address", d.httpServer.Addr)
+		}
+	}()
 }
 
 func (d *CSIDriver) NewK8SClientSet() (clientset *kubernetes.Clientset, err error) {
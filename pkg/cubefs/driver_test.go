@@ -0,0 +1,64 @@
+package cubefs
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestShutdownStopsServers(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "csi.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &CSIDriver{
+		gsrv:    grpc.NewServer(),
+		options: &Options{ShutdownGracePeriod: time.Second, HttpEndpoint: freeAddr(t)},
+	}
+	served := make(chan error, 1)
+	go func() { served <- d.gsrv.Serve(listener) }()
+	d.runHttpServer()
+
+	url := "http://" + d.options.HttpEndpoint + "/metrics"
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get(url); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("metrics not served: %v", err)
+	}
+	resp.Body.Close()
+
+	d.shutdown("unix", socket)
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("gRPC server still serving after shutdown")
+	}
+	if _, err = os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket after shutdown: err = %v, want it removed", err)
+	}
+	if resp, err = http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("HTTP server still serving after shutdown")
+	}
+}
@@ -0,0 +1,434 @@
+package cubefs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	mountutils "k8s.io/mount-utils"
+)
+
+const (
+	// ephemeralContextKey is set by kubelet in the volume context of CSI ephemeral inline volumes
+	ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+	// podInfoPrefix prefixes the keys kubelet adds to the volume context
+	podInfoPrefix = "csi.storage.k8s.io/"
+	// KSize is the size of an ephemeral volume as a resource quantity, e.g. 10Gi
+	KSize = "size"
+
+	defaultEphemeralSize    = "1Gi"
+	defaultEphemeralBaseDir = "csi-ephemeral"
+)
+
+// ephemeralAttributeKeys are the attributes a pod spec may set on an inline
+// volume. The cluster and the owner come from the node, so pods cannot point
+// the driver at another cluster or impersonate the owner of a volume.
+var ephemeralAttributeKeys = []string{
+	KSize, KVolumeName, KBaseDir,
+	KUid, KGid, KUmask,
+	KLogLevel, KEnablePosixACL, KKeepCache, KAttrValid, KEntryValid, KICacheTimeout, KLookupValid,
+}
+
+// ephemeralDirElemRe is what every element of the base directory of an inline volume must match.
+var ephemeralDirElemRe = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9_.-]{0,254}$`)
+
+// ephemeralVolume is an inline volume of a pod, persisted from the start of
+// NodePublishVolume until it is deleted so a leaked volume can be cleaned up.
+type ephemeralVolume struct {
+	VolumeId   string `json:"volumeId"`
+	TargetPath string `json:"targetPath"`
+	// MountPath is where the cubefs client mounts the volume
+	MountPath string `json:"mountPath"`
+	// Subdir is the directory created for the pod in a shared volume, empty
+	// if a volume was created for the pod
+	Subdir string `json:"subdir,omitempty"`
+	// Attributes are the client parameters of the volume, with the owner needed to delete it
+	Attributes map[string]string `json:"attributes"`
+	CreatedAt  time.Time         `json:"createdAt"`
+}
+
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralContextKey] == "true"
+}
+
+// ephemeralAttributes returns the attributes from the pod spec, without the
+// keys added by kubelet. It fails if the pod sets an attribute which is not
+// in ephemeralAttributeKeys.
+func ephemeralAttributes(volumeContext map[string]string) (map[string]string, error) {
+	attrs := make(map[string]string, len(volumeContext))
+	var refused []string
+	for key, value := range volumeContext {
+		switch {
+		case strings.HasPrefix(key, podInfoPrefix):
+		case slices.Contains(ephemeralAttributeKeys, key):
+			attrs[key] = value
+		default:
+			refused = append(refused, key)
+		}
+	}
+	if len(refused) > 0 {
+		slices.Sort(refused)
+		return nil, fmt.Errorf("inline volumes cannot set %s, supported attributes: %s",
+			strings.Join(refused, ", "), strings.Join(ephemeralAttributeKeys, ", "))
+	}
+	return attrs, nil
+}
+
+// validateEphemeralBaseDir checks the base directory of an inline volume is a
+// relative path of plain names.
+func validateEphemeralBaseDir(dir string) error {
+	for _, elem := range strings.Split(dir, "/") {
+		if !ephemeralDirElemRe.MatchString(elem) || elem == "." || elem == ".." {
+			return fmt.Errorf("%q must be a relative path of names matching %s", dir, ephemeralDirElemRe)
+		}
+	}
+	return nil
+}
+
+// ephemeralCapacityGB parses the size of an ephemeral volume, rounded up to GB.
+func ephemeralCapacityGB(size string) (int64, error) {
+	if size == "" {
+		size = defaultEphemeralSize
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", KSize, size, err)
+	}
+	if quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", KSize, size)
+	}
+	return (quantity.Value() + 1<<30 - 1) >> 30, nil
+}
+
+// ephemeralVolumeName names the CubeFS volume created for an inline volume,
+// kubelet's volume IDs are too long for CubeFS.
+func ephemeralVolumeName(volumeId string) string {
+	sum := sha256.Sum256([]byte(volumeId))
+	return "csi-eph-" + hex.EncodeToString(sum[:])[:32]
+}
+
+func (n *NodeService) publishEphemeral(ctx context.Context, request *csi.NodePublishVolumeRequest, pod podInfo) (*csi.NodePublishVolumeResponse, error) {
+	start := time.Now()
+	volumeId := request.GetVolumeId()
+	targetPath := request.GetTargetPath()
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "target path missing in request")
+	}
+	if n.options.EphemeralMaxSizeGB <= 0 || n.options.EphemeralMasterAddr == "" {
+		return nil, status.Error(codes.InvalidArgument, "ephemeral inline volumes are disabled on this node")
+	}
+	if request.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing in request")
+	}
+	if err := validateVolumeCapability(request.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mountOpts, err := parseMountFlags(request.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the client writes the scratch directory, the pod gets a read-only bind mount instead
+	delete(mountOpts.clientConf, KReadOnly)
+
+	attrs, err := ephemeralAttributes(request.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	capacityGB, err := ephemeralCapacityGB(attrs[KSize])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if capacityGB > n.options.EphemeralMaxSizeGB {
+		return nil, status.Errorf(codes.OutOfRange, "ephemeral volume of %dGB exceeds the limit of %dGB", capacityGB, n.options.EphemeralMaxSizeGB)
+	}
+	delete(attrs, KSize)
+	baseDir := getValueWithDefault(attrs, KBaseDir, defaultEphemeralBaseDir)
+	if err := validateEphemeralBaseDir(baseDir); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %v", KBaseDir, err)
+	}
+	readOnly := request.GetReadonly() || isReadOnlyAccessMode(request.GetVolumeCapability())
+	owner, err := volumeOwnership(attrs)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ctx, done, err := n.beginOperation(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if notMnt, err := n.mounter.IsLikelyNotMountPoint(targetPath); err == nil && !notMnt {
+		klog.V(4).InfoS("Target path is a mount point, skip", pod.keysAndValues("targetPath", targetPath)...)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// every inline volume runs its own client
+	if err := n.reserveClient(ctx, volumeId); err != nil {
+		return nil, err
+	}
+	defer n.refs.unreserve(volumeId)
+
+	// a retry after a failed attempt continues with the same volume
+	vol, err := loadEphemeral(volumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if vol == nil {
+		vol = &ephemeralVolume{
+			VolumeId:   volumeId,
+			TargetPath: targetPath,
+			MountPath:  filepath.Join(layout.kubeletCSIPluginDir(), n.driverName, "ephemeral", volumeId),
+			CreatedAt:  time.Now(),
+		}
+		if attrs[KVolumeName] != "" {
+			vol.Subdir = path.Join(baseDir, volumeId)
+		} else {
+			attrs[KVolumeName] = ephemeralVolumeName(volumeId)
+		}
+		attrs[KMasterAddr] = n.options.EphemeralMasterAddr
+		if n.options.EphemeralOwner != "" {
+			attrs[KOwner] = n.options.EphemeralOwner
+		}
+		if n.options.EphemeralMasterVersion != "" {
+			attrs[KMasterVersion] = n.options.EphemeralMasterVersion
+		}
+		// the client only serves this pod
+		pod.labelClientConf(attrs)
+		cfsServer, err := NewCfsServer(volumeId, attrs)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		vol.Attributes = cfsServer.clientConf
+		if err = saveEphemeral(vol); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	options := append([]string{"bind"}, mountOpts.bindFlags...)
+	if readOnly && !slices.Contains(options, "ro") {
+		options = append(options, "ro")
+	}
+	if err := n.setupEphemeral(ctx, vol, capacityGB, mountOpts, owner, options, readOnly, pod); err != nil {
+		klog.ErrorS(err, "NodePublishVolume: failed to set up ephemeral volume, deleting it", pod.keysAndValues("volumeId", volumeId)...)
+		if cleanupErr := n.deleteEphemeral(ctx, vol); cleanupErr != nil {
+			klog.ErrorS(cleanupErr, "Failed to delete ephemeral volume, it is left to the sweep", pod.keysAndValues("volumeId", volumeId)...)
+		}
+		return nil, toGRPCError(err, codes.Internal)
+	}
+
+	klog.InfoS("NodePublishVolume success", pod.keysAndValues("volumeId", volumeId, "targetPath", targetPath, "ephemeral", true,
+		"volName", vol.Attributes[KVolumeName], "subdir", vol.Subdir, "cost", time.Since(start))...)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// setupEphemeral creates the volume or directory of an inline volume, mounts
+// it and bind mounts it to the target path.
+func (n *NodeService) setupEphemeral(ctx context.Context, vol *ephemeralVolume, capacityGB int64, mountOpts *mountOptions,
+	owner *rootOwnership, options []string, readOnly bool, pod podInfo) error {
+	if vol.Subdir == "" {
+		cfsServer, err := NewCfsServer(vol.VolumeId, maps.Clone(vol.Attributes))
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err = cfsServer.createVolume(ctx, capacityGB); err != nil {
+			return err
+		}
+		if n.options.VolumeReadyTimeout > 0 {
+			if err = cfsServer.waitVolumeReady(ctx, n.options.VolumeReadyTimeout, n.options.MinWritableDataPartitions); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := n.mountEphemeral(ctx, vol, mountOpts); err != nil {
+		return err
+	}
+	bind := bindMount{source: vol.MountPath, options: options, pod: pod}
+	if vol.Subdir != "" {
+		var err error
+		if bind.source, err = ensureSubdir(vol.MountPath, vol.Subdir, true); err != nil {
+			return err
+		}
+	}
+	if owner != nil && !readOnly {
+		if err := owner.apply(bind.source); err != nil {
+			return status.Errorf(codes.Internal, "set ownership of %s: %v", bind.source, err)
+		}
+	}
+
+	if err := n.mounter.MakeDir(vol.TargetPath); err != nil {
+		return status.Errorf(codes.Internal, "create target path: %v", err)
+	}
+	if err := n.mounter.Mount(bind.source, vol.TargetPath, "", options); err != nil {
+		return status.Errorf(codes.Internal, "bind mount %s to %s: %v", bind.source, vol.TargetPath, err)
+	}
+	n.refs.addTarget(vol.VolumeId, vol.MountPath, vol.TargetPath, bind)
+	return nil
+}
+
+// mountEphemeral starts the client of an inline volume unless it is running.
+func (n *NodeService) mountEphemeral(ctx context.Context, vol *ephemeralVolume, mountOpts *mountOptions) error {
+	if isMnt, err := n.mounter.IsMountPoint(vol.MountPath); err == nil && isMnt {
+		return nil
+	}
+	if err := unmountStale(n.mounter, vol.MountPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(vol.MountPath, 0750); err != nil {
+		return status.Errorf(codes.Internal, "create mount path: %v", err)
+	}
+	if err := n.mount(ctx, vol.MountPath, vol.VolumeId, maps.Clone(vol.Attributes), mountOpts); err != nil {
+		return err
+	}
+	n.refs.setMount(vol.VolumeId, vol.MountPath)
+	return nil
+}
+
+// deleteEphemeral removes the directory or the volume created for an inline
+// volume and stops its client, the record is only removed once all succeeded.
+func (n *NodeService) deleteEphemeral(ctx context.Context, vol *ephemeralVolume) error {
+	if vol.Subdir != "" {
+		if err := n.mountEphemeral(ctx, vol, &mountOptions{clientConf: map[string]string{}}); err != nil {
+			return fmt.Errorf("mount volume to remove %s: %w", vol.Subdir, err)
+		}
+		dir, err := ensureSubdir(vol.MountPath, vol.Subdir, false)
+		if err == nil {
+			err = os.RemoveAll(dir)
+		} else if status.Code(err) == codes.NotFound {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("remove %s: %w", vol.Subdir, err)
+		}
+	}
+
+	if err := n.runner.stop(ctx, vol.VolumeId); err != nil {
+		return err
+	}
+	if err := mountutils.CleanupMountPoint(vol.MountPath, n.mounter, false); err != nil {
+		return err
+	}
+	if vol.Subdir == "" {
+		cfsServer, err := NewCfsServer(vol.VolumeId, maps.Clone(vol.Attributes))
+		if err != nil {
+			return err
+		}
+		if err = cfsServer.deleteVolume(ctx); err != nil {
+			return err
+		}
+	}
+	if err := removeClientConf(vol.VolumeId); err != nil {
+		return err
+	}
+	n.refs.remove(vol.VolumeId)
+	if err := os.Remove(ephemeralRecordPath(vol.VolumeId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	klog.InfoS("Deleted ephemeral volume", "volumeId", vol.VolumeId, "volName", vol.Attributes[KVolumeName], "subdir", vol.Subdir)
+	return nil
+}
+
+// runEphemeralSweep periodically deletes the leaked inline volumes.
+func (n *NodeService) runEphemeralSweep(ctx context.Context) {
+	if n.options.EphemeralSweepInterval <= 0 {
+		return
+	}
+	wait.UntilWithContext(ctx, n.sweepEphemeral, n.options.EphemeralSweepInterval)
+}
+
+// sweepEphemeral deletes the inline volumes whose pod went away without
+// NodeUnpublishVolume, e.g. because the node died. kubelet removes the volume
+// directory of a pod after unpublishing it.
+func (n *NodeService) sweepEphemeral(ctx context.Context) {
+	vols, err := listEphemeral()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list ephemeral volumes")
+		return
+	}
+	for _, vol := range vols {
+		if _, err := os.Stat(filepath.Dir(vol.TargetPath)); !os.IsNotExist(err) {
+			continue
+		}
+		// volumes busy with an operation are checked in the next round
+		if !n.volumeLocks.tryAcquire(vol.VolumeId) {
+			continue
+		}
+		klog.InfoS("Deleting leaked ephemeral volume", "volumeId", vol.VolumeId, "targetPath", vol.TargetPath, "createdAt", vol.CreatedAt,
+			"pod", klog.KRef(vol.Attributes[KPodNamespace], vol.Attributes[KPodName]))
+		n.refs.removeTarget(vol.VolumeId, vol.TargetPath)
+		if err := n.deleteEphemeral(ctx, vol); err != nil {
+			klog.ErrorS(err, "Failed to delete leaked ephemeral volume", "volumeId", vol.VolumeId)
+		}
+		n.volumeLocks.release(vol.VolumeId)
+	}
+}
+
+func ephemeralRecordPath(volumeId string) string {
+	return filepath.Join(layout.ephemeralRecordDir(), volumeId+jsonFileSuffix)
+}
+
+func saveEphemeral(vol *ephemeralVolume) error {
+	if err := os.MkdirAll(layout.ephemeralRecordDir(), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ephemeralRecordPath(vol.VolumeId), data, 0600)
+}
+
+// loadEphemeral reads the record of an inline volume, nil if the volume is not one.
+func loadEphemeral(volumeId string) (*ephemeralVolume, error) {
+	data, err := os.ReadFile(ephemeralRecordPath(volumeId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	vol := &ephemeralVolume{}
+	if err = json.Unmarshal(data, vol); err != nil {
+		return nil, fmt.Errorf("decode ephemeral volume %s: %w", volumeId, err)
+	}
+	return vol, nil
+}
+
+func listEphemeral() ([]*ephemeralVolume, error) {
+	entries, err := os.ReadDir(layout.ephemeralRecordDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var vols []*ephemeralVolume
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), jsonFileSuffix) {
+			continue
+		}
+		vol, err := loadEphemeral(strings.TrimSuffix(entry.Name(), jsonFileSuffix))
+		if err != nil {
+			klog.ErrorS(err, "Failed to read ephemeral volume", "file", entry.Name())
+			continue
+		}
+		vols = append(vols, vol)
+	}
+	return vols, nil
+}
@@ -0,0 +1,158 @@
+package cubefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/majlu/my-cubefs-csi/pkg/fakemaster"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEphemeralAttributes(t *testing.T) {
+	attrs, err := ephemeralAttributes(map[string]string{
+		ephemeralContextKey:        "true",
+		podInfoPrefix + "pod.name": "web-0",
+		KSize:                      "10Gi",
+		KVolumeName:                "shared-1",
+		KBaseDir:                   "scratch",
+		KUid:                       "1000",
+		KLogLevel:                  "warn",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != 5 || attrs[KSize] != "10Gi" || attrs[ephemeralContextKey] != "" {
+		t.Errorf("attributes = %v, want the pod spec attributes without the kubelet ones", attrs)
+	}
+
+	for _, key := range []string{KMasterAddr, KOwner, KLogDir, KMountPoint, KAllowedNamespaces, "rdmaPort"} {
+		_, err := ephemeralAttributes(map[string]string{KSize: "1Gi", key: "x"})
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("attribute %s: err = %v, want it refused", key, err)
+		}
+	}
+}
+
+func TestValidateEphemeralBaseDir(t *testing.T) {
+	for _, dir := range []string{defaultEphemeralBaseDir, "team-a/scratch", "a.b_c", "_tmp"} {
+		if err := validateEphemeralBaseDir(dir); err != nil {
+			t.Errorf("validateEphemeralBaseDir(%q) = %v", dir, err)
+		}
+	}
+	for _, dir := range []string{"", "/abs", "a/../b", "..", ".", ".hidden", "a//b", "a/", "a b", "$(id)", "a;b", "a\x00b"} {
+		if err := validateEphemeralBaseDir(dir); err == nil {
+			t.Errorf("validateEphemeralBaseDir(%q) accepted", dir)
+		}
+	}
+}
+
+func TestEphemeralCapacityGB(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"", 1, false},
+		{"1Gi", 1, false},
+		{"10Gi", 10, false},
+		{"100Mi", 1, false},
+		{"1500Mi", 2, false},
+		{"1Ti", 1024, false},
+		{"0", 0, true},
+		{"-1Gi", 0, true},
+		{"lots", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ephemeralCapacityGB(tt.size)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ephemeralCapacityGB(%q) err = %v, wantErr %v", tt.size, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ephemeralCapacityGB(%q) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestEphemeralVolumeName(t *testing.T) {
+	name := ephemeralVolumeName("csi-8d2b7e9b3f0f4c1f6b5e1d8f9a2c3b4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b")
+	if !volumeNameRe.MatchString(name) {
+		t.Errorf("ephemeralVolumeName = %q, not a valid volume name", name)
+	}
+	if name != ephemeralVolumeName("csi-8d2b7e9b3f0f4c1f6b5e1d8f9a2c3b4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b") {
+		t.Error("ephemeralVolumeName is not stable")
+	}
+}
+
+func TestEphemeralPublishLifecycle(t *testing.T) {
+	ctx := context.Background()
+	n, m, runner := newTestNodeService(t)
+	masterAddr := startFakeMaster(t, fakemaster.Config{Version: "3.3.0", CapacityGB: 100})
+	n.options = &Options{EphemeralMaxSizeGB: 10, EphemeralMasterAddr: masterAddr, EphemeralOwner: "csi"}
+	volumeId := "csi-0f1e2d3c4b5a"
+	target := filepath.Join(t.TempDir(), "pods", "uid-1", "volumes", "kubernetes.io~csi", "scratch", "mount")
+	request := &csi.NodePublishVolumeRequest{
+		VolumeId:         volumeId,
+		TargetPath:       target,
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{ephemeralContextKey: "true", KSize: "20Gi"},
+	}
+	if _, err := n.NodePublishVolume(ctx, request); status.Code(err) != codes.OutOfRange {
+		t.Fatalf("NodePublishVolume over the size limit: err = %v, want OutOfRange", err)
+	}
+
+	request.VolumeContext[KSize] = "2Gi"
+	if _, err := n.NodePublishVolume(ctx, request); err != nil {
+		t.Fatalf("NodePublishVolume: %v", err)
+	}
+	vol, err := loadEphemeral(volumeId)
+	if err != nil || vol == nil {
+		t.Fatalf("loadEphemeral() = %v, %v, want the record", vol, err)
+	}
+	cfsServer, err := NewCfsServer(volumeId, map[string]string{KMasterAddr: masterAddr, KVolumeName: ephemeralVolumeName(volumeId)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfsServer.getVolume(ctx); err != nil {
+		t.Fatalf("volume not created on the master: %v", err)
+	}
+	if !reflect.DeepEqual(runner.started, []string{volumeId}) {
+		t.Errorf("started clients = %v, want %s", runner.started, volumeId)
+	}
+	if want := []string{vol.MountPath + " " + target}; !reflect.DeepEqual(m.mounts, want) {
+		t.Errorf("bind mounts = %v, want %v", m.mounts, want)
+	}
+
+	if _, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeId, TargetPath: target}); err != nil {
+		t.Fatalf("NodeUnpublishVolume: %v", err)
+	}
+	if _, err := cfsServer.getVolume(ctx); err == nil {
+		t.Error("volume left on the master")
+	}
+	if !reflect.DeepEqual(runner.stopped, []string{volumeId}) {
+		t.Errorf("stopped clients = %v, want %s", runner.stopped, volumeId)
+	}
+	for _, path := range []string{ephemeralRecordPath(volumeId), clientConfFilePath(volumeId), vol.MountPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+}
+
+func TestEphemeralPublishDisabled(t *testing.T) {
+	n, _, _ := newTestNodeService(t)
+	_, err := n.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-0f1e2d3c4b5a",
+		TargetPath:       filepath.Join(t.TempDir(), "mount"),
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{ephemeralContextKey: "true"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("NodePublishVolume with inline volumes disabled: err = %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,117 @@
+package cubefs
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error codes returned by the CubeFS master in the "code" field of a reply,
+// mirrors proto/admin_proto.go of cubefs.
+const (
+	ErrCodeSuccess                         = 0
+	ErrCodeInternalError                   = 1
+	ErrCodeParamError                      = 2
+	ErrCodeInvalidCfg                      = 3
+	ErrCodePersistenceByRaft               = 4
+	ErrCodeMarshalData                     = 5
+	ErrCodeUnmarshalData                   = 6
+	ErrCodeVolNotExists                    = 7
+	ErrCodeMetaPartitionNotExists          = 8
+	ErrCodeDataPartitionNotExists          = 9
+	ErrCodeDataNodeNotExists               = 10
+	ErrCodeMetaNodeNotExists               = 11
+	ErrCodeDuplicateVol                    = 12
+	ErrCodeActiveDataNodesTooLess          = 13
+	ErrCodeActiveMetaNodesTooLess          = 14
+	ErrCodeInvalidMpStart                  = 15
+	ErrCodeNoAvailDataPartition            = 16
+	ErrCodeNoDataNodeToWrite               = 21
+	ErrCodeNoMetaNodeToWrite               = 22
+	ErrCodeNoDataNodeToCreateDataPartition = 24
+	ErrCodeNoZoneToCreateDataPartition     = 25
+	ErrCodeNoNodeSetToCreateDataPartition  = 26
+	ErrCodeNoNodeSetToCreateMetaPartition  = 27
+	ErrCodeNoMetaNodeToCreateMetaPartition = 28
+	ErrCodeNoLeader                        = 31
+	ErrCodeVolAuthKeyNotMatch              = 32
+)
+
+// CfsError is a non-zero reply code from the CubeFS master.
+type CfsError struct {
+	Code int
+	Msg  string
+}
+
+func NewCfsError(code int, msg string) *CfsError {
+	return &CfsError{Code: code, Msg: msg}
+}
+
+func (e *CfsError) Error() string {
+	return fmt.Sprintf("cubefs master error: code(%d) msg(%s)", e.Code, e.Msg)
+}
+
+// GRPCStatus makes CfsError usable with status.FromError and status.Code,
+// also when it is wrapped by fmt.Errorf("%w").
+func (e *CfsError) GRPCStatus() *status.Status {
+	return status.New(e.GRPCCode(), e.Error())
+}
+
+// GRPCCode translates the master code into the gRPC code the CSI sidecars
+// expect, so they retry transient failures and give up on permanent ones.
+// Only the code is trusted, the message is free text which may mention anything.
+func (e *CfsError) GRPCCode() codes.Code {
+	switch e.Code {
+	case ErrCodeVolNotExists, ErrCodeMetaPartitionNotExists, ErrCodeDataPartitionNotExists:
+		return codes.NotFound
+	case ErrCodeDuplicateVol:
+		return codes.AlreadyExists
+	case ErrCodeActiveDataNodesTooLess, ErrCodeActiveMetaNodesTooLess, ErrCodeNoAvailDataPartition,
+		ErrCodeNoDataNodeToWrite, ErrCodeNoMetaNodeToWrite, ErrCodeNoDataNodeToCreateDataPartition,
+		ErrCodeNoZoneToCreateDataPartition, ErrCodeNoNodeSetToCreateDataPartition,
+		ErrCodeNoNodeSetToCreateMetaPartition, ErrCodeNoMetaNodeToCreateMetaPartition:
+		return codes.ResourceExhausted
+	case ErrCodeVolAuthKeyNotMatch:
+		return codes.PermissionDenied
+	case ErrCodeParamError, ErrCodeInvalidCfg, ErrCodeInvalidMpStart:
+		return codes.InvalidArgument
+	case ErrCodeNoLeader, ErrCodePersistenceByRaft:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// IsVolNotExists reports whether err means the volume is unknown to the master.
+func IsVolNotExists(err error) bool {
+	var cfsErr *CfsError
+	return errors.As(err, &cfsErr) && cfsErr.GRPCCode() == codes.NotFound
+}
+
+// IsDuplicateVol reports whether err means the volume has already been created.
+func IsDuplicateVol(err error) bool {
+	var cfsErr *CfsError
+	return errors.As(err, &cfsErr) && cfsErr.GRPCCode() == codes.AlreadyExists
+}
+
+// isRetryable reports whether another master may succeed where this one failed.
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// toGRPCError returns err as a gRPC status error, using code when err does
+// not carry a status of its own.
+func toGRPCError(err error, code codes.Code) error {
+	if err == nil {
+		return nil
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Err()
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,104 @@
+package cubefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCfsErrorGRPCCode(t *testing.T) {
+	tests := []struct {
+		code int
+		msg  string
+		want codes.Code
+	}{
+		{ErrCodeVolNotExists, "", codes.NotFound},
+		{ErrCodeDataPartitionNotExists, "", codes.NotFound},
+		{ErrCodeDuplicateVol, "", codes.AlreadyExists},
+		{ErrCodeNoDataNodeToCreateDataPartition, "", codes.ResourceExhausted},
+		{ErrCodeActiveMetaNodesTooLess, "", codes.ResourceExhausted},
+		{ErrCodeVolAuthKeyNotMatch, "", codes.PermissionDenied},
+		{ErrCodeParamError, "", codes.InvalidArgument},
+		{ErrCodeNoLeader, "", codes.Unavailable},
+		{ErrCodePersistenceByRaft, "", codes.Unavailable},
+		// the message is not trusted, whatever it mentions
+		{ErrCodeInternalError, "vol not exists", codes.Internal},
+		{ErrCodeInternalError, "parameter authKey is missing in the raft log", codes.Internal},
+		{ErrCodeParamError, "authKey is empty", codes.InvalidArgument},
+		{ErrCodeInternalError, "disk full", codes.Internal},
+		{99, "", codes.Internal},
+	}
+	for _, tt := range tests {
+		err := NewCfsError(tt.code, tt.msg)
+		if got := err.GRPCCode(); got != tt.want {
+			t.Errorf("code %d msg %q: GRPCCode() = %v, want %v", tt.code, tt.msg, got, tt.want)
+		}
+		// the code survives wrapping
+		if got := status.Code(fmt.Errorf("create volume: %w", err)); got != tt.want {
+			t.Errorf("code %d msg %q: status.Code(wrapped) = %v, want %v", tt.code, tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestIsVolNotExistsAndDuplicateVol(t *testing.T) {
+	notExists := fmt.Errorf("get volume: %w", NewCfsError(ErrCodeVolNotExists, "vol not exists"))
+	duplicate := fmt.Errorf("create volume: %w", NewCfsError(ErrCodeDuplicateVol, "duplicate vol"))
+	if !IsVolNotExists(notExists) || IsVolNotExists(duplicate) || IsVolNotExists(errors.New("vol not exists")) {
+		t.Error("IsVolNotExists misclassifies errors")
+	}
+	if !IsDuplicateVol(duplicate) || IsDuplicateVol(notExists) {
+		t.Error("IsDuplicateVol misclassifies errors")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.Unavailable, "no leader"), true},
+		{status.Error(codes.DeadlineExceeded, "timeout"), true},
+		{errors.New("unexpected reply"), false},
+		{status.Error(codes.Unknown, "unknown"), false},
+		{NewCfsError(ErrCodeNoLeader, ""), true},
+		{NewCfsError(ErrCodeVolNotExists, ""), false},
+		{status.Error(codes.InvalidArgument, "bad name"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestToGRPCError(t *testing.T) {
+	if toGRPCError(nil, codes.Internal) != nil {
+		t.Error("toGRPCError(nil) is not nil")
+	}
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"plain error", errors.New("boom"), codes.Internal},
+		{"status", status.Error(codes.NotFound, "gone"), codes.NotFound},
+		{"wrapped master error", fmt.Errorf("mount failed: %w", NewCfsError(ErrCodeVolAuthKeyNotMatch, "")), codes.PermissionDenied},
+		{"context", context.DeadlineExceeded, codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := toGRPCError(tt.err, codes.Internal)
+			s, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("toGRPCError() = %v, not a status error", err)
+			}
+			if s.Code() != tt.want {
+				t.Fatalf("toGRPCError() code = %v, want %v", s.Code(), tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/klog/v2"
 )
 
@@ -14,6 +15,8 @@ var (
 type IdentityService struct {
 	Name    string
 	Version string
+	// ready reports why the plugin is not ready, the plugin is always ready if nil
+	ready func() error
 	csi.UnimplementedIdentityServer
 }
 
@@ -44,6 +47,13 @@ func (d *IdentityService) GetPluginCapabilities(ctx context.Context, request *cs
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
 		},
 	}
 	return resp, nil
@@ -51,5 +61,11 @@ func (d *IdentityService) GetPluginCapabilities(ctx context.Context, request *cs
 
 func (d *IdentityService) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	klog.V(6).InfoS("Probe: called", "args", req)
-	return &csi.ProbeResponse{}, nil
+	if d.ready != nil {
+		if err := d.ready(); err != nil {
+			klog.InfoS("Probe: not ready", "reason", err)
+			return &csi.ProbeResponse{Ready: wrapperspb.Bool(false)}, nil
+		}
+	}
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
 }
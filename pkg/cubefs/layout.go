@@ -0,0 +1,193 @@
+package cubefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Default node layout, the paths of the node DaemonSet
+const (
+	DefaultClientBin     = CfsClientBin
+	DefaultClientConfDir = "/cfs/conf"
+	DefaultClientLogDir  = "/cfs/logs"
+	DefaultKubeletDir    = "/var/lib/kubelet"
+
+	// legacyMountDir is where the driver mounted the volumes before it staged them
+	legacyMountDir = "/mnt"
+)
+
+// nodeLayout is where the node service finds the cubefs client and keeps the
+// files of its volumes. The per-volume files are below a directory named
+// after the driver, so drivers with different names can share a node.
+type nodeLayout struct {
+	clientBin string
+	// confDir holds the client configs and the ephemeral volume records of the driver
+	confDir string
+	// logDir holds the client logs of the driver
+	logDir string
+	// logHostDir is logDir on the host
+	logHostDir string
+	kubeletDir string
+
+	// legacyConfDir is where the files of the driver were before they were
+	// put below a directory named after the driver
+	legacyConfDir string
+}
+
+// layout is the node layout in use, set by NewCSIDriver.
+var layout = newNodeLayout(DriverName, &Options{})
+
+// newNodeLayout builds the layout of the driver from the options, empty paths
+// are defaults.
+func newNodeLayout(driverName string, opts *Options) *nodeLayout {
+	orDefault := func(path, defaultPath string) string {
+		if path == "" {
+			return defaultPath
+		}
+		return filepath.Clean(path)
+	}
+	confDir := orDefault(opts.ClientConfDir, DefaultClientConfDir)
+	logDir := orDefault(opts.ClientLogDir, DefaultClientLogDir)
+	return &nodeLayout{
+		clientBin:     orDefault(opts.ClientBin, DefaultClientBin),
+		confDir:       filepath.Join(confDir, driverName),
+		logDir:        filepath.Join(logDir, driverName),
+		logHostDir:    filepath.Join(orDefault(opts.ClientLogHostDir, logDir), driverName),
+		kubeletDir:    orDefault(opts.KubeletDir, DefaultKubeletDir),
+		legacyConfDir: confDir,
+	}
+}
+
+// setNodeLayout sets the layout of the node service created afterwards.
+func setNodeLayout(driverName string, opts *Options) {
+	layout = newNodeLayout(driverName, opts)
+}
+
+func (l *nodeLayout) kubeletPodsDir() string {
+	return filepath.Join(l.kubeletDir, "pods")
+}
+
+// kubeletCSIPluginDir holds the staging paths, the clients of ephemeral volumes mount below it too
+func (l *nodeLayout) kubeletCSIPluginDir() string {
+	return filepath.Join(l.kubeletDir, "plugins", "kubernetes.io", "csi")
+}
+
+func (l *nodeLayout) ephemeralRecordDir() string {
+	return filepath.Join(l.confDir, "ephemeral")
+}
+
+// reclaimMountDir holds the mounts of the controller deleting the directories of PVs
+func (l *nodeLayout) reclaimMountDir() string {
+	return filepath.Join(l.confDir, "reclaim")
+}
+
+func (l *nodeLayout) clientProcessLogDir() string {
+	return filepath.Join(l.logDir, "clients")
+}
+
+// hostLogDir returns where the client log directory dir of the driver is on the host.
+func (l *nodeLayout) hostLogDir(dir string) (string, error) {
+	rel, err := filepath.Rel(l.logDir, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("client log directory %q is not below %s", dir, l.logDir)
+	}
+	return filepath.Join(l.logHostDir, rel), nil
+}
+
+// validateLayoutOptions checks the paths of the node layout are absolute.
+func validateLayoutOptions(opts *Options) error {
+	for _, p := range []struct{ name, path string }{
+		{"client binary", opts.ClientBin},
+		{"client config directory", opts.ClientConfDir},
+		{"client log directory", opts.ClientLogDir},
+		{"client log host directory", opts.ClientLogHostDir},
+		{"kubelet directory", opts.KubeletDir},
+	} {
+		if p.path != "" && !filepath.IsAbs(p.path) {
+			return fmt.Errorf("%s must be an absolute path (actual: %s)", p.name, p.path)
+		}
+	}
+	return nil
+}
+
+// migrateLayout moves the client configs and the ephemeral volume records the
+// driver left directly in the config directory below the directory of the
+// driver. The running clients keep their log directory.
+//
+// The legacy directory may be shared by several drivers, so a driver only
+// takes the files of the volumes mounted below its kubelet plugin directory,
+// which is named after it. The default driver also takes the volumes staged
+// by kubelets which do not name the staging paths after the driver.
+//
+// The volumes the driver mounted below /mnt before it staged them are not
+// taken over: kubelet never staged them, so the node cannot tell when they are
+// no longer used. Their configs are left in place and reported, the pods using
+// them keep the mounts of the old clients until they are restarted.
+func (l *nodeLayout) migrateLayout(driverName string) {
+	pluginDir := filepath.Join(l.kubeletCSIPluginDir(), driverName) + "/"
+	owned := func(mountPath string) bool {
+		if strings.HasPrefix(mountPath, pluginDir) {
+			return true
+		}
+		return driverName == DriverName && strings.HasPrefix(mountPath, filepath.Join(l.kubeletCSIPluginDir(), "pv")+"/")
+	}
+
+	migrate := func(fromDir, toDir string, mountPathOf func(data []byte) (string, error)) {
+		entries, err := os.ReadDir(fromDir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				klog.ErrorS(err, "Failed to list legacy node files", "dir", fromDir)
+			}
+			return
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), jsonFileSuffix) {
+				continue
+			}
+			from := filepath.Join(fromDir, entry.Name())
+			data, err := os.ReadFile(from)
+			if err != nil {
+				klog.ErrorS(err, "Failed to read legacy node file", "file", from)
+				continue
+			}
+			mountPath, err := mountPathOf(data)
+			if err != nil {
+				klog.ErrorS(err, "Failed to decode legacy node file", "file", from)
+				continue
+			}
+			mountPath = filepath.Clean(mountPath)
+			if !owned(mountPath) {
+				if driverName == DriverName && filepath.Dir(mountPath) == legacyMountDir {
+					klog.ErrorS(nil, "Volume mounted by a driver version which did not stage volumes is not taken over, restart the pods using it",
+						"file", from, "mountPath", mountPath)
+				}
+				continue
+			}
+			to := filepath.Join(toDir, entry.Name())
+			if err = os.MkdirAll(toDir, 0755); err == nil {
+				err = os.Rename(from, to)
+			}
+			if err != nil {
+				klog.ErrorS(err, "Failed to migrate legacy node file", "from", from, "to", to)
+				continue
+			}
+			klog.InfoS("Migrated legacy node file", "from", from, "to", to)
+		}
+	}
+
+	migrate(l.legacyConfDir, l.confDir, func(data []byte) (string, error) {
+		conf := make(map[string]string)
+		err := json.Unmarshal(data, &conf)
+		return conf[KMountPoint], err
+	})
+	migrate(filepath.Join(l.legacyConfDir, "ephemeral"), l.ephemeralRecordDir(), func(data []byte) (string, error) {
+		vol := &ephemeralVolume{}
+		err := json.Unmarshal(data, vol)
+		return vol.MountPath, err
+	})
+}
@@ -0,0 +1,110 @@
+package cubefs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewNodeLayout(t *testing.T) {
+	l := newNodeLayout("other.csi.cubefs.com", &Options{})
+	if l.clientBin != DefaultClientBin || l.kubeletDir != DefaultKubeletDir {
+		t.Errorf("default layout = %+v, want the default paths", l)
+	}
+	if want := filepath.Join(DefaultClientConfDir, "other.csi.cubefs.com"); l.confDir != want {
+		t.Errorf("confDir = %q, want %q", l.confDir, want)
+	}
+	if want := filepath.Join(DefaultClientLogDir, "other.csi.cubefs.com"); l.logDir != want {
+		t.Errorf("logDir = %q, want %q", l.logDir, want)
+	}
+	if l.legacyConfDir != DefaultClientConfDir {
+		t.Errorf("legacyConfDir = %q, want %q", l.legacyConfDir, DefaultClientConfDir)
+	}
+
+	l = newNodeLayout(DriverName, &Options{
+		ClientBin:     "/opt/cubefs/bin/cfs-client",
+		ClientConfDir: "/etc/cubefs/",
+		ClientLogDir:  "/var/log//cubefs",
+		KubeletDir:    "/data/kubelet",
+	})
+	if l.clientBin != "/opt/cubefs/bin/cfs-client" || l.confDir != "/etc/cubefs/"+DriverName ||
+		l.logDir != "/var/log/cubefs/"+DriverName {
+		t.Errorf("layout = %+v, want the configured paths cleaned", l)
+	}
+	if got, want := l.kubeletPodsDir(), "/data/kubelet/pods"; got != want {
+		t.Errorf("kubeletPodsDir() = %q, want %q", got, want)
+	}
+	if got, want := l.kubeletCSIPluginDir(), "/data/kubelet/plugins/kubernetes.io/csi"; got != want {
+		t.Errorf("kubeletCSIPluginDir() = %q, want %q", got, want)
+	}
+}
+
+func TestValidateLayoutOptions(t *testing.T) {
+	if err := validateLayoutOptions(&Options{}); err != nil {
+		t.Errorf("validateLayoutOptions() of the defaults = %v", err)
+	}
+	if err := validateLayoutOptions(&Options{ClientConfDir: "/etc/cubefs", KubeletDir: "/data/kubelet"}); err != nil {
+		t.Errorf("validateLayoutOptions() = %v", err)
+	}
+	err := validateLayoutOptions(&Options{KubeletDir: "kubelet"})
+	if err == nil || !strings.Contains(err.Error(), "kubelet directory must be an absolute path") {
+		t.Errorf("validateLayoutOptions() of a relative path = %v, want an error", err)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	const otherDriver = "other.csi.cubefs.com"
+	dir := t.TempDir()
+	opts := &Options{ClientConfDir: filepath.Join(dir, "conf"), KubeletDir: filepath.Join(dir, "kubelet")}
+	legacy := opts.ClientConfDir
+	pluginDir := filepath.Join(opts.KubeletDir, "plugins", "kubernetes.io", "csi")
+
+	conf := func(mountPath string) string { return `{"mountPoint":"` + mountPath + `"}` }
+	writeFile(t, filepath.Join(legacy, "pvc-ours.json"), conf(filepath.Join(pluginDir, DriverName, "abc", "globalmount")))
+	writeFile(t, filepath.Join(legacy, "pvc-old-kubelet.json"), conf(filepath.Join(pluginDir, "pv", "pvc-old-kubelet", "globalmount")))
+	writeFile(t, filepath.Join(legacy, "pvc-other.json"), conf(filepath.Join(pluginDir, otherDriver, "def", "globalmount")))
+	writeFile(t, filepath.Join(legacy, "pvc-broken.json"), "not json")
+	writeFile(t, filepath.Join(legacy, "pvc-unstaged.json"), conf(filepath.Join(legacyMountDir, "pvc-unstaged")))
+	writeFile(t, filepath.Join(legacy, "ephemeral", "csi-ours.json"),
+		`{"volumeId":"csi-ours","mountPath":"`+filepath.Join(pluginDir, DriverName, "ephemeral", "csi-ours")+`"}`)
+	writeFile(t, filepath.Join(legacy, "ephemeral", "csi-other.json"),
+		`{"volumeId":"csi-other","mountPath":"`+filepath.Join(pluginDir, otherDriver, "ephemeral", "csi-other")+`"}`)
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	ours := newNodeLayout(DriverName, opts)
+	ours.migrateLayout(DriverName)
+	for _, name := range []string{"pvc-ours.json", "pvc-old-kubelet.json"} {
+		if !exists(filepath.Join(ours.confDir, name)) || exists(filepath.Join(legacy, name)) {
+			t.Errorf("%s not moved below the driver directory", name)
+		}
+	}
+	if !exists(filepath.Join(ours.ephemeralRecordDir(), "csi-ours.json")) {
+		t.Error("ephemeral record not moved below the driver directory")
+	}
+	for _, path := range []string{"pvc-other.json", "pvc-broken.json", "pvc-unstaged.json", "ephemeral/csi-other.json"} {
+		if !exists(filepath.Join(legacy, path)) {
+			t.Errorf("%s taken", path)
+		}
+	}
+
+	// the other driver does not take the volumes staged by old kubelets
+	writeFile(t, filepath.Join(legacy, "pvc-old-kubelet2.json"), conf(filepath.Join(pluginDir, "pv", "pvc-old-kubelet2", "globalmount")))
+	other := newNodeLayout(otherDriver, opts)
+	other.migrateLayout(otherDriver)
+	if !exists(filepath.Join(other.confDir, "pvc-other.json")) || !exists(filepath.Join(other.ephemeralRecordDir(), "csi-other.json")) {
+		t.Error("files of the other driver not moved below its directory")
+	}
+	if !exists(filepath.Join(legacy, "pvc-old-kubelet2.json")) {
+		t.Error("volume staged by an old kubelet taken by a driver with another name")
+	}
+
+	// migrating again changes nothing
+	ours.migrateLayout(DriverName)
+	if !exists(filepath.Join(ours.confDir, "pvc-ours.json")) {
+		t.Error("migrated file lost by a second migration")
+	}
+}
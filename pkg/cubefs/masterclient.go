@@ -0,0 +1,375 @@
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majlu/my-cubefs-csi/pkg/metrics"
+	"github.com/majlu/my-cubefs-csi/pkg/util"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultMasterQPS         = 10
+	defaultMasterBurst       = 20
+	defaultMasterMaxInflight = 16
+
+	// masterDialectTTL is how long a detected master version is trusted
+	masterDialectTTL = 10 * time.Minute
+)
+
+var (
+	masterQueueDepth = metrics.NewGaugeVec("master_queue_depth",
+		"Number of master requests waiting for the rate limiter or an in-flight slot.", "cluster")
+	masterInflight = metrics.NewGaugeVec("master_inflight_requests",
+		"Number of master requests in flight.", "cluster")
+	masterThrottled = metrics.NewCounterVec("master_throttled_total",
+		"Number of master requests delayed by the rate limiter or the in-flight cap.", "cluster")
+	masterRejected = metrics.NewCounterVec("master_rejected_total",
+		"Number of master requests given up while queueing because of the context deadline.", "cluster")
+)
+
+// MasterLimits throttles the requests sent to the masters of one cluster.
+type MasterLimits struct {
+	// QPS is the token bucket refill rate, zero or less means unlimited.
+	QPS float64
+	// Burst is the token bucket size.
+	Burst int
+	// MaxInflight caps the concurrent requests, zero or less means unlimited.
+	MaxInflight int
+}
+
+// masterClientPool hands out one masterClient per cluster, so every CfsServer
+// of the same cluster shares its limits.
+type masterClientPool struct {
+	mutex   sync.Mutex
+	limits  MasterLimits
+	clients map[string]*masterClient
+}
+
+var masterClients = &masterClientPool{
+	limits: MasterLimits{
+		QPS:         defaultMasterQPS,
+		Burst:       defaultMasterBurst,
+		MaxInflight: defaultMasterMaxInflight,
+	},
+	clients: make(map[string]*masterClient),
+}
+
+// SetMasterLimits sets the limits of the master clients created afterwards.
+func SetMasterLimits(limits MasterLimits) {
+	masterClients.mutex.Lock()
+	defer masterClients.mutex.Unlock()
+	masterClients.limits = limits
+}
+
+func (p *masterClientPool) get(masterAddr string) *masterClient {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if c, ok := p.clients[masterAddr]; ok {
+		return c
+	}
+	c := newMasterClient(masterAddr, p.limits)
+	p.clients[masterAddr] = c
+	return c
+}
+
+type masterClient struct {
+	cluster  string
+	addrs    []string
+	limiter  *rate.Limiter
+	inflight chan struct{}
+
+	// dialect is detected at first contact and again once it expires,
+	// guarded by dialectMutex
+	dialectMutex  sync.Mutex
+	dialect       *masterDialect
+	version       string
+	dialectExpiry time.Time
+}
+
+func newMasterClient(masterAddr string, limits MasterLimits) *masterClient {
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if limits.QPS > 0 {
+		limiter = rate.NewLimiter(rate.Limit(limits.QPS), max(limits.Burst, 1))
+	}
+	var inflight chan struct{}
+	if limits.MaxInflight > 0 {
+		inflight = make(chan struct{}, limits.MaxInflight)
+	}
+	return &masterClient{
+		cluster:  masterAddr,
+		addrs:    strings.Split(masterAddr, ","),
+		limiter:  limiter,
+		inflight: inflight,
+	}
+}
+
+// acquire waits for a token and an in-flight slot, giving up when ctx is done.
+func (c *masterClient) acquire(ctx context.Context) (release func(), err error) {
+	masterQueueDepth.WithLabelValues(c.cluster).Inc()
+	defer masterQueueDepth.WithLabelValues(c.cluster).Dec()
+
+	throttled := false
+	if c.limiter.Tokens() < 1 {
+		throttled = true
+	}
+	if err = c.limiter.Wait(ctx); err != nil {
+		masterRejected.WithLabelValues(c.cluster).Inc()
+		return nil, status.Errorf(queueErrorCode(ctx), "throttled by master rate limit, cluster(%v) err(%v)", c.cluster, err)
+	}
+
+	if c.inflight != nil {
+		select {
+		case c.inflight <- struct{}{}:
+		default:
+			throttled = true
+			select {
+			case c.inflight <- struct{}{}:
+			case <-ctx.Done():
+				masterRejected.WithLabelValues(c.cluster).Inc()
+				return nil, status.Errorf(queueErrorCode(ctx), "too many in-flight master requests, cluster(%v) err(%v)", c.cluster, ctx.Err())
+			}
+		}
+	}
+	if throttled {
+		masterThrottled.WithLabelValues(c.cluster).Inc()
+	}
+
+	masterInflight.WithLabelValues(c.cluster).Inc()
+	return func() {
+		masterInflight.WithLabelValues(c.cluster).Dec()
+		if c.inflight != nil {
+			<-c.inflight
+		}
+	}, nil
+}
+
+// queueErrorCode is the code of a request given up while queueing: Canceled
+// if the caller gave up, DeadlineExceeded if the deadline passed or would
+// pass before the rate limiter lets the request through.
+func queueErrorCode(ctx context.Context) codes.Code {
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Code()
+	}
+	return codes.DeadlineExceeded
+}
+
+// getDialect returns the request dialect of the cluster, asking the masters
+// for their version when it is unknown or older than masterDialectTTL, so an
+// upgraded cluster is noticed. A pinned version, the KMasterVersion of the
+// volume, is used as it is.
+func (c *masterClient) getDialect(ctx context.Context, pinned string) (*masterDialect, string, error) {
+	if pinned != "" {
+		dialect, err := dialectForVersion(pinned)
+		if err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "invalid %s: %v", KMasterVersion, err)
+		}
+		return dialect, pinned, nil
+	}
+
+	c.dialectMutex.Lock()
+	defer c.dialectMutex.Unlock()
+	if c.dialect != nil && time.Now().Before(c.dialectExpiry) {
+		return c.dialect, c.version, nil
+	}
+
+	var version string
+	err := c.forEachMasterAddr(ctx, "GetVersion", func(addr string) error {
+		body, err := c.executeRawRequest(ctx, fmt.Sprintf("http://%s%s", addr, masterVersionPath))
+		if status.Code(err) == codes.Unimplemented {
+			return status.Errorf(codes.FailedPrecondition, "masters of cluster %s do not report their version, set the %s parameter",
+				c.cluster, KMasterVersion)
+		} else if err != nil {
+			return err
+		}
+		version, err = parseMasterVersion(body)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	dialect, err := dialectForVersion(version)
+	if err != nil {
+		return nil, "", status.Errorf(codes.FailedPrecondition, "masters of cluster %s: %v, set the %s parameter",
+			c.cluster, err, KMasterVersion)
+	}
+
+	if c.version != version {
+		klog.InfoS("Detected master version", "cluster", c.cluster, "version", version, "dialect", dialect.name)
+	}
+	c.dialect, c.version = dialect, version
+	c.dialectExpiry = time.Now().Add(masterDialectTTL)
+	return c.dialect, c.version, nil
+}
+
+// forgetDialect drops the detected dialect, the next request asks the masters
+// for their version again.
+func (c *masterClient) forgetDialect() {
+	c.dialectMutex.Lock()
+	defer c.dialectMutex.Unlock()
+	c.dialect = nil
+}
+
+// executeDialectRequest executes a request built by the dialect. A master
+// which does not know the endpoint was replaced by another release, so the
+// dialect is detected again on the next request.
+func (c *masterClient) executeDialectRequest(ctx context.Context, reqURL string) (*cfsServerResponse, error) {
+	resp, err := c.executeRequest(ctx, reqURL)
+	if status.Code(err) == codes.Unimplemented {
+		klog.InfoS("Master does not know the endpoint, detecting its version again", "cluster", c.cluster, "url", reqURL)
+		c.forgetDialect()
+	}
+	return resp, err
+}
+
+// parseMasterVersion returns the version of a master's version reply. The
+// masters send the bare version info, but the reply envelope the other
+// endpoints use is accepted too.
+func parseMasterVersion(body []byte) (string, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", status.Errorf(codes.Internal, "unmarshal master version, body(%s) err(%v)",
+			util.ShortenString(string(body), 256), err)
+	}
+	data := body
+	_, hasCode := fields["code"]
+	_, hasData := fields["data"]
+	if hasCode || hasData {
+		resp := &cfsServerResponse{}
+		if err := json.Unmarshal(body, resp); err != nil {
+			return "", status.Errorf(codes.Internal, "unmarshal master version, body(%s) err(%v)",
+				util.ShortenString(string(body), 256), err)
+		}
+		if resp.Code != ErrCodeSuccess {
+			return "", fmt.Errorf("get master version is failed: %w", NewCfsError(resp.Code, resp.Msg))
+		}
+		data = resp.Data
+	}
+
+	info := &masterVersionInfo{}
+	if err := json.Unmarshal(data, info); err != nil || info.Version == "" {
+		return "", status.Errorf(codes.Internal, "unmarshal master version, data(%s) err(%v)",
+			util.ShortenString(string(data), 256), err)
+	}
+	return info.Version, nil
+}
+
+// forEachMasterAddr calls f with each master address until one succeeds, the
+// whole walk counts as one request for the limits.
+func (c *masterClient) forEachMasterAddr(ctx context.Context, stage string, f func(addr string) error) (err error) {
+	release, err := c.acquire(ctx)
+	if err != nil {
+		klog.ErrorS(err, "Throttled before reaching masters", "stage", stage)
+		return err
+	}
+	defer release()
+
+	for _, addr := range c.addrs {
+		if err = f(addr); err == nil {
+			break
+		}
+		klog.ErrorS(err, "try master addr failed", "stage", stage, "addr", addr)
+		// every master answers the same for permanent errors, don't bother the others
+		if !isRetryable(err) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		klog.ErrorS(err, "Failed with all masters", "stage", stage)
+		return err
+	}
+
+	return nil
+}
+
+// executeRequest executes a request and decodes the reply envelope.
+func (c *masterClient) executeRequest(ctx context.Context, reqURL string) (*cfsServerResponse, error) {
+	body, err := c.executeRawRequest(ctx, reqURL)
+	if err != nil {
+		return nil, err
+	}
+	resp := &cfsServerResponse{}
+	if err = json.Unmarshal(body, resp); err != nil {
+		return nil, status.Errorf(codes.Internal, "unmarshal http response body, url(%v) body(%v) err(%v)",
+			reqURL, util.ShortenString(string(body), 256), err)
+	}
+	return resp, nil
+}
+
+// executeRawRequest executes a request, following a redirect to the leader,
+// and returns the body of the reply.
+func (c *masterClient) executeRawRequest(ctx context.Context, reqURL string) ([]byte, error) {
+	body, leader, err := c.doRequest(ctx, reqURL)
+	if err != nil || leader == "" {
+		return body, err
+	}
+
+	// a follower answered with the leader address, ask the leader directly
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "parse url(%v) err(%v)", reqURL, err)
+	}
+	u.Host = leader
+	klog.V(4).InfoS("Redirected to master leader", "url", reqURL, "leader", leader)
+	body, leader, err = c.doRequest(ctx, u.String())
+	if err == nil && leader != "" {
+		return nil, status.Errorf(codes.Unavailable, "master leader changed during request, url(%v) leader(%v)", u, leader)
+	}
+	return body, err
+}
+
+// doRequest returns the body of the reply, or the leader address when a
+// follower refused to serve the request.
+func (c *masterClient) doRequest(ctx context.Context, reqURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, "", status.Errorf(codes.Internal, "new request failed, url(%v) err(%v)", reqURL, err)
+	}
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, "", status.Errorf(codes.DeadlineExceeded, "request url failed, url(%v) err(%v)", reqURL, err)
+		}
+		return nil, "", status.Errorf(codes.Unavailable, "request url failed, url(%v) err(%v)", reqURL, err)
+	}
+
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, "", status.Errorf(codes.Unavailable, "read http response body, url(%v) bodyLen(%v) err(%v)", reqURL, len(body), err)
+	}
+
+	if httpResp.StatusCode == http.StatusForbidden {
+		if leader := strings.TrimSpace(string(body)); leader != "" {
+			return nil, leader, nil
+		}
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		// the master answers 5xx while it is electing a leader or overloaded
+		code := codes.Internal
+		if httpResp.StatusCode == http.StatusNotFound {
+			code = codes.Unimplemented
+		} else if httpResp.StatusCode >= http.StatusInternalServerError {
+			code = codes.Unavailable
+		}
+		return nil, "", status.Errorf(code, "unexpected http status, url(%v) status(%v) body(%v)",
+			reqURL, httpResp.Status, util.ShortenString(string(body), 256))
+	}
+
+	return body, "", nil
+}
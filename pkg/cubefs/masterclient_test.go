@@ -0,0 +1,124 @@
+package cubefs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMasterClientAcquireErrors(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelExpired()
+	time.Sleep(2 * time.Millisecond)
+
+	tests := []struct {
+		name   string
+		limits MasterLimits
+		ctx    context.Context
+		want   codes.Code
+	}{
+		{"rate limit canceled", MasterLimits{QPS: 0.001, Burst: 1}, canceled, codes.Canceled},
+		{"rate limit expired", MasterLimits{QPS: 0.001, Burst: 1}, expired, codes.DeadlineExceeded},
+		{"in-flight canceled", MasterLimits{MaxInflight: 1}, canceled, codes.Canceled},
+		{"in-flight expired", MasterLimits{MaxInflight: 1}, expired, codes.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMasterClient("127.0.0.1:17010", tt.limits)
+			// use up the token or the slot so the next request queues
+			release, err := c.acquire(context.Background())
+			if err != nil {
+				t.Fatalf("first acquire: %v", err)
+			}
+			defer release()
+
+			_, err = c.acquire(tt.ctx)
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("acquire code = %v, want %v (err %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestMasterClientAcquireWaits(t *testing.T) {
+	c := newMasterClient("127.0.0.1:17010", MasterLimits{MaxInflight: 1})
+	release, err := c.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	release2, err := c.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	release2()
+}
+
+func TestMasterClientFollowsLeader(t *testing.T) {
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"code":0,"msg":"success","data":"` + r.URL.Path + `"}`))
+	}))
+	defer leader.Close()
+	redirectTo := func(addr string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(addr))
+		}))
+	}
+	follower := redirectTo(strings.TrimPrefix(leader.URL, "http://"))
+	defer follower.Close()
+	// a follower naming another follower as the leader, e.g. during an election
+	stale := redirectTo(strings.TrimPrefix(follower.URL, "http://"))
+	defer stale.Close()
+
+	c := newMasterClient(strings.TrimPrefix(follower.URL, "http://"), MasterLimits{})
+	resp, err := c.executeRequest(context.Background(), follower.URL+"/admin/getVol")
+	if err != nil {
+		t.Fatalf("executeRequest() through a follower = %v", err)
+	}
+	if string(resp.Data) != `"/admin/getVol"` {
+		t.Errorf("executeRequest() data = %s, want the reply of the leader", resp.Data)
+	}
+
+	if _, err = c.executeRequest(context.Background(), stale.URL+"/admin/getVol"); status.Code(err) != codes.Unavailable {
+		t.Errorf("executeRequest() redirected twice = %v, want Unavailable", err)
+	}
+}
+
+func TestMasterClientHTTPStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   codes.Code
+	}{
+		{http.StatusNotFound, codes.Unimplemented},
+		{http.StatusServiceUnavailable, codes.Unavailable},
+		{http.StatusBadRequest, codes.Internal},
+		// a 403 without a leader address is not a redirect
+		{http.StatusForbidden, codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer master.Close()
+			c := newMasterClient(strings.TrimPrefix(master.URL, "http://"), MasterLimits{})
+			if _, err := c.executeRequest(context.Background(), master.URL+"/admin/getVol"); status.Code(err) != tt.want {
+				t.Errorf("executeRequest() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
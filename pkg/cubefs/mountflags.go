@@ -0,0 +1,133 @@
+package cubefs
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cubefs client options set by mount flags
+const (
+	KEnablePosixACL = "enablePosixACL"
+	KWriteCache     = "writecache"
+	KKeepCache      = "keepcache"
+	KAttrValid      = "attrValid"
+	KEntryValid     = "entryValid"
+	KICacheTimeout  = "icacheTimeout"
+	KLookupValid    = "lookupValid"
+)
+
+// mountFlag is how a StorageClass mountOption or PV mount flag is applied,
+// to the cubefs client config, to the bind mounts into the pods, or both.
+type mountFlag struct {
+	// clientKey is the client option set by the flag
+	clientKey string
+	// clientValue is the value of a flag without value, empty if the flag needs one
+	clientValue string
+	// bindFlag is the option of the bind mounts set by the flag
+	bindFlag string
+	// attribute is the volume attribute overridden by the flag
+	attribute string
+	validate  func(value string) error
+}
+
+var mountFlags = map[string]mountFlag{
+	"ro":            {clientKey: KReadOnly, clientValue: "true", bindFlag: "ro"},
+	"posixacl":      {clientKey: KEnablePosixACL, clientValue: "true"},
+	"writecache":    {clientKey: KWriteCache, clientValue: "true"},
+	"keepcache":     {clientKey: KKeepCache, clientValue: "true"},
+	"subdir":        {attribute: KSubdir},
+	"loglevel":      {clientKey: KLogLevel, validate: oneOf("debug", "info", "warn", "error")},
+	"attrvalid":     {clientKey: KAttrValid, validate: seconds},
+	"entryvalid":    {clientKey: KEntryValid, validate: seconds},
+	"icachetimeout": {clientKey: KICacheTimeout, validate: seconds},
+	"lookupvalid":   {clientKey: KLookupValid, validate: seconds},
+	"nosuid":        {bindFlag: "nosuid"},
+	"nodev":         {bindFlag: "nodev"},
+	"noexec":        {bindFlag: "noexec"},
+}
+
+// mountOptions are the effective options of a list of mount flags.
+type mountOptions struct {
+	clientConf map[string]string
+	bindFlags  []string
+	attributes map[string]string
+}
+
+// parseMountFlags maps mount flags such as "ro", "attrvalid=30" or
+// "nosuid,nodev" to client options and bind mount flags, unknown flags are
+// rejected.
+func parseMountFlags(flags []string) (*mountOptions, error) {
+	opts := &mountOptions{clientConf: make(map[string]string), attributes: make(map[string]string)}
+	for _, flag := range flags {
+		for _, option := range strings.Split(flag, ",") {
+			option = strings.TrimSpace(option)
+			if option == "" {
+				continue
+			}
+			name, value, hasValue := strings.Cut(option, "=")
+			spec, ok := mountFlags[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown mount flag %q, supported: %s", option, strings.Join(supportedMountFlags(), ", "))
+			}
+
+			if spec.attribute != "" {
+				if !hasValue || value == "" {
+					return nil, fmt.Errorf("mount flag %q needs a value", name)
+				}
+				opts.attributes[spec.attribute] = value
+			} else if spec.clientKey != "" {
+				switch {
+				case spec.clientValue != "" && hasValue:
+					return nil, fmt.Errorf("mount flag %q takes no value", name)
+				case spec.clientValue == "" && (!hasValue || value == ""):
+					return nil, fmt.Errorf("mount flag %q needs a value", name)
+				case spec.clientValue != "":
+					value = spec.clientValue
+				}
+				if spec.validate != nil {
+					if err := spec.validate(value); err != nil {
+						return nil, fmt.Errorf("invalid mount flag %q: %w", option, err)
+					}
+				}
+				opts.clientConf[spec.clientKey] = value
+			} else if hasValue {
+				return nil, fmt.Errorf("mount flag %q takes no value", name)
+			}
+			if spec.bindFlag != "" && !slices.Contains(opts.bindFlags, spec.bindFlag) {
+				opts.bindFlags = append(opts.bindFlags, spec.bindFlag)
+			}
+		}
+	}
+	return opts, nil
+}
+
+func supportedMountFlags() []string {
+	names := make([]string, 0, len(mountFlags))
+	for name, spec := range mountFlags {
+		if spec.attribute != "" || (spec.clientKey != "" && spec.clientValue == "") {
+			name += "=<value>"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func oneOf(values ...string) func(string) error {
+	return func(value string) error {
+		if !slices.Contains(values, value) {
+			return fmt.Errorf("must be one of %v", values)
+		}
+		return nil
+	}
+}
+
+func seconds(value string) error {
+	if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+		return fmt.Errorf("must be a number of seconds")
+	}
+	return nil
+}
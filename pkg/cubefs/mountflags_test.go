@@ -0,0 +1,138 @@
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestParseMountFlags(t *testing.T) {
+	tests := []struct {
+		name           string
+		flags          []string
+		wantClientConf map[string]string
+		wantBindFlags  []string
+		wantAttributes map[string]string
+		wantErr        string
+	}{
+		{
+			name:           "none",
+			wantClientConf: map[string]string{},
+			wantAttributes: map[string]string{},
+		},
+		{
+			name:           "client and bind flags",
+			flags:          []string{"ro", "nosuid,nodev", " posixacl ", "attrvalid=30", "LogLevel=warn"},
+			wantClientConf: map[string]string{KReadOnly: "true", KEnablePosixACL: "true", KAttrValid: "30", KLogLevel: "warn"},
+			wantBindFlags:  []string{"ro", "nosuid", "nodev"},
+			wantAttributes: map[string]string{},
+		},
+		{
+			name:           "repeated flags",
+			flags:          []string{"noexec,noexec", "entryvalid=1", "entryvalid=2"},
+			wantClientConf: map[string]string{KEntryValid: "2"},
+			wantBindFlags:  []string{"noexec"},
+			wantAttributes: map[string]string{},
+		},
+		{
+			name:           "subdir",
+			flags:          []string{"subdir=app/data", "keepcache"},
+			wantClientConf: map[string]string{KKeepCache: "true"},
+			wantAttributes: map[string]string{KSubdir: "app/data"},
+		},
+		{name: "unknown flag", flags: []string{"rw"}, wantErr: `unknown mount flag "rw"`},
+		{name: "value on a switch", flags: []string{"ro=false"}, wantErr: `"ro" takes no value`},
+		{name: "value on a bind flag", flags: []string{"nosuid=1"}, wantErr: `"nosuid" takes no value`},
+		{name: "missing value", flags: []string{"attrvalid"}, wantErr: `"attrvalid" needs a value`},
+		{name: "empty value", flags: []string{"loglevel="}, wantErr: `"loglevel" needs a value`},
+		{name: "empty subdir", flags: []string{"subdir="}, wantErr: `"subdir" needs a value`},
+		{name: "invalid seconds", flags: []string{"lookupvalid=-1"}, wantErr: "must be a number of seconds"},
+		{name: "invalid log level", flags: []string{"loglevel=trace"}, wantErr: "must be one of"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseMountFlags(tt.flags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseMountFlags(%q) err = %v, want %q", tt.flags, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMountFlags(%q) = %v", tt.flags, err)
+			}
+			if !reflect.DeepEqual(opts.clientConf, tt.wantClientConf) {
+				t.Errorf("clientConf = %v, want %v", opts.clientConf, tt.wantClientConf)
+			}
+			if !reflect.DeepEqual(opts.bindFlags, tt.wantBindFlags) {
+				t.Errorf("bindFlags = %v, want %v", opts.bindFlags, tt.wantBindFlags)
+			}
+			if !reflect.DeepEqual(opts.attributes, tt.wantAttributes) {
+				t.Errorf("attributes = %v, want %v", opts.attributes, tt.wantAttributes)
+			}
+		})
+	}
+}
+
+func TestSupportedMountFlags(t *testing.T) {
+	got := strings.Join(supportedMountFlags(), " ")
+	for _, want := range []string{"ro", "nosuid", "attrvalid=<value>", "subdir=<value>"} {
+		if !strings.Contains(" "+got+" ", " "+want+" ") {
+			t.Errorf("supportedMountFlags() = %s, want %s listed", got, want)
+		}
+	}
+}
+
+func TestNodeMountFlags(t *testing.T) {
+	ctx := context.Background()
+	n, _, _ := newTestNodeService(t)
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "globalmount")
+	target := filepath.Join(dir, "mount")
+	capability := mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+	capability.GetMount().MountFlags = []string{"attrvalid=30", "nosuid,nodev"}
+	// the mount flags override the volume attributes
+	volumeContext := map[string]string{KMasterAddr: "127.0.0.1:17010", KVolumeName: "pvc-a", KAttrValid: "5"}
+
+	_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-a",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  capability,
+		VolumeContext:     volumeContext,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	data, err := os.ReadFile(clientConfFilePath("pvc-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := make(map[string]string)
+	if err = json.Unmarshal(data, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf[KAttrValid] != "30" {
+		t.Errorf("client config %s = %q, want 30 from the mount flags", KAttrValid, conf[KAttrValid])
+	}
+
+	_, err = n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "pvc-a",
+		StagingTargetPath: stagingPath,
+		TargetPath:        target,
+		VolumeCapability:  capability,
+		VolumeContext:     volumeContext,
+	})
+	if err != nil {
+		t.Fatalf("NodePublishVolume: %v", err)
+	}
+	want := []string{"bind", "nosuid", "nodev"}
+	if got := n.refs.targetBind("pvc-a", target).options; !reflect.DeepEqual(got, want) {
+		t.Errorf("bind mount options = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,367 @@
+package cubefs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// StorageClass parameters sizing the mount pods of a volume, they are not
+// passed to the cubefs client.
+const (
+	KMountPodCPURequest    = "mountPodCpuRequest"
+	KMountPodCPULimit      = "mountPodCpuLimit"
+	KMountPodMemoryRequest = "mountPodMemoryRequest"
+	KMountPodMemoryLimit   = "mountPodMemoryLimit"
+
+	mountPodParamPrefix = "mountPod"
+)
+
+const (
+	mountPodNamePrefix    = "cfs-mount-"
+	mountPodAppLabel      = "my-cfs-mount"
+	mountPodContainerName = "cfs-client"
+	mountPodConfDir       = "/cfs/conf"
+	mountPodConfKey       = "client.json"
+	mountPodPollInterval  = time.Second
+	// mountPodCleanupTimeout bounds deleting a mount pod which failed to mount,
+	// the request deadline may have passed already
+	mountPodCleanupTimeout = 30 * time.Second
+
+	annotationVolumeId = DriverName + "/volume-id"
+	annotationNodeId   = DriverName + "/node-id"
+	// annotationPod is the namespace/name of the pod served by the mount pod of an ephemeral volume
+	annotationPod = DriverName + "/pod"
+)
+
+// container waiting reasons after which the mount pod will not mount by itself
+var mountPodFatalReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// podRunner runs the cubefs client of every volume staged on the node in its
+// own pod, which mounts the volume on the host through bidirectional mount
+// propagation. The client config, owner included, is handed to the pod in a
+// Secret named like the pod.
+type podRunner struct {
+	nodeId    string
+	clientSet kubernetes.Interface
+	image     string
+	namespace string
+	timeout   time.Duration
+}
+
+func newPodRunner(nodeId string, clientSet kubernetes.Interface, opts *Options) *podRunner {
+	return &podRunner{
+		nodeId:    nodeId,
+		clientSet: clientSet,
+		image:     opts.MountPodImage,
+		namespace: opts.MountPodNamespace,
+		timeout:   opts.MountPodTimeout,
+	}
+}
+
+// mountPodName is unique per node and volume, and a valid pod name whatever the volume ID is.
+func mountPodName(nodeId, volumeId string) string {
+	sum := sha256.Sum256([]byte(nodeId + "/" + volumeId))
+	return mountPodNamePrefix + hex.EncodeToString(sum[:])[:20]
+}
+
+func (r *podRunner) start(ctx context.Context, volumeId, mountPath string) error {
+	data, err := os.ReadFile(clientConfFilePath(volumeId))
+	if err != nil {
+		return fmt.Errorf("read client config of volume %s: %w", volumeId, err)
+	}
+	conf := make(map[string]string)
+	if err = json.Unmarshal(data, &conf); err != nil {
+		return fmt.Errorf("decode client config of volume %s: %w", volumeId, err)
+	}
+
+	pod, secret, err := r.newMountPod(volumeId, mountPath, conf)
+	if err != nil {
+		return err
+	}
+	if err = r.ensureConfSecret(ctx, secret); err != nil {
+		return err
+	}
+	if err = r.ensurePod(ctx, pod); err != nil {
+		return err
+	}
+
+	if err = r.waitMounted(ctx, pod.Name, mountPath); err != nil {
+		klog.ErrorS(err, "Mount pod failed to mount the volume, deleting it", "volumeId", volumeId, "pod", klog.KObj(pod))
+		// the Secret holds the owner, it must not outlive the request
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mountPodCleanupTimeout)
+		defer cancel()
+		if delErr := r.stop(cleanupCtx, volumeId); delErr != nil {
+			klog.ErrorS(delErr, "Failed to delete mount pod", "volumeId", volumeId, "pod", klog.KObj(pod))
+		}
+		return err
+	}
+	klog.InfoS("Mount pod mounted the volume", "volumeId", volumeId, "pod", klog.KObj(pod), "mountPath", mountPath)
+	return nil
+}
+
+func (r *podRunner) stop(ctx context.Context, volumeId string) error {
+	name := mountPodName(r.nodeId, volumeId)
+	err := r.clientSet.CoreV1().Pods(r.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete mount pod %s/%s: %w", r.namespace, name, err)
+	}
+	klog.InfoS("Deleted mount pod", "volumeId", volumeId, "pod", klog.KRef(r.namespace, name))
+
+	err = r.clientSet.CoreV1().Secrets(r.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete mount pod secret %s/%s: %w", r.namespace, name, err)
+	}
+	return nil
+}
+
+// ensureConfSecret creates the client config Secret of a mount pod, or updates
+// the one left by an earlier stage.
+func (r *podRunner) ensureConfSecret(ctx context.Context, secret *corev1.Secret) error {
+	secrets := r.clientSet.CoreV1().Secrets(r.namespace)
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if err == nil {
+		return nil
+	} else if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("create mount pod secret %s/%s: %w", r.namespace, secret.Name, err)
+	}
+	existing, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get mount pod secret %s/%s: %w", r.namespace, secret.Name, err)
+	}
+	existing.Data = secret.Data
+	if _, err = secrets.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update mount pod secret %s/%s: %w", r.namespace, secret.Name, err)
+	}
+	return nil
+}
+
+// ensurePod creates the mount pod, a running one is reused and a terminated or
+// terminating one is replaced.
+func (r *podRunner) ensurePod(ctx context.Context, pod *corev1.Pod) error {
+	pods := r.clientSet.CoreV1().Pods(r.namespace)
+	existing, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return fmt.Errorf("get mount pod %s/%s: %w", r.namespace, pod.Name, err)
+	case existing.DeletionTimestamp == nil && existing.Status.Phase != corev1.PodFailed && existing.Status.Phase != corev1.PodSucceeded:
+		klog.InfoS("Reusing mount pod", "pod", klog.KObj(existing))
+		return nil
+	default:
+		klog.InfoS("Replacing terminated mount pod", "pod", klog.KObj(existing), "phase", existing.Status.Phase)
+		if err = pods.Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("delete mount pod %s/%s: %w", r.namespace, pod.Name, err)
+		}
+		err = wait.PollUntilContextTimeout(ctx, mountPodPollInterval, r.timeout, true, func(ctx context.Context) (bool, error) {
+			_, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return true, nil
+			}
+			return false, err
+		})
+		if err != nil {
+			return fmt.Errorf("wait for mount pod %s/%s to be deleted: %w", r.namespace, pod.Name, err)
+		}
+	}
+
+	if _, err = pods.Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("create mount pod %s/%s: %w", r.namespace, pod.Name, err)
+	}
+	klog.InfoS("Created mount pod", "pod", klog.KObj(pod), "volumeId", pod.Annotations[annotationVolumeId])
+	return nil
+}
+
+// waitMounted waits for the mount to appear at mountPath, failing early when
+// the mount pod cannot run.
+func (r *podRunner) waitMounted(ctx context.Context, name, mountPath string) error {
+	var lastState string
+	start := time.Now()
+	err := wait.PollUntilContextTimeout(ctx, mountPodPollInterval, r.timeout, true, func(ctx context.Context) (bool, error) {
+		if isMnt, err := isClientMounted(mountPath); err == nil && isMnt {
+			return true, nil
+		}
+
+		pod, err := r.clientSet.CoreV1().Pods(r.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			lastState = err.Error()
+			return false, nil
+		}
+		lastState = string(pod.Status.Phase)
+		if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+			return false, status.Errorf(codes.Internal, "mount pod %s/%s exited: %s %s", r.namespace, name, pod.Status.Reason, pod.Status.Message)
+		}
+		for _, cs := range pod.Status.ContainerStatuses {
+			if waiting := cs.State.Waiting; waiting != nil && mountPodFatalReasons[waiting.Reason] {
+				return false, status.Errorf(codes.Internal, "mount pod %s/%s cannot run: %s: %s", r.namespace, name, waiting.Reason, waiting.Message)
+			}
+		}
+		return false, nil
+	})
+	if wait.Interrupted(err) {
+		return status.Errorf(codes.DeadlineExceeded, "volume not mounted at %s by mount pod %s/%s after %v, pod state: %s",
+			mountPath, r.namespace, name, time.Since(start).Round(time.Second), lastState)
+	}
+	return err
+}
+
+// newMountPod returns the mount pod of a volume and the Secret holding its
+// client config. The pod runs the client directly, without a shell, and
+// reads the config from the Secret mounted at mountPodConfDir.
+func (r *podRunner) newMountPod(volumeId, mountPath string, conf map[string]string) (*corev1.Pod, *corev1.Secret, error) {
+	resources, err := mountPodResources(conf)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	logDir := conf[KLogDir]
+	if !filepath.IsAbs(logDir) || filepath.Clean(logDir) != logDir {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "client log directory %q must be a clean absolute path", logDir)
+	}
+	// the logs stay on the host next to the ones of the process mount mode,
+	// they are needed most after the pod crashed or was deleted
+	hostLogDir, err := layout.hostLogDir(logDir)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	clientConf, err := json.Marshal(clientOnlyConf(conf))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := mountPodName(r.nodeId, volumeId)
+	annotations := map[string]string{
+		annotationVolumeId: volumeId,
+		annotationNodeId:   r.nodeId,
+	}
+	if conf[KPodName] != "" {
+		annotations[annotationPod] = conf[KPodNamespace] + "/" + conf[KPodName]
+	}
+	meta := metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   r.namespace,
+		Labels:      map[string]string{"app": mountPodAppLabel},
+		Annotations: annotations,
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: meta,
+		Data:       map[string][]byte{mountPodConfKey: clientConf},
+	}
+
+	privileged := true
+	bidirectional := corev1.MountPropagationBidirectional
+	hostPathType := corev1.HostPathDirectoryOrCreate
+	confMode := int32(0400)
+	// the parent is shared with the host, the client mounts onto mountPath inside it
+	mountDir := filepath.Dir(mountPath)
+
+	pod := &corev1.Pod{
+		ObjectMeta: *meta.DeepCopy(),
+		Spec: corev1.PodSpec{
+			NodeName:          r.nodeId,
+			HostNetwork:       true,
+			RestartPolicy:     corev1.RestartPolicyAlways,
+			PriorityClassName: "system-node-critical",
+			Tolerations:       []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+			Containers: []corev1.Container{{
+				Name:            mountPodContainerName,
+				Image:           r.image,
+				Command:         []string{CfsClientBin, "-f", "-c", filepath.Join(mountPodConfDir, mountPodConfKey)},
+				Resources:       resources,
+				SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+				VolumeMounts: []corev1.VolumeMount{
+					{
+						Name:             "mount-dir",
+						MountPath:        mountDir,
+						MountPropagation: &bidirectional,
+					},
+					{Name: "client-conf", MountPath: mountPodConfDir, ReadOnly: true},
+					{Name: "client-log", MountPath: logDir},
+				},
+			}},
+			Volumes: []corev1.Volume{
+				{
+					Name: "mount-dir",
+					VolumeSource: corev1.VolumeSource{
+						HostPath: &corev1.HostPathVolumeSource{Path: mountDir, Type: &hostPathType},
+					},
+				},
+				{
+					Name: "client-conf",
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{SecretName: name, DefaultMode: &confMode},
+					},
+				},
+				{
+					Name: "client-log",
+					VolumeSource: corev1.VolumeSource{
+						HostPath: &corev1.HostPathVolumeSource{Path: hostLogDir, Type: &hostPathType},
+					},
+				},
+			},
+		},
+	}
+	return pod, secret, nil
+}
+
+// mountPodResources reads the mount pod requests and limits from the volume parameters.
+func mountPodResources(param map[string]string) (corev1.ResourceRequirements, error) {
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{},
+		Limits:   corev1.ResourceList{},
+	}
+	for _, r := range []struct {
+		key  string
+		list corev1.ResourceList
+		name corev1.ResourceName
+	}{
+		{KMountPodCPURequest, resources.Requests, corev1.ResourceCPU},
+		{KMountPodCPULimit, resources.Limits, corev1.ResourceCPU},
+		{KMountPodMemoryRequest, resources.Requests, corev1.ResourceMemory},
+		{KMountPodMemoryLimit, resources.Limits, corev1.ResourceMemory},
+	} {
+		value := param[r.key]
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return resources, fmt.Errorf("invalid %s %q: %v", r.key, value, err)
+		}
+		r.list[r.name] = quantity
+	}
+	return resources, nil
+}
+
+// clientOnlyConf drops the driver parameters the cubefs client does not know.
+func clientOnlyConf(conf map[string]string) map[string]string {
+	clientConf := make(map[string]string, len(conf))
+	for k, v := range conf {
+		if !strings.HasPrefix(k, mountPodParamPrefix) {
+			clientConf[k] = v
+		}
+	}
+	return clientConf
+}
@@ -0,0 +1,230 @@
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+func newTestPodRunner() *podRunner {
+	return &podRunner{
+		nodeId:    "node-1",
+		clientSet: fake.NewSimpleClientset(),
+		image:     "cubefs/cfs-client:test",
+		namespace: "cubefs-mount",
+	}
+}
+
+func TestNewMountPod(t *testing.T) {
+	saved := layout
+	layout = newNodeLayout("driver", &Options{ClientLogHostDir: "/opt/cubefs/node/logs"})
+	t.Cleanup(func() { layout = saved })
+	r := newTestPodRunner()
+	conf := map[string]string{
+		KVolumeName:          "pvc-1",
+		KOwner:               "secret-owner",
+		KLogDir:              "/cfs/logs/driver/pvc-1",
+		KMountPodMemoryLimit: "1Gi",
+		KMountPodCPURequest:  "100m",
+		KMasterAddr:          "10.0.0.1:17010",
+		KPodNamespace:        "team-a",
+		KPodName:             "web-0",
+		KMountPoint:          "/mnt/pvc-1/mount",
+		KVolType:             defaultVolType,
+		KLogLevel:            defaultLogLevel,
+		KConsulAddr:          defaultConsulAddr,
+	}
+	pod, secret, err := r.newMountPod("vol-1", "/mnt/pvc-1/mount", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := pod.Spec.Containers[0]
+	wantCommand := []string{CfsClientBin, "-f", "-c", mountPodConfDir + "/" + mountPodConfKey}
+	if !slices.Equal(container.Command, wantCommand) {
+		t.Errorf("command = %q, want the client run without a shell %q", container.Command, wantCommand)
+	}
+	if len(container.Env) != 0 {
+		t.Errorf("env = %v, want the config in the secret only", container.Env)
+	}
+	if secret.Name != pod.Name {
+		t.Errorf("secret name = %s, want the pod name %s", secret.Name, pod.Name)
+	}
+	clientConf := make(map[string]string)
+	if err = json.Unmarshal(secret.Data[mountPodConfKey], &clientConf); err != nil {
+		t.Fatal(err)
+	}
+	if clientConf[KOwner] != "secret-owner" || clientConf[KMountPodMemoryLimit] != "" {
+		t.Errorf("client config = %v, want the owner and no mount pod parameters", clientConf)
+	}
+	mounts := make(map[string]string)
+	for _, m := range container.VolumeMounts {
+		mounts[m.Name] = m.MountPath
+	}
+	if mounts["client-conf"] != mountPodConfDir || mounts["client-log"] != conf[KLogDir] || mounts["mount-dir"] != "/mnt/pvc-1" {
+		t.Errorf("volume mounts = %v", mounts)
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == "client-log" && (v.HostPath == nil || v.HostPath.Path != "/opt/cubefs/node/logs/driver/pvc-1") {
+			t.Errorf("client-log volume = %+v, want the host directory of the client logs", v.VolumeSource)
+		}
+	}
+	if pod.Annotations[annotationPod] != "team-a/web-0" {
+		t.Errorf("pod annotation = %q, want team-a/web-0", pod.Annotations[annotationPod])
+	}
+}
+
+func TestNewMountPodRejectsRelativeLogDir(t *testing.T) {
+	r := newTestPodRunner()
+	for _, logDir := range []string{"logs", "/cfs/logs/../../etc", "", "/etc", layout.logDir + "-other/pvc-1"} {
+		_, _, err := r.newMountPod("vol-1", "/mnt/pvc-1/mount", map[string]string{KLogDir: logDir})
+		if err == nil {
+			t.Errorf("newMountPod with log dir %q succeeded", logDir)
+		}
+	}
+}
+
+func TestMountPodSecretLifecycle(t *testing.T) {
+	r := newTestPodRunner()
+	ctx := context.Background()
+	conf := map[string]string{KVolumeName: "pvc-1", KOwner: "owner-1", KLogDir: filepath.Join(layout.logDir, "pvc-1")}
+	_, secret, err := r.newMountPod("vol-1", "/mnt/pvc-1/mount", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.ensureConfSecret(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second stage updates the config left by the first one
+	conf[KOwner] = "owner-2"
+	_, secret, err = r.newMountPod("vol-1", "/mnt/pvc-1/mount", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.ensureConfSecret(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	secrets := r.clientSet.CoreV1().Secrets(r.namespace)
+	got, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got.Data[mountPodConfKey]), "owner-2") {
+		t.Errorf("secret config = %s, want the updated owner", got.Data[mountPodConfKey])
+	}
+
+	if err = r.stop(ctx, "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = secrets.Get(ctx, secret.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("secret after stop: err = %v, want not found", err)
+	}
+	// stopping again finds nothing to delete
+	if err = r.stop(ctx, "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMountPodResources(t *testing.T) {
+	resources, err := mountPodResources(map[string]string{KMountPodCPURequest: "100m", KMountPodMemoryLimit: "1Gi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu := resources.Requests[corev1.ResourceCPU]; cpu.String() != "100m" {
+		t.Errorf("cpu request = %s, want 100m", cpu.String())
+	}
+	if memory := resources.Limits[corev1.ResourceMemory]; memory.String() != "1Gi" {
+		t.Errorf("memory limit = %s, want 1Gi", memory.String())
+	}
+	if _, err = mountPodResources(map[string]string{KMountPodCPULimit: "lots"}); err == nil {
+		t.Error("invalid cpu limit accepted")
+	}
+}
+
+// ctxClientset fails deletes with a done context like the API server client
+// does, the fake clientset ignores contexts.
+type ctxClientset struct {
+	*fake.Clientset
+}
+
+func (c ctxClientset) CoreV1() typedcorev1.CoreV1Interface {
+	return ctxCoreV1{c.Clientset.CoreV1()}
+}
+
+type ctxCoreV1 struct {
+	typedcorev1.CoreV1Interface
+}
+
+func (c ctxCoreV1) Pods(namespace string) typedcorev1.PodInterface {
+	return ctxPods{c.CoreV1Interface.Pods(namespace)}
+}
+
+func (c ctxCoreV1) Secrets(namespace string) typedcorev1.SecretInterface {
+	return ctxSecrets{c.CoreV1Interface.Secrets(namespace)}
+}
+
+type ctxPods struct {
+	typedcorev1.PodInterface
+}
+
+func (p ctxPods) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.PodInterface.Delete(ctx, name, opts)
+}
+
+type ctxSecrets struct {
+	typedcorev1.SecretInterface
+}
+
+func (s ctxSecrets) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.SecretInterface.Delete(ctx, name, opts)
+}
+
+var _ kubernetes.Interface = ctxClientset{}
+
+func TestMountPodStartTimeoutCleansUp(t *testing.T) {
+	useTestLayout(t)
+	useTestMountInfo(t, "20 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n")
+	conf, err := json.Marshal(map[string]string{KVolumeName: "pvc-1", KOwner: "owner-1", KLogDir: filepath.Join(layout.logDir, "pvc-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, clientConfFilePath("vol-1"), string(conf))
+
+	r := newTestPodRunner()
+	r.clientSet = ctxClientset{fake.NewSimpleClientset()}
+	r.timeout = time.Minute
+	// the pod never mounts, the request deadline ends the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err = r.start(ctx, "vol-1", "/mnt/pvc-1/mount"); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("start() = %v, want DeadlineExceeded", err)
+	}
+
+	name := mountPodName(r.nodeId, "vol-1")
+	if _, err = r.clientSet.CoreV1().Pods(r.namespace).Get(context.Background(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("mount pod after the timeout: err = %v, want not found", err)
+	}
+	if _, err = r.clientSet.CoreV1().Secrets(r.namespace).Get(context.Background(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("mount pod secret after the timeout: err = %v, want not found", err)
+	}
+}
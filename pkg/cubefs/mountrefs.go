@@ -0,0 +1,254 @@
+package cubefs
+
+import (
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/majlu/my-cubefs-csi/pkg/mounter"
+
+	"k8s.io/klog/v2"
+	mountutils "k8s.io/mount-utils"
+)
+
+// clientMount is a mount served by one cubefs client and the target paths
+// bind mounted from it.
+type clientMount struct {
+	mountPath string
+	targets   map[string]bindMount
+}
+
+// bindMount is how a target is bind mounted from a client mount, source is
+// the client mount or a subdirectory of it. pod is the pod of the target,
+// only its UID after a restart.
+type bindMount struct {
+	source  string
+	options []string
+	pod     podInfo
+}
+
+// mountRefs tracks the users of every client mount on the node, so a client
+// mount shared by several pods is only torn down with its last target.
+type mountRefs struct {
+	mutex  sync.Mutex
+	mounts map[string]*clientMount
+	// reserved are the volumes whose client is being mounted, see reserve
+	reserved map[string]bool
+}
+
+func newMountRefs() *mountRefs {
+	return &mountRefs{
+		mounts:   make(map[string]*clientMount),
+		reserved: make(map[string]bool),
+	}
+}
+
+// rebuild recovers the references from the persisted client configs and the
+// mount table, e.g. after the node service restarted.
+func (r *mountRefs) rebuild(m mounter.Mounter) {
+	confs, err := listClientConfs()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list client configs, mount references start empty")
+		return
+	}
+
+	mountInfos, err := mountutils.ParseMountInfo(procMountInfoPath)
+	if err != nil {
+		klog.ErrorS(err, "Failed to read mount info, bind mounts are restored from the client mount root")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for volumeId, conf := range confs {
+		mountPath := conf[KMountPoint]
+		if mountPath == "" {
+			continue
+		}
+		mount := r.getOrCreateLocked(volumeId, mountPath)
+		refs, err := m.GetMountRefs(mountPath)
+		if err != nil {
+			klog.ErrorS(err, "Failed to get mount references", "volumeId", volumeId, "mountPath", mountPath)
+			continue
+		}
+		for _, target := range refs {
+			mount.targets[target] = bindMountOf(mountInfos, mountPath, target)
+		}
+		klog.InfoS("Rebuilt mount references", "volumeId", volumeId, "mountPath", mountPath, "targets", refs)
+	}
+}
+
+func (r *mountRefs) getOrCreateLocked(volumeId, mountPath string) *clientMount {
+	mount, ok := r.mounts[volumeId]
+	if !ok {
+		mount = &clientMount{targets: make(map[string]bindMount)}
+		r.mounts[volumeId] = mount
+	}
+	mount.mountPath = mountPath
+	return mount
+}
+
+// setMount records the client mount of a volume.
+func (r *mountRefs) setMount(volumeId, mountPath string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.getOrCreateLocked(volumeId, mountPath)
+	delete(r.reserved, volumeId)
+}
+
+// reserve counts a volume about to be mounted among the client mounts of the
+// node, unless the node already has limit of them, zero is no limit. The
+// reservation ends with setMount or unreserve.
+func (r *mountRefs) reserve(volumeId string, limit int64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.mounts[volumeId]; ok || r.reserved[volumeId] {
+		return true
+	}
+	if limit > 0 && int64(len(r.mounts)+len(r.reserved)) >= limit {
+		return false
+	}
+	r.reserved[volumeId] = true
+	return true
+}
+
+func (r *mountRefs) unreserve(volumeId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.reserved, volumeId)
+}
+
+// addTarget records a target bind mounted from the client mount.
+func (r *mountRefs) addTarget(volumeId, mountPath, target string, bind bindMount) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.getOrCreateLocked(volumeId, mountPath).targets[target] = bind
+}
+
+// targetBind returns how a target is bind mounted, the whole client mount if unknown.
+func (r *mountRefs) targetBind(volumeId, target string) bindMount {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	mount, ok := r.mounts[volumeId]
+	if !ok {
+		return bindMount{options: []string{"bind"}, pod: podInfoOfTarget(target)}
+	}
+	if bind, ok := mount.targets[target]; ok && bind.source != "" {
+		return bind
+	}
+	return bindMount{source: mount.mountPath, options: []string{"bind"}, pod: podInfoOfTarget(target)}
+}
+
+// removeTarget forgets a target and returns how many targets still use the client mount.
+func (r *mountRefs) removeTarget(volumeId, target string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	mount, ok := r.mounts[volumeId]
+	if !ok {
+		return 0
+	}
+	delete(mount.targets, target)
+	return len(mount.targets)
+}
+
+// liveTargets returns the targets of a volume which are still mounted,
+// dropping the ones unmounted behind our back. The targets are looked up in
+// the mount table without holding the lock, a stat of a bind mount blocks on a
+// hung client and would stall every volume of the node.
+func (r *mountRefs) liveTargets(volumeId string) []string {
+	targets := r.targets(volumeId)
+	if len(targets) == 0 {
+		return targets
+	}
+	mountInfos, err := mountutils.ParseMountInfo(procMountInfoPath)
+	if err != nil {
+		klog.ErrorS(err, "Failed to read mount info, keeping all mount references", "volumeId", volumeId)
+		return targets
+	}
+	mounted := make(map[string]bool, len(mountInfos))
+	for _, info := range mountInfos {
+		mounted[info.MountPoint] = true
+	}
+
+	var live, stale []string
+	for _, target := range targets {
+		// corrupted targets are still listed and still using the mount
+		if mounted[filepath.Clean(target)] {
+			live = append(live, target)
+		} else {
+			stale = append(stale, target)
+		}
+	}
+	if len(stale) == 0 {
+		return live
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if mount, ok := r.mounts[volumeId]; ok {
+		for _, target := range stale {
+			klog.InfoS("Dropped stale mount reference", "volumeId", volumeId, "targetPath", target)
+			delete(mount.targets, target)
+		}
+	}
+	return live
+}
+
+// targets returns the recorded targets of a volume without checking them.
+func (r *mountRefs) targets(volumeId string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	mount, ok := r.mounts[volumeId]
+	if !ok {
+		return nil
+	}
+	targets := make([]string, 0, len(mount.targets))
+	for target := range mount.targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// mountPaths returns the client mount of every known volume.
+func (r *mountRefs) mountPaths() map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	paths := make(map[string]string, len(r.mounts))
+	for volumeId, mount := range r.mounts {
+		paths[volumeId] = mount.mountPath
+	}
+	return paths
+}
+
+// procMountInfoPath is the mount table of the node, tests point it at a file of their own.
+var procMountInfoPath = "/proc/self/mountinfo"
+
+// bindMountFlags are the flags of a bind mount which must be restored when it is remounted
+var bindMountFlags = []string{"ro", "nosuid", "nodev", "noexec"}
+
+// bindMountOf finds how target is bind mounted from the client mount at
+// mountPath in the mount info, which keeps listing dead mounts.
+func bindMountOf(mountInfos []mountutils.MountInfo, mountPath, target string) bindMount {
+	bind := bindMount{source: mountPath, options: []string{"bind"}, pod: podInfoOfTarget(target)}
+	for _, info := range mountInfos {
+		if info.MountPoint != target {
+			continue
+		}
+		// the root of a bind mount of a subdirectory is the subdirectory
+		bind.source = filepath.Join(mountPath, info.Root)
+		for _, flag := range bindMountFlags {
+			if slices.Contains(info.MountOptions, flag) {
+				bind.options = append(bind.options, flag)
+			}
+		}
+		break
+	}
+	return bind
+}
+
+func (r *mountRefs) remove(volumeId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.mounts, volumeId)
+}
@@ -0,0 +1,221 @@
+package cubefs
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/majlu/my-cubefs-csi/pkg/mounter"
+	mountutils "k8s.io/mount-utils"
+)
+
+// fakeMounter answers the mount point queries from maps, the other methods
+// of mounter.Mounter are not used by the tests and panic.
+type fakeMounter struct {
+	mounter.Mounter
+	// mountPoints maps the mount points to their error, nil for a healthy mount
+	mountPoints map[string]error
+	refs        map[string][]string
+	unmounted   []string
+	// mounts are the bind mounts made, as "source target"
+	mounts []string
+}
+
+func (m *fakeMounter) IsLikelyNotMountPoint(path string) (bool, error) {
+	err, ok := m.mountPoints[path]
+	if !ok {
+		if _, statErr := os.Stat(path); statErr != nil {
+			return true, statErr
+		}
+		return true, nil
+	}
+	return false, err
+}
+
+func (m *fakeMounter) IsMountPoint(path string) (bool, error) {
+	notMnt, err := m.IsLikelyNotMountPoint(path)
+	return !notMnt, err
+}
+
+func (m *fakeMounter) CanSafelySkipMountPointCheck() bool {
+	return false
+}
+
+func (m *fakeMounter) PathExists(path string) (bool, error) {
+	return mountutils.PathExists(path)
+}
+
+func (m *fakeMounter) MakeDir(path string) error {
+	return os.MkdirAll(path, 0750)
+}
+
+func (m *fakeMounter) GetMountRefs(path string) ([]string, error) {
+	return m.refs[path], nil
+}
+
+func (m *fakeMounter) IsCorruptedMnt(err error) bool {
+	return mountutils.IsCorruptedMnt(err)
+}
+
+func (m *fakeMounter) Unmount(path string) error {
+	m.unmounted = append(m.unmounted, path)
+	delete(m.mountPoints, path)
+	return nil
+}
+
+func (m *fakeMounter) UnmountLazy(path string) error {
+	return m.Unmount(path)
+}
+
+func (m *fakeMounter) Mount(source, target, fstype string, options []string) error {
+	m.mounts = append(m.mounts, source+" "+target)
+	m.mountPoints[target] = nil
+	return nil
+}
+
+func TestMountRefsTargets(t *testing.T) {
+	const (
+		mountPath = "/var/lib/cubefs/mnt/pvc-a"
+		target1   = "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pvc-a/mount"
+		target2   = "/var/lib/kubelet/pods/uid-2/volumes/kubernetes.io~csi/pvc-a/mount"
+	)
+	r := newMountRefs()
+	r.setMount("pvc-a", mountPath)
+	r.addTarget("pvc-a", mountPath, target1, bindMount{source: mountPath + "/data", options: []string{"bind", "ro"}})
+	r.addTarget("pvc-a", mountPath, target2, bindMount{})
+
+	if got := r.targets("pvc-a"); !reflect.DeepEqual(got, []string{target1, target2}) {
+		t.Errorf("targets() = %v, want both targets", got)
+	}
+	if got := r.targetBind("pvc-a", target1); got.source != mountPath+"/data" {
+		t.Errorf("targetBind(target1).source = %q, want the recorded source", got.source)
+	}
+	// a target without a recorded source is bind mounted from the whole client mount
+	if got := r.targetBind("pvc-a", target2); got.source != mountPath || got.pod.uid != "uid-2" {
+		t.Errorf("targetBind(target2) = %+v, want the client mount of pod uid-2", got)
+	}
+	if got := r.mountPaths(); !reflect.DeepEqual(got, map[string]string{"pvc-a": mountPath}) {
+		t.Errorf("mountPaths() = %v", got)
+	}
+
+	if got := r.removeTarget("pvc-a", target1); got != 1 {
+		t.Errorf("removeTarget(target1) = %d, want 1", got)
+	}
+	if got := r.removeTarget("pvc-a", target2); got != 0 {
+		t.Errorf("removeTarget(target2) = %d, want 0", got)
+	}
+	if got := r.removeTarget("pvc-unknown", target1); got != 0 {
+		t.Errorf("removeTarget() of an unknown volume = %d, want 0", got)
+	}
+	r.remove("pvc-a")
+	if got := r.targets("pvc-a"); got != nil {
+		t.Errorf("targets() after remove = %v, want none", got)
+	}
+}
+
+func TestMountRefsLiveTargets(t *testing.T) {
+	dir := t.TempDir()
+	live, corrupted, unmounted := dir+"/live", dir+"/corrupted", dir+"/unmounted"
+	// a dead client leaves its bind mounts in the mount table
+	useTestMountInfo(t, strings.Join([]string{
+		"20 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw",
+		"40 20 0:60 / " + live + " rw,relatime - fuse.cubefs cubefs rw",
+		"41 20 0:61 / " + corrupted + " rw,relatime - fuse.cubefs cubefs rw",
+	}, "\n")+"\n")
+
+	r := newMountRefs()
+	for _, target := range []string{live, corrupted, unmounted} {
+		r.addTarget("pvc-a", dir, target, bindMount{})
+	}
+	want := []string{corrupted, live}
+	if got := r.liveTargets("pvc-a"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("liveTargets() = %v, want %v", got, want)
+	}
+	if got := r.targets("pvc-a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("targets() = %v, want the stale targets dropped", got)
+	}
+	if got := r.liveTargets("pvc-unknown"); len(got) != 0 {
+		t.Errorf("liveTargets() of an unknown volume = %v, want none", got)
+	}
+}
+
+func TestMountRefsLiveTargetsWithoutMountInfo(t *testing.T) {
+	useTestMountInfo(t, "")
+	procMountInfoPath += ".missing"
+	r := newMountRefs()
+	r.addTarget("pvc-a", "/mnt/pvc-a", "/pods/uid-1/mount", bindMount{})
+	if got := r.liveTargets("pvc-a"); !reflect.DeepEqual(got, []string{"/pods/uid-1/mount"}) {
+		t.Errorf("liveTargets() = %v, want the targets kept", got)
+	}
+}
+
+func TestMountRefsReserve(t *testing.T) {
+	r := newMountRefs()
+	r.setMount("pvc-a", "/mnt/pvc-a")
+
+	if !r.reserve("pvc-a", 1) {
+		t.Error("reserve() of a mounted volume = false, want true at the limit")
+	}
+	if r.reserve("pvc-b", 1) {
+		t.Error("reserve() over the limit = true, want false")
+	}
+	if !r.reserve("pvc-b", 2) || !r.reserve("pvc-b", 2) {
+		t.Error("reserve() under the limit = false, want true and true again for the same volume")
+	}
+	if r.reserve("pvc-c", 2) {
+		t.Error("reserve() with a reservation at the limit = true, want false")
+	}
+	r.unreserve("pvc-b")
+	if !r.reserve("pvc-c", 2) {
+		t.Error("reserve() after unreserve = false, want true")
+	}
+	r.setMount("pvc-c", "/mnt/pvc-c")
+	if len(r.reserved) != 0 {
+		t.Errorf("reserved = %v, want setMount to end the reservation", r.reserved)
+	}
+	if !r.reserve("pvc-d", 0) {
+		t.Error("reserve() without a limit = false, want true")
+	}
+}
+
+func TestBindMountOf(t *testing.T) {
+	const (
+		mountPath = "/var/lib/cubefs/mnt/pvc-a"
+		target    = "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pvc-a/mount"
+	)
+	infos := []mountutils.MountInfo{
+		{MountPoint: mountPath, Root: "/", MountOptions: []string{"rw", "relatime"}},
+		{MountPoint: target, Root: "/data/app", MountOptions: []string{"ro", "nosuid", "relatime"}},
+	}
+
+	got := bindMountOf(infos, mountPath, target)
+	want := bindMount{source: mountPath + "/data/app", options: []string{"bind", "ro", "nosuid"}, pod: podInfo{uid: "uid-1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bindMountOf() = %+v, want %+v", got, want)
+	}
+
+	got = bindMountOf(nil, mountPath, target)
+	want = bindMount{source: mountPath, options: []string{"bind"}, pod: podInfo{uid: "uid-1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bindMountOf() without mount info = %+v, want %+v", got, want)
+	}
+}
+
+func TestMountRefsRebuild(t *testing.T) {
+	useTestLayout(t)
+	const target = "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pvc-a/mount"
+	writeFile(t, clientConfFilePath("pvc-a"), `{"mountPoint":"/mnt/pvc-a","volName":"pvc-a"}`)
+	writeFile(t, clientConfFilePath("pvc-b"), `{"volName":"pvc-b"}`)
+	writeFile(t, clientConfFilePath("pvc-c"), `not json`)
+
+	r := newMountRefs()
+	r.rebuild(&fakeMounter{refs: map[string][]string{"/mnt/pvc-a": {target}}})
+
+	if got := r.mountPaths(); !reflect.DeepEqual(got, map[string]string{"pvc-a": "/mnt/pvc-a"}) {
+		t.Errorf("mountPaths() = %v, want only the config with a mount point", got)
+	}
+	if got := r.targets("pvc-a"); !reflect.DeepEqual(got, []string{target}) {
+		t.Errorf("targets() = %v, want %v", got, []string{target})
+	}
+}
@@ -2,9 +2,12 @@ package cubefs
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
 	"os"
-	"path/filepath"
-	"sync"
+	"slices"
 	"time"
 
 	"github.com/majlu/my-cubefs-csi/pkg/mounter"
@@ -12,46 +15,239 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	mountutils "k8s.io/mount-utils"
 )
 
-// Supported access modes
-const (
-	SingleNodeWriter = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
-)
-
 var (
-	nodeCaps []csi.NodeServiceCapability_RPC_Type
+	nodeCaps = []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+	}
 )
 
 type NodeService struct {
-	NodeId    string
-	mounter   mounter.Mounter
-	ClientSet *kubernetes.Clientset
-	mutex     sync.Mutex
+	NodeId      string
+	driverName  string
+	mounter     mounter.Mounter
+	ClientSet   kubernetes.Interface
+	volumeLocks *volumeLocks
+	// opSlots bounds the operations running concurrently on the node
+	opSlots  chan struct{}
+	refs     *mountRefs
+	recorder record.EventRecorder
+	runner   clientRunner
+	options  *Options
+	// maxVolumes is the volume limit of the node, see volumeLimit
+	maxVolumes nodeVolumeLimit
+	// preflightChecks are the node requirements, see preflight
+	preflightChecks []preflightCheck
 	csi.UnimplementedNodeServer
 }
 
 var _ csi.NodeServer = (*NodeService)(nil)
 
-func NewNodeService(nodeId string, clientSet *kubernetes.Clientset) *NodeService {
-	return &NodeService{
-		NodeId:    nodeId,
-		mounter:   mounter.NewNodeMounter(),
-		ClientSet: clientSet,
+func NewNodeService(name, nodeId string, clientSet kubernetes.Interface, opts *Options) *NodeService {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
+	n := &NodeService{
+		NodeId:      nodeId,
+		driverName:  name,
+		mounter:     mounter.NewNodeMounter(),
+		ClientSet:   clientSet,
+		refs:        newMountRefs(),
+		volumeLocks: newVolumeLocks(),
+		opSlots:     make(chan struct{}, opts.NodeMaxConcurrentOperations),
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: name, Host: nodeId}),
+		options:     opts,
+
+		preflightChecks: nodePreflightChecks(opts),
+	}
+	n.runner = newClientRunner(nodeId, clientSet, opts, n.clientRestarted)
+	layout.migrateLayout(name)
+	n.refs.rebuild(n.mounter)
+	return n
+}
+
+// preflight checks the node can mount volumes, it returns why not otherwise.
+func (n *NodeService) preflight() error {
+	return runPreflightChecks(n.preflightChecks)
+}
+
+// logPreflight logs the version of the cubefs client and the result of the
+// preflight checks on startup.
+func (n *NodeService) logPreflight(ctx context.Context) {
+	if n.options.MountMode == ProcessMountMode {
+		if version, err := clientVersion(ctx); err != nil {
+			klog.ErrorS(err, "Failed to get the cubefs client version")
+		} else {
+			klog.InfoS("Cubefs client found", "path", layout.clientBin, "version", version)
+		}
+	}
+	if err := n.preflight(); err != nil {
+		klog.ErrorS(err, "Node preflight checks failed, the node will not register until they pass")
+		return
 	}
+	klog.InfoS("Node preflight checks passed")
+}
+
+// Run runs the background work of the node service until ctx is done.
+func (n *NodeService) Run(ctx context.Context) {
+	go n.runEphemeralSweep(ctx)
+	n.runMountChecker(ctx)
+}
+
+// beginOperation starts an operation on a volume, it fails with Aborted while
+// another operation holds the volume and waits for a free slot if too many
+// operations are running on the node. The returned context is bounded by the
+// node operation timeout, done ends the operation.
+func (n *NodeService) beginOperation(ctx context.Context, volumeId string) (context.Context, func(), error) {
+	if !n.volumeLocks.tryAcquire(volumeId) {
+		return nil, nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", volumeId)
+	}
+	cancel := context.CancelFunc(func() {})
+	if n.options.NodeOperationTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, n.options.NodeOperationTimeout)
+	}
+
+	select {
+	case n.opSlots <- struct{}{}:
+	case <-ctx.Done():
+		cancel()
+		n.volumeLocks.release(volumeId)
+		return nil, nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return ctx, func() {
+		<-n.opSlots
+		cancel()
+		n.volumeLocks.release(volumeId)
+	}, nil
+}
+
+// clientsHandler serves the table of the cubefs client processes run by the node.
+func (n *NodeService) clientsHandler() http.Handler {
+	if supervisor, ok := n.runner.(*clientSupervisor); ok {
+		return supervisor
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, fmt.Sprintf("cubefs clients run in mount pods, see pods labeled app=%s", mountPodAppLabel), http.StatusNotFound)
+	})
 }
 
 func (n *NodeService) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	klog.V(4).InfoS("NodeStageVolume: called", "args", request)
+	volumeId := request.GetVolumeId()
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing in request")
+	}
+	stagingTargetPath := request.GetStagingTargetPath()
+	if len(stagingTargetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+	if request.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing in request")
+	}
+	if err := validateVolumeCapability(request.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mountOpts, err := parseMountFlags(request.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	subdir, err := volumeSubdir(request.GetVolumeContext(), mountOpts)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	owner, err := volumeOwnership(request.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ctx, done, err := n.beginOperation(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if err := n.reserveClient(ctx, volumeId); err != nil {
+		return nil, err
+	}
+	defer n.refs.unreserve(volumeId)
+
+	start := time.Now()
+	// the cubefs client mounts the volume to the staging path, pods bind mount it from there
+	if exist, err := n.mounter.PathExists(stagingTargetPath); err != nil {
+		klog.ErrorS(err, "Failed to check staging path", "stagingTargetPath", stagingTargetPath)
+		return nil, status.Error(codes.Internal, err.Error())
+	} else if !exist {
+		klog.InfoS("NodeStageVolume: creating staging path", "stagingTargetPath", stagingTargetPath)
+		if err := n.mounter.MakeDir(stagingTargetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else if isMnt, err := n.mounter.IsMountPoint(stagingTargetPath); err == nil {
+		if isMnt {
+			klog.InfoS("NodeStageVolume: volume already staged", "stagingTargetPath", stagingTargetPath)
+			n.refs.setMount(volumeId, stagingTargetPath)
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+	} else if n.mounter.IsCorruptedMnt(err) {
+		klog.ErrorS(err, "NodeStageVolume: mount point is corrupted", "stagingTargetPath", stagingTargetPath)
+		n.refs.setMount(volumeId, stagingTargetPath)
+		if err := n.recoverVolume(ctx, volumeId, stagingTargetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	} else {
+		klog.ErrorS(err, "Failed to check staging path", "stagingTargetPath", stagingTargetPath)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if isReadOnlyAccessMode(request.GetVolumeCapability()) {
+		mountOpts.clientConf[KReadOnly] = "true"
+	}
+	if err := n.mount(ctx, stagingTargetPath, volumeId, request.GetVolumeContext(), mountOpts); err != nil {
+		return nil, err
+	}
+	n.refs.setMount(volumeId, stagingTargetPath)
+
+	// the ownership is set once when the client mounts, all the pods of the
+	// node share the directory, so publishing must not flip it between them
+	if owner != nil && !isReadOnlyAccessMode(request.GetVolumeCapability()) {
+		if err := applyOwnership(stagingTargetPath, subdir, request.GetVolumeContext()[KCreateSubdir] == "true", owner); err != nil {
+			klog.ErrorS(err, "NodeStageVolume: failed to set volume ownership, unstaging", "volumeId", volumeId, "subdir", subdir)
+			if unstageErr := n.unstage(ctx, volumeId, stagingTargetPath); unstageErr != nil {
+				klog.ErrorS(unstageErr, "Failed to unstage volume", "volumeId", volumeId)
+			}
+			return nil, err
+		}
+	}
+
+	duration := time.Since(start)
+	klog.InfoS("NodeStageVolume success", "volumeId", volumeId, "stagingTargetPath", stagingTargetPath, "cost", duration)
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (n *NodeService) mount(targetPath, volumeName string, param map[string]string) (retErr error) {
+// driverAttributes are the volume attributes the node service applies itself
+// instead of passing them to the cubefs client.
+var driverAttributes = []string{KSubdir, KBaseDir, KCreateSubdir, KOnDelete, KMasterVersion, KUid, KGid, KUmask, KAllowedNamespaces}
+
+func (n *NodeService) mount(ctx context.Context, targetPath, volumeName string, param map[string]string, mountOpts *mountOptions) (retErr error) {
 	defer func() {
 		if retErr != nil {
-			klog.ErrorS(retErr, "targetPath", targetPath)
+			// the runner killed the client, clean up whatever it left behind
+			klog.ErrorS(retErr, "Failed to mount volume, cleaning up", "volumeId", volumeName, "targetPath", targetPath)
+			if err := unmountStale(n.mounter, targetPath); err != nil {
+				klog.ErrorS(err, "Failed to unmount target path", "targetPath", targetPath)
+			}
+			if err := removeClientConf(volumeName); err != nil {
+				klog.ErrorS(err, "Failed to remove client config file", "volumeId", volumeName)
+			}
 			if err := os.Remove(targetPath); err != nil {
 				klog.ErrorS(err, "targetPath remove failed")
 				return
@@ -60,19 +256,57 @@ func (n *NodeService) mount(targetPath, volumeName string, param map[string]stri
 		}
 	}()
 
-	cfsServer, err := NewCfsServer(volumeName, param)
+	// the node config is read on every mount to pick up ConfigMap updates
+	nodeConfig, err := loadNodeClientConfig(n.options.ClientConfigFile)
+	if err != nil {
+		retErr = status.Errorf(codes.FailedPrecondition, "node client config: %v", err)
+		return
+	}
+	// the ports allocated while building the config are reserved until it is persisted
+	defer clientPorts.release(volumeName)
+	data := &clientConfData{
+		VolumeId:   volumeName,
+		VolumeName: getValueWithDefault(param, KVolumeName, volumeName),
+		NodeId:     n.NodeId,
+		MountPoint: targetPath,
+	}
+	if err = nodeConfig.applyDefaults(param, data); err != nil {
+		retErr = status.Errorf(codes.FailedPrecondition, "node client config: %v", err)
+		return
+	}
+
+	// the client config is built from a copy, the caller still needs the driver attributes
+	cfsServer, err := NewCfsServer(volumeName, maps.Clone(param))
 	if err != nil {
 		retErr = status.Errorf(codes.InvalidArgument, "new cfs server failed: %v", err)
 		return
 	}
+	// the mount flags override the volume parameters
+	for key, value := range mountOpts.clientConf {
+		cfsServer.clientConf[key] = value
+	}
+	// the client always mounts the volume root, subdirectories and their
+	// ownership are set up on publish
+	for _, key := range driverAttributes {
+		delete(cfsServer.clientConf, key)
+	}
+	if err = nodeConfig.applyOverrides(cfsServer.clientConf, data); err != nil {
+		retErr = status.Errorf(codes.FailedPrecondition, "node client config: %v", err)
+		return
+	}
+	cfsServer.clientConf[KMountPoint] = targetPath
+	if err = validateClientConf(volumeName, cfsServer.clientConf); err != nil {
+		retErr = status.Errorf(codes.InvalidArgument, "invalid client config: %v", err)
+		return
+	}
 
 	if err := cfsServer.persistClientConf(targetPath); err != nil {
-		retErr = status.Errorf(codes.Internal, "persist client config file failed: %v", err)
+		retErr = toGRPCError(fmt.Errorf("persist client config file failed: %w", err), codes.Internal)
 		return
 	}
 
-	if err := cfsServer.runClient(); err != nil {
-		retErr = status.Errorf(codes.Internal, "mount failed: %v", err)
+	if err := n.runner.start(ctx, volumeName, targetPath); err != nil {
+		retErr = toGRPCError(fmt.Errorf("mount failed: %w", err), codes.Internal)
 		return
 	}
 
@@ -80,97 +314,262 @@ func (n *NodeService) mount(targetPath, volumeName string, param map[string]stri
 }
 
 func (n *NodeService) NodeUnstageVolume(ctx context.Context, request *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	klog.V(4).InfoS("NodeUnstageVolume: called", "args", request)
+	volumeId := request.GetVolumeId()
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing in request")
+	}
+	stagingTargetPath := request.GetStagingTargetPath()
+	if len(stagingTargetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+
+	ctx, done, err := n.beginOperation(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	// pods on this node may still use the shared client mount
+	if targets := n.refs.liveTargets(volumeId); len(targets) > 0 {
+		klog.InfoS("NodeUnstageVolume: volume is still published, keep the client mount",
+			"volumeId", volumeId, "stagingTargetPath", stagingTargetPath, "targets", targets)
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is still published at %v", volumeId, targets)
+	}
+
+	if err := n.unstage(ctx, volumeId, stagingTargetPath); err != nil {
+		return nil, err
+	}
+
+	klog.InfoS("NodeUnstageVolume success", "volumeId", volumeId, "stagingTargetPath", stagingTargetPath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (n *NodeService) NodePublishVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
+// unstage stops the client of a volume and cleans up its staging path and config.
+func (n *NodeService) unstage(ctx context.Context, volumeId, stagingTargetPath string) error {
+	// stop the cubefs client first so it is not restarted, the dead mount is cleaned up below
+	if err := n.runner.stop(ctx, volumeId); err != nil {
+		klog.ErrorS(err, "Failed to stop cubefs client", "volumeId", volumeId)
+		return toGRPCError(err, codes.Internal)
+	}
+	if err := mountutils.CleanupMountPoint(stagingTargetPath, n.mounter, false); err != nil {
+		klog.ErrorS(err, "Failed to unmount staging path", "stagingTargetPath", stagingTargetPath)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := removeClientConf(volumeId); err != nil {
+		klog.ErrorS(err, "Failed to remove client config file", "volumeId", volumeId)
+		return status.Error(codes.Internal, err.Error())
+	}
 
+	n.refs.remove(volumeId)
+	return nil
+}
+
+func (n *NodeService) NodePublishVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	klog.V(4).InfoS("NodePublishVolume: called", "args", request)
 	start := time.Now()
-	// we mount the cubefs volume to /mnt dir firstly and then mount to pods volume path
-	//stagingTargetPath := request.GetStagingTargetPath()
+	if len(request.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing in request")
+	}
+	pod := podInfoOf(request.GetVolumeContext())
+	if err := checkNamespaceAllowed(request.GetVolumeContext(), pod, n.options.EphemeralAllowedNamespaces); err != nil {
+		klog.ErrorS(err, "NodePublishVolume: pod may not mount the volume", pod.keysAndValues("volumeId", request.GetVolumeId())...)
+		if ref := pod.objectRef(); ref != nil && status.Code(err) == codes.PermissionDenied {
+			n.recorder.Event(ref, corev1.EventTypeWarning, eventReasonNamespaceNotAllowed, status.Convert(err).Message())
+		}
+		return nil, err
+	}
+	// inline volumes are not staged, they are created and mounted here
+	if isEphemeral(request.GetVolumeContext()) {
+		return n.publishEphemeral(ctx, request, pod)
+	}
+	stagingTargetPath := request.GetStagingTargetPath()
+	if len(stagingTargetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
 	targetPath := request.GetTargetPath()
-	klog.V(10).InfoS("NodePublishVolume", "targetPath", targetPath)
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "target path missing in request")
+	}
+	if request.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing in request")
+	}
+	if err := validateVolumeCapability(request.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mountOpts, err := parseMountFlags(request.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	subdir, err := volumeSubdir(request.GetVolumeContext(), mountOpts)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	readOnly := request.GetReadonly() || isReadOnlyAccessMode(request.GetVolumeCapability())
+	klog.V(10).InfoS("NodePublishVolume", pod.keysAndValues("stagingTargetPath", stagingTargetPath, "targetPath", targetPath, "subdir", subdir)...)
+	// mount-utils remounts the bind mount to make ro and the other flags stick
+	options := append([]string{"bind"}, mountOpts.bindFlags...)
+	if readOnly && !slices.Contains(options, "ro") {
+		options = append(options, "ro")
+	}
+	ctx, done, err := n.beginOperation(ctx, request.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 
-	// 1. mount the cubefs volume to /mnt dir
-	mntDir := filepath.Join("/mnt", request.GetVolumeId())
-	if exist, err := n.mounter.PathExists(mntDir); err != nil {
-		klog.ErrorS(err, "Failed to check /mnt path", "mntPath", mntDir)
-		return nil, status.Error(codes.Internal, err.Error())
-	} else if !exist { // make new mnt dir
-		klog.InfoS("NodePublishVolume: creating mnt path", "mntDir", mntDir)
-		if err := n.mounter.MakeDir(mntDir); err != nil {
+	// the volume is mounted to the staging path by NodeStageVolume, only bind mount it here
+	if isMnt, err := n.mounter.IsMountPoint(stagingTargetPath); err != nil && n.mounter.IsCorruptedMnt(err) {
+		klog.ErrorS(err, "NodePublishVolume: staging mount point is corrupted", pod.keysAndValues("stagingTargetPath", stagingTargetPath)...)
+		n.refs.setMount(request.GetVolumeId(), stagingTargetPath)
+		if err := n.recoverVolume(ctx, request.GetVolumeId(), stagingTargetPath); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
-	} else if isMnt, err := n.mounter.IsMountPoint(mntDir); err == nil {
-		if isMnt {
-			klog.InfoS("NodePublishVolume: volume already mounted", "mntDir", mntDir)
-		} else {
-			klog.InfoS("NodePublishVolume: mount dir is already exist, but is not mount point, skip create it", "mntPath", mntDir)
-		}
-	} else if n.mounter.IsCorruptedMnt(err) {
-		// TODO: remount mntDir mount point as corrupted
-		klog.ErrorS(err, "NodePublishVolume: mount point is corrupted", "mntDir", mntDir)
-		return nil, err
+	} else if err != nil {
+		klog.ErrorS(err, "Failed to check staging path", pod.keysAndValues("stagingTargetPath", stagingTargetPath)...)
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if !isMnt {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not staged at %s", request.GetVolumeId(), stagingTargetPath)
 	}
 
-	if err := n.mount(mntDir, request.GetVolumeId(), request.GetVolumeContext()); err != nil {
-		return nil, err
+	// the client mounts the volume root, the pod only sees its subdir
+	bind := bindMount{source: stagingTargetPath, options: options, pod: pod}
+	if subdir != "" {
+		if bind.source, err = ensureSubdir(stagingTargetPath, subdir, request.GetVolumeContext()[KCreateSubdir] == "true"); err != nil {
+			klog.ErrorS(err, "NodePublishVolume: invalid subdir", pod.keysAndValues("volumeId", request.GetVolumeId(), "subdir", subdir)...)
+			return nil, err
+		}
 	}
-
 	if exist, err := n.mounter.PathExists(targetPath); err != nil {
-		klog.ErrorS(err, "Failed to check target path", "targetPath", targetPath)
+		klog.ErrorS(err, "Failed to check target path", pod.keysAndValues("targetPath", targetPath)...)
 		return nil, status.Error(codes.Internal, err.Error())
 	} else if exist {
-		klog.V(4).InfoS("Target path already exists", "targetPath", targetPath)
+		klog.V(4).InfoS("Target path already exists", pod.keysAndValues("targetPath", targetPath)...)
 		isNotMountPoint, err := n.mounter.IsLikelyNotMountPoint(targetPath)
+		if err != nil && n.mounter.IsCorruptedMnt(err) {
+			// a stale bind mount of a client which has been restarted since
+			klog.ErrorS(err, "NodePublishVolume: target mount point is corrupted", pod.keysAndValues("targetPath", targetPath)...)
+			if err := n.rebindTarget(targetPath, bind); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			n.refs.addTarget(request.GetVolumeId(), stagingTargetPath, targetPath, bind)
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
 		if err != nil {
-			klog.ErrorS(err, "Failed to check target path", "targetPath", targetPath)
+			klog.ErrorS(err, "Failed to check target path", pod.keysAndValues("targetPath", targetPath)...)
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 		if !isNotMountPoint {
-			klog.V(4).InfoS("Target path is a mount point, skip", "targetPath", targetPath)
+			klog.V(4).InfoS("Target path is a mount point, skip", pod.keysAndValues("targetPath", targetPath)...)
+			n.refs.addTarget(request.GetVolumeId(), stagingTargetPath, targetPath, bind)
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
 	} else {
 		if err := n.mounter.MakeDir(targetPath); err != nil {
-			klog.ErrorS(err, "Failed to create target path", "targetPath", targetPath)
+			klog.ErrorS(err, "Failed to create target path", pod.keysAndValues("targetPath", targetPath)...)
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
-	if err := n.mounter.Mount(mntDir, targetPath, "", []string{"bind"}); err != nil {
-		klog.ErrorS(err, "Failed to bind mount mnt path to target path", "mntPath", mntDir, "targetPath", targetPath)
+	if err := n.mounter.Mount(bind.source, targetPath, "", options); err != nil {
+		klog.ErrorS(err, "Failed to bind mount staging path to target path", pod.keysAndValues("source", bind.source, "targetPath", targetPath)...)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	n.refs.addTarget(request.GetVolumeId(), stagingTargetPath, targetPath, bind)
 
 	duration := time.Since(start)
-	klog.InfoS("NodePublishVolume success", "mntPath", mntDir, "targetPath", targetPath, "cost", duration)
+	klog.InfoS("NodePublishVolume success", pod.keysAndValues("source", bind.source, "targetPath", targetPath, "options", options, "cost", duration)...)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 func (n *NodeService) NodeUnpublishVolume(ctx context.Context, request *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-
 	klog.V(10).InfoS("NodeUnpublishVolume", "targetPath", request.GetTargetPath())
+	if len(request.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing in request")
+	}
+	if len(request.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "target path missing in request")
+	}
+	ctx, done, err := n.beginOperation(ctx, request.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	pod := n.refs.targetBind(request.GetVolumeId(), request.GetTargetPath()).pod
+
+	// the cubefs client keeps serving the staging path until NodeUnstageVolume
 	if err := mountutils.CleanupMountPoint(request.GetTargetPath(), n.mounter, false); err != nil {
-		klog.ErrorS(err, "Failed to unmount target path", "targetPath", request.GetTargetPath())
+		klog.ErrorS(err, "Failed to unmount target path", pod.keysAndValues("targetPath", request.GetTargetPath())...)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	err := mountutils.CleanupMountPoint(filepath.Join("/mnt", request.GetVolumeId()), n.mounter, false)
+	remaining := n.refs.removeTarget(request.GetVolumeId(), request.GetTargetPath())
+
+	// inline volumes live as long as their pod
+	vol, err := loadEphemeral(request.GetVolumeId())
 	if err != nil {
-		klog.ErrorS(err, "Failed to unmount mnt path", "mntDir", filepath.Join("/mnt", request.GetVolumeId()))
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if vol != nil {
+		if err := n.deleteEphemeral(ctx, vol); err != nil {
+			klog.ErrorS(err, "Failed to delete ephemeral volume", pod.keysAndValues("volumeId", request.GetVolumeId())...)
+			return nil, toGRPCError(err, codes.Internal)
+		}
+	}
+	klog.InfoS("NodeUnpublishVolume success", pod.keysAndValues("volumeId", request.GetVolumeId(),
+		"targetPath", request.GetTargetPath(), "remainingTargets", remaining)...)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (n *NodeService) NodeGetVolumeStats(ctx context.Context, request *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return &csi.NodeGetVolumeStatsResponse{}, nil
+	klog.V(4).InfoS("NodeGetVolumeStats: called", "args", request)
+	if len(request.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing in request")
+	}
+	volumePath := request.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+
+	stats, err := statfs(ctx, volumePath, volumeStatsTimeout)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volumePath)
+		}
+		if !errors.Is(err, errStatfsTimeout) && !n.mounter.IsCorruptedMnt(err) {
+			klog.ErrorS(err, "Failed to get volume stats", "volumePath", volumePath)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		// a hung or disconnected client is a volume condition, not an RPC failure
+		klog.ErrorS(err, "Volume is abnormal", "volumeId", request.GetVolumeId(), "volumePath", volumePath)
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("cubefs mount is not responding: %v", err),
+			},
+		}, nil
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     stats.totalBytes,
+				Available: stats.availableBytes,
+				Used:      stats.usedBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     stats.totalInodes,
+				Available: stats.freeInodes,
+				Used:      stats.usedInodes,
+			},
+		},
+		VolumeCondition: &csi.VolumeCondition{
+			Abnormal: false,
+			Message:  "volume is healthy",
+		},
+	}, nil
 }
 
 func (n *NodeService) NodeExpandVolume(ctx context.Context, request *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -195,7 +594,16 @@ func (n *NodeService) NodeGetCapabilities(ctx context.Context, request *csi.Node
 
 func (n *NodeService) NodeGetInfo(ctx context.Context, request *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	klog.V(4).InfoS("NodeGetInfo: called", "args", request)
+	// kubelet registers the node with the driver once NodeGetInfo succeeds
+	if err := n.preflight(); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "node preflight checks failed: %v", err)
+	}
+	maxVolumes, err := n.volumeLimit(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "compute the volume limit of the node: %v", err)
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId: n.NodeId,
+		NodeId:            n.NodeId,
+		MaxVolumesPerNode: maxVolumes,
 	}, nil
 }
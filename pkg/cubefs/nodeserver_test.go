@@ -0,0 +1,170 @@
+package cubefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// newTestNodeService returns a node service mounting with fakes in the test layout.
+func newTestNodeService(t *testing.T) (*NodeService, *fakeMounter, *fakeRunner) {
+	t.Helper()
+	useTestLayout(t)
+	m := &fakeMounter{mountPoints: make(map[string]error)}
+	runner := &fakeRunner{mounter: m}
+	n := &NodeService{
+		NodeId:      "node-1",
+		driverName:  DriverName,
+		mounter:     m,
+		ClientSet:   fake.NewSimpleClientset(),
+		volumeLocks: newVolumeLocks(),
+		opSlots:     make(chan struct{}, 4),
+		refs:        newMountRefs(),
+		recorder:    record.NewFakeRecorder(10),
+		runner:      runner,
+		options:     &Options{},
+	}
+	return n, m, runner
+}
+
+func TestNodeStagePublishLifecycle(t *testing.T) {
+	ctx := context.Background()
+	n, m, runner := newTestNodeService(t)
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "globalmount")
+	target1 := filepath.Join(dir, "pods", "uid-1", "volumes", "kubernetes.io~csi", "pvc-a", "mount")
+	target2 := filepath.Join(dir, "pods", "uid-2", "volumes", "kubernetes.io~csi", "pvc-a", "mount")
+	volumeContext := map[string]string{KMasterAddr: "127.0.0.1:17010", KVolumeName: "pvc-a", KOwner: "csi"}
+	capability := mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+
+	stageReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-a",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  capability,
+		VolumeContext:     volumeContext,
+	}
+	if _, err := n.NodeStageVolume(ctx, stageReq); err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	if _, err := os.Stat(clientConfFilePath("pvc-a")); err != nil {
+		t.Errorf("client config not persisted: %v", err)
+	}
+	// staging again finds the client mount
+	if _, err := n.NodeStageVolume(ctx, stageReq); err != nil {
+		t.Fatalf("NodeStageVolume again: %v", err)
+	}
+	if !reflect.DeepEqual(runner.started, []string{"pvc-a"}) {
+		t.Fatalf("started clients = %v, want one client for pvc-a", runner.started)
+	}
+
+	for _, target := range []string{target1, target2} {
+		_, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          "pvc-a",
+			StagingTargetPath: stagingPath,
+			TargetPath:        target,
+			VolumeCapability:  capability,
+			VolumeContext:     volumeContext,
+		})
+		if err != nil {
+			t.Fatalf("NodePublishVolume(%s): %v", target, err)
+		}
+	}
+	wantMounts := []string{stagingPath + " " + target1, stagingPath + " " + target2}
+	if !reflect.DeepEqual(m.mounts, wantMounts) {
+		t.Errorf("bind mounts = %v, want %v", m.mounts, wantMounts)
+	}
+
+	unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: "pvc-a", StagingTargetPath: stagingPath}
+	useTestMountInfo(t, "40 20 0:60 / "+target2+" rw,relatime - fuse.cubefs cubefs rw\n")
+	if _, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-a", TargetPath: target1}); err != nil {
+		t.Fatalf("NodeUnpublishVolume: %v", err)
+	}
+	if _, err := n.NodeUnstageVolume(ctx, unstageReq); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("NodeUnstageVolume while published: err = %v, want FailedPrecondition", err)
+	}
+	if len(runner.stopped) != 0 {
+		t.Fatalf("stopped clients = %v, want the shared client kept", runner.stopped)
+	}
+
+	if _, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-a", TargetPath: target2}); err != nil {
+		t.Fatalf("NodeUnpublishVolume: %v", err)
+	}
+	if _, err := n.NodeUnstageVolume(ctx, unstageReq); err != nil {
+		t.Fatalf("NodeUnstageVolume: %v", err)
+	}
+	if !reflect.DeepEqual(runner.stopped, []string{"pvc-a"}) {
+		t.Errorf("stopped clients = %v, want pvc-a", runner.stopped)
+	}
+	for _, path := range []string{stagingPath, target1, target2, clientConfFilePath("pvc-a")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+	if got := n.refs.mountPaths(); len(got) != 0 {
+		t.Errorf("mount references = %v, want none", got)
+	}
+}
+
+func TestNodePublishVolumeNotStaged(t *testing.T) {
+	n, _, _ := newTestNodeService(t)
+	dir := t.TempDir()
+	_, err := n.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "pvc-a",
+		StagingTargetPath: dir,
+		TargetPath:        filepath.Join(dir, "target"),
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("NodePublishVolume() of an unstaged volume err = %v, want FailedPrecondition", err)
+	}
+}
+
+func TestNodeStageVolumeBusy(t *testing.T) {
+	n, _, _ := newTestNodeService(t)
+	n.volumeLocks.tryAcquire("pvc-a")
+	_, err := n.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-a",
+		StagingTargetPath: t.TempDir(),
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:     map[string]string{KMasterAddr: "127.0.0.1:17010"},
+	})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("NodeStageVolume() of a busy volume err = %v, want Aborted", err)
+	}
+}
+
+func TestNodeStageVolumeCleansUpFailedMount(t *testing.T) {
+	n, _, runner := newTestNodeService(t)
+	runner.startErr = status.Error(codes.DeadlineExceeded, "volume not mounted")
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+
+	_, err := n.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-a",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:     map[string]string{KMasterAddr: "127.0.0.1:17010"},
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("NodeStageVolume() = %v, want the DeadlineExceeded of the runner", err)
+	}
+	for _, path := range []string{stagingPath, clientConfFilePath("pvc-a")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after the failed mount: %v", path, err)
+		}
+	}
+	if got := n.refs.mountPaths(); len(got) != 0 {
+		t.Errorf("mount references = %v, want none", got)
+	}
+	// the volume counts no more against the node limit
+	if len(n.refs.reserved) != 0 {
+		t.Errorf("reserved volumes = %v, want none", n.refs.reserved)
+	}
+}
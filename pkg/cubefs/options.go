@@ -1,5 +1,7 @@
 package cubefs
 
+import "time"
+
 // Mode is the operating mode of the CSI driver.
 type Mode string
 
@@ -23,4 +25,73 @@ type Options struct {
 	Endpoint string
 	// HttpEndpoint is the TCP network address where the HTTP server for metrics will listen
 	HttpEndpoint string
+
+	// MasterLimits throttles the requests sent to the masters of each CubeFS cluster.
+	MasterLimits MasterLimits
+
+	// VolumeReadyTimeout is how long CreateVolume waits for a new volume to become writable,
+	// zero disables the wait.
+	VolumeReadyTimeout time.Duration
+	// MinWritableDataPartitions is the number of writable data partitions a volume needs to be ready.
+	MinWritableDataPartitions int
+
+	// MountCheckInterval is how often the node service looks for corrupted client mounts to recover,
+	// zero disables the check.
+	MountCheckInterval time.Duration
+
+	// MountMode is where the node runs the cubefs clients.
+	MountMode MountMode
+	// MountPodImage is the image of the mount pods, it must contain the cubefs client at CfsClientBin.
+	MountPodImage string
+	// MountPodNamespace is the namespace the mount pods are created in.
+	MountPodNamespace string
+	// MountPodTimeout is how long NodeStageVolume waits for a mount pod to mount the volume.
+	MountPodTimeout time.Duration
+
+	// NodeMaxConcurrentOperations bounds the volume operations running concurrently on the node.
+	NodeMaxConcurrentOperations int
+	// NodeOperationTimeout bounds every volume operation on the node on top of the deadline set by
+	// the caller, zero only keeps the caller's deadline.
+	NodeOperationTimeout time.Duration
+
+	// NodeMaxVolumes is the most volumes the node stages, zero is no limit.
+	NodeMaxVolumes int64
+	// ClientMemoryEstimate is the memory a cubefs client is estimated to use as a resource
+	// quantity, if set the node stages no more volumes than its allocatable memory allows.
+	ClientMemoryEstimate string
+
+	// ClientConfigFile is the node-level cubefs client configuration, none if empty.
+	ClientConfigFile string
+
+	// ClientBin is the cubefs client the node runs in the process mount mode.
+	ClientBin string
+	// ClientConfDir and ClientLogDir hold the client configs and logs of the node, below a
+	// directory named after the driver.
+	ClientConfDir string
+	ClientLogDir  string
+	// ClientLogHostDir is ClientLogDir on the host, where the mount pods write
+	// their client logs. It defaults to ClientLogDir.
+	ClientLogHostDir string
+	// KubeletDir is the root directory of kubelet.
+	KubeletDir string
+
+	// ShutdownGracePeriod is how long the driver lets the operations in flight finish on SIGTERM.
+	ShutdownGracePeriod time.Duration
+
+	// EphemeralMaxSizeGB is the largest ephemeral inline volume the node creates, zero disables them.
+	EphemeralMaxSizeGB int64
+	// EphemeralMasterAddr is the CubeFS cluster of the ephemeral inline volumes, empty disables them.
+	EphemeralMasterAddr string
+	// EphemeralOwner is the owner of the ephemeral inline volumes, every created volume gets its own
+	// if empty.
+	EphemeralOwner string
+	// EphemeralMasterVersion is the master version of the cluster of the ephemeral inline volumes,
+	// needed when its masters do not report it.
+	EphemeralMasterVersion string
+	// EphemeralAllowedNamespaces are the namespaces whose pods may use ephemeral inline volumes,
+	// all if empty.
+	EphemeralAllowedNamespaces []string
+	// EphemeralSweepInterval is how often the node deletes the inline volumes of pods which are gone,
+	// zero only sweeps on startup.
+	EphemeralSweepInterval time.Duration
 }
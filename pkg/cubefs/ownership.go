@@ -0,0 +1,115 @@
+package cubefs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// Volume attributes setting the owner and mode of the directory a PV exposes,
+// they are applied by the node service and not passed to the cubefs client.
+const (
+	KUid   = "uid"
+	KGid   = "gid"
+	KUmask = "umask"
+)
+
+// rootOwnership is the owner and mode the exposed directory of a volume gets
+// when it is staged, -1 and 0 leave the current value. The pod's fsGroup is
+// not part of it: the cubefs client cannot map the owner of files, so kubelet
+// applies the fsGroup of every pod itself.
+type rootOwnership struct {
+	uid  int
+	gid  int
+	mode os.FileMode
+}
+
+// volumeOwnership returns the ownership of a volume from its attributes, nil
+// if nothing is set.
+func volumeOwnership(volumeContext map[string]string) (*rootOwnership, error) {
+	owner := &rootOwnership{uid: -1, gid: -1}
+	var err error
+	if owner.uid, err = parseID(volumeContext, KUid); err != nil {
+		return nil, err
+	}
+	if owner.gid, err = parseID(volumeContext, KGid); err != nil {
+		return nil, err
+	}
+	if umask := volumeContext[KUmask]; umask != "" {
+		mask, err := strconv.ParseUint(umask, 8, 32)
+		if err != nil || mask > 0777 {
+			return nil, fmt.Errorf("invalid %s %q, must be an octal mask like 022", KUmask, umask)
+		}
+		owner.mode = os.ModeDir | 0777&^os.FileMode(mask)
+	}
+	if owner.uid == -1 && owner.gid == -1 && owner.mode == 0 {
+		return nil, nil
+	}
+	return owner, nil
+}
+
+func parseID(volumeContext map[string]string, key string) (int, error) {
+	value := volumeContext[key]
+	if value == "" {
+		return -1, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return -1, fmt.Errorf("invalid %s %q, must be a number", key, value)
+	}
+	return int(id), nil
+}
+
+// applyOwnership sets the ownership of the directory a volume exposes, the
+// volume root or subdir in the client mount at mountPath.
+func applyOwnership(mountPath, subdir string, createSubdir bool, owner *rootOwnership) error {
+	dir := mountPath
+	if subdir != "" {
+		var err error
+		if dir, err = ensureSubdir(mountPath, subdir, createSubdir); err != nil {
+			return err
+		}
+	}
+	if err := owner.apply(dir); err != nil {
+		return status.Errorf(codes.Internal, "set ownership of %s: %v", dir, err)
+	}
+	return nil
+}
+
+// apply sets the owner and mode of dir, only touching what differs.
+func (o *rootOwnership) apply(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("no owner of %s", dir)
+	}
+	if (o.uid != -1 && uint32(o.uid) != stat.Uid) || (o.gid != -1 && uint32(o.gid) != stat.Gid) {
+		if err = os.Chown(dir, o.uid, o.gid); err != nil {
+			return err
+		}
+		// chown may clear the setgid bit
+		if info, err = os.Stat(dir); err != nil {
+			return err
+		}
+	}
+
+	mode := info.Mode()
+	if o.mode != 0 {
+		mode = o.mode | mode&os.ModeSetgid
+	}
+	if mode != info.Mode() {
+		if err = os.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+	klog.V(4).InfoS("Applied volume ownership", "dir", dir, "uid", o.uid, "gid", o.gid, "mode", mode)
+	return nil
+}
@@ -0,0 +1,105 @@
+package cubefs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeOwnership(t *testing.T) {
+	tests := []struct {
+		name    string
+		attrs   map[string]string
+		want    *rootOwnership
+		wantErr bool
+	}{
+		{"nothing", map[string]string{}, nil, false},
+		{"uid", map[string]string{KUid: "1000"}, &rootOwnership{uid: 1000, gid: -1}, false},
+		{"gid and umask", map[string]string{KGid: "2000", KUmask: "022"}, &rootOwnership{uid: -1, gid: 2000, mode: os.ModeDir | 0755}, false},
+		{"bad uid", map[string]string{KUid: "root"}, nil, true},
+		{"negative gid", map[string]string{KGid: "-1"}, nil, true},
+		{"bad umask", map[string]string{KUmask: "999"}, nil, true},
+		{"umask too large", map[string]string{KUmask: "1777"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := volumeOwnership(tt.attrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("volumeOwnership() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Fatalf("volumeOwnership() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func statOwner(t *testing.T, dir string) (uint32, uint32, os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	return stat.Uid, stat.Gid, info.Mode()
+}
+
+func TestRootOwnershipApply(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown needs root")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0755|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := &rootOwnership{uid: 1000, gid: 3000}
+	if err := owner.apply(dir); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid, _ := statOwner(t, dir); uid != 1000 || gid != 3000 {
+		t.Errorf("owner = %d:%d, want 1000:3000", uid, gid)
+	}
+
+	// a umask keeps the setgid bit set by the admin
+	owner = &rootOwnership{uid: -1, gid: -1, mode: os.ModeDir | 0750}
+	if err := owner.apply(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, mode := statOwner(t, dir); mode&os.ModeSetgid == 0 || mode.Perm() != 0750 {
+		t.Errorf("mode = %v, want 0750 with setgid", mode)
+	}
+}
+
+func TestApplyOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown needs root")
+	}
+	mountPath := t.TempDir()
+	owner := &rootOwnership{uid: -1, gid: 3000}
+
+	if err := applyOwnership(mountPath, "data/team-a", false, owner); status.Code(err) != codes.NotFound {
+		t.Fatalf("applyOwnership() on a missing subdir: err = %v, want NotFound", err)
+	}
+	if err := applyOwnership(mountPath, "data/team-a", true, owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, gid, _ := statOwner(t, filepath.Join(mountPath, "data", "team-a")); gid != 3000 {
+		t.Errorf("subdir gid = %d, want 3000", gid)
+	}
+	// only the exposed directory gets the ownership
+	if _, gid, _ := statOwner(t, mountPath); gid == 3000 {
+		t.Error("the volume root got the ownership of the subdir")
+	}
+
+	if err := os.Symlink("/etc", filepath.Join(mountPath, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyOwnership(mountPath, "escape", true, owner); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("applyOwnership() through a symlink: err = %v, want InvalidArgument", err)
+	}
+}
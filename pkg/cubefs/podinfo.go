@@ -0,0 +1,139 @@
+package cubefs
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// Volume context keys set by kubelet when the CSIDriver has podInfoOnMount
+const (
+	podNameContextKey            = "csi.storage.k8s.io/pod.name"
+	podNamespaceContextKey       = "csi.storage.k8s.io/pod.namespace"
+	podUIDContextKey             = "csi.storage.k8s.io/pod.uid"
+	serviceAccountNameContextKey = "csi.storage.k8s.io/serviceAccount.name"
+)
+
+// KAllowedNamespaces is a volume attribute listing the namespaces whose pods
+// may mount the volume, comma separated. Any namespace may if it is empty.
+const KAllowedNamespaces = "allowedNamespaces"
+
+// Client config labels of the pod a client serves alone, i.e. of ephemeral volumes
+const (
+	KPodName        = "podName"
+	KPodNamespace   = "podNamespace"
+	KServiceAccount = "serviceAccount"
+)
+
+// Reasons of the events recorded on pods by NodePublishVolume
+const (
+	eventReasonNamespaceNotAllowed = "CubeFSNamespaceNotAllowed"
+)
+
+// podInfo is the pod a volume is published to.
+type podInfo struct {
+	name           string
+	namespace      string
+	uid            string
+	serviceAccount string
+}
+
+func podInfoOf(volumeContext map[string]string) podInfo {
+	return podInfo{
+		name:           volumeContext[podNameContextKey],
+		namespace:      volumeContext[podNamespaceContextKey],
+		uid:            volumeContext[podUIDContextKey],
+		serviceAccount: volumeContext[serviceAccountNameContextKey],
+	}
+}
+
+// podInfoOfTarget returns what the target path tells of its pod, the UID.
+func podInfoOfTarget(target string) podInfo {
+	if match := podUIDInTargetPath.FindStringSubmatch(target); match != nil {
+		return podInfo{uid: match[1]}
+	}
+	return podInfo{}
+}
+
+// keysAndValues prepends the pod to the key/value pairs of a log line.
+func (p podInfo) keysAndValues(kv ...any) []any {
+	switch {
+	case p.name != "":
+		return append([]any{"pod", klog.KRef(p.namespace, p.name), "serviceAccount", p.serviceAccount}, kv...)
+	case p.uid != "":
+		return append([]any{"podUID", p.uid}, kv...)
+	}
+	return kv
+}
+
+// objectRef refers to the pod for events, nil if kubelet passed no pod info.
+func (p podInfo) objectRef() *corev1.ObjectReference {
+	if p.name == "" {
+		return nil
+	}
+	return &corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: p.namespace, Name: p.name, UID: types.UID(p.uid)}
+}
+
+// labelClientConf records the pod in the config of a client serving it alone.
+func (p podInfo) labelClientConf(conf map[string]string) {
+	if p.name == "" {
+		return
+	}
+	conf[KPodName] = p.name
+	conf[KPodNamespace] = p.namespace
+	conf[KServiceAccount] = p.serviceAccount
+}
+
+// parseAllowedNamespaces returns the namespaces allowed to mount a volume, nil for all.
+func parseAllowedNamespaces(volumeContext map[string]string) ([]string, error) {
+	return parseNamespaces(KAllowedNamespaces, strings.Split(volumeContext[KAllowedNamespaces], ","))
+}
+
+// parseNamespaces validates the namespaces of the setting named what, empty
+// entries are skipped.
+func parseNamespaces(what string, list []string) ([]string, error) {
+	var namespaces []string
+	for _, ns := range list {
+		if ns = strings.TrimSpace(ns); ns == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace %q in %s: %s", ns, what, strings.Join(errs, ", "))
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces, nil
+}
+
+// checkNamespaceAllowed fails with PermissionDenied if the volume restricts
+// the namespaces it can be mounted in and the pod is not in one of them. The
+// attributes of an inline volume come from the pod spec, so they cannot
+// restrict it, the namespaces of the node policy ephemeralNamespaces do.
+func checkNamespaceAllowed(volumeContext map[string]string, pod podInfo, ephemeralNamespaces []string) error {
+	allowed := ephemeralNamespaces
+	if !isEphemeral(volumeContext) {
+		var err error
+		if allowed, err = parseAllowedNamespaces(volumeContext); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	if pod.namespace == "" {
+		return status.Errorf(codes.FailedPrecondition, "the volume is restricted to namespaces %v but kubelet passed no pod info, "+
+			"set podInfoOnMount on the CSIDriver", allowed)
+	}
+	for _, ns := range allowed {
+		if ns == pod.namespace {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "pods of namespace %s may not mount the volume, allowed namespaces: %v", pod.namespace, allowed)
+}
@@ -0,0 +1,69 @@
+package cubefs
+
+import (
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseAllowedNamespaces(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"team-a", []string{"team-a"}, false},
+		{" team-a , team-b,,", []string{"team-a", "team-b"}, false},
+		{"Team-A", nil, true},
+		{"team_a", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAllowedNamespaces(map[string]string{KAllowedNamespaces: tt.value})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAllowedNamespaces(%q) err = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseAllowedNamespaces(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCheckNamespaceAllowed(t *testing.T) {
+	teamA := podInfo{name: "web-0", namespace: "team-a"}
+	teamB := podInfo{name: "web-0", namespace: "team-b"}
+	restricted := map[string]string{KAllowedNamespaces: "team-a"}
+	inline := map[string]string{ephemeralContextKey: "true"}
+	// the pod spec cannot widen or narrow the access of an inline volume
+	inlineRestricted := map[string]string{ephemeralContextKey: "true", KAllowedNamespaces: "team-b"}
+
+	tests := []struct {
+		name                string
+		volumeContext       map[string]string
+		pod                 podInfo
+		ephemeralNamespaces []string
+		want                codes.Code
+	}{
+		{"unrestricted", map[string]string{}, teamB, nil, codes.OK},
+		{"allowed namespace", restricted, teamA, nil, codes.OK},
+		{"other namespace", restricted, teamB, nil, codes.PermissionDenied},
+		{"no pod info", restricted, podInfo{}, nil, codes.FailedPrecondition},
+		{"invalid attribute", map[string]string{KAllowedNamespaces: "Team-A"}, teamA, nil, codes.InvalidArgument},
+		{"node policy ignored for PVs", map[string]string{}, teamB, []string{"team-a"}, codes.OK},
+		{"inline without policy", inline, teamB, nil, codes.OK},
+		{"inline allowed by policy", inline, teamA, []string{"team-a"}, codes.OK},
+		{"inline refused by policy", inline, teamB, []string{"team-a"}, codes.PermissionDenied},
+		{"inline attribute ignored", inlineRestricted, teamA, nil, codes.OK},
+		{"inline attribute cannot allow", inlineRestricted, teamB, []string{"team-a"}, codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkNamespaceAllowed(tt.volumeContext, tt.pod, tt.ephemeralNamespaces)
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("checkNamespaceAllowed() code = %v, want %v (err %v)", got, tt.want, err)
+			}
+		})
+	}
+}
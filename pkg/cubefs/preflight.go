@@ -0,0 +1,156 @@
+package cubefs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	mountutils "k8s.io/mount-utils"
+)
+
+const (
+	devFusePath = "/dev/fuse"
+
+	clientVersionTimeout = 10 * time.Second
+)
+
+// procFilesystemsPath lists the file systems of the kernel, tests point it at a file of their own.
+var procFilesystemsPath = "/proc/filesystems"
+
+// preflightCheck is a requirement of the node service checked on startup, by
+// Probe and by NodeGetInfo. The node does not register while a mandatory
+// check fails, the others are only reported.
+type preflightCheck struct {
+	name      string
+	mandatory bool
+	check     func() error
+}
+
+// nodePreflightChecks returns the checks of the node. The mount pods bring
+// their own client and device, so only the process mode needs them in the
+// driver container.
+func nodePreflightChecks(opts *Options) []preflightCheck {
+	processMode := opts.MountMode == ProcessMountMode
+	return []preflightCheck{
+		{name: "fuse module", mandatory: true, check: checkFuseFilesystem},
+		{name: "fuse device", mandatory: processMode, check: checkFuseDevice},
+		{name: "cfs-client", mandatory: processMode, check: checkClientBinary},
+		{name: "kubelet pods propagation", mandatory: true, check: func() error { return checkSharedMount(layout.kubeletPodsDir()) }},
+		{name: "staging propagation", mandatory: true, check: func() error { return checkSharedMount(layout.kubeletCSIPluginDir()) }},
+	}
+}
+
+// runPreflightChecks runs the checks and returns why the mandatory ones
+// failed, nil if the node is ready. Failed checks are logged.
+func runPreflightChecks(checks []preflightCheck) error {
+	var errs []error
+	for _, c := range checks {
+		err := c.check()
+		if err == nil {
+			continue
+		}
+		if c.mandatory {
+			klog.ErrorS(err, "Node preflight check failed", "check", c.name)
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		} else {
+			klog.InfoS("Node preflight check failed, ignoring it", "check", c.name, "err", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkFuseDevice() error {
+	info, err := os.Stat(devFusePath)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s is not a character device", devFusePath)
+	}
+	return nil
+}
+
+// checkFuseFilesystem checks the kernel supports fuse, which it lists in
+// /proc/filesystems once the module is loaded.
+func checkFuseFilesystem() error {
+	f, err := os.Open(procFilesystemsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// lines look like "nodev	fuse"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "fuse" {
+			return nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("fuse is not in %s, load the fuse kernel module", procFilesystemsPath)
+}
+
+func checkClientBinary() error {
+	info, err := os.Stat(layout.clientBin)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", layout.clientBin)
+	}
+	if err = unix.Access(layout.clientBin, unix.X_OK); err != nil {
+		return fmt.Errorf("%s is not executable: %w", layout.clientBin, err)
+	}
+	return nil
+}
+
+// checkSharedMount checks the mounts made below dir propagate to the host,
+// i.e. the mount holding dir is shared, which the Bidirectional propagation
+// of the DaemonSet volumes does.
+func checkSharedMount(dir string) error {
+	mountInfos, err := mountutils.ParseMountInfo(procMountInfoPath)
+	if err != nil {
+		return err
+	}
+	dir = filepath.Clean(dir)
+	var holder *mountutils.MountInfo
+	for i, info := range mountInfos {
+		if dir != info.MountPoint && !strings.HasPrefix(dir, strings.TrimSuffix(info.MountPoint, "/")+"/") {
+			continue
+		}
+		// the last mount of the longest mount point wins, it hides the others
+		if holder == nil || len(info.MountPoint) >= len(holder.MountPoint) {
+			holder = &mountInfos[i]
+		}
+	}
+	if holder == nil {
+		return fmt.Errorf("no mount holds %s", dir)
+	}
+	for _, field := range holder.OptionalFields {
+		if strings.HasPrefix(field, "shared:") {
+			return nil
+		}
+	}
+	return fmt.Errorf("mount %s holding %s is not shared, mount it with Bidirectional propagation", holder.MountPoint, dir)
+}
+
+// clientVersion runs the version command of the cubefs client.
+func clientVersion(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, clientVersionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, layout.clientBin, "-v").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s -v: %w, output: %s", layout.clientBin, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,167 @@
+package cubefs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// useTestMountInfo points the mount table at a file with the given content.
+func useTestMountInfo(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	writeFile(t, path, content)
+	saved := procMountInfoPath
+	procMountInfoPath = path
+	t.Cleanup(func() { procMountInfoPath = saved })
+}
+
+func TestCheckSharedMount(t *testing.T) {
+	useTestMountInfo(t, strings.Join([]string{
+		"20 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw",
+		"30 20 8:2 / /var/lib/kubelet rw,relatime shared:7 - ext4 /dev/sda2 rw",
+		"31 30 0:50 / /var/lib/kubelet/pods/uid-1/volumes/secret rw,relatime - tmpfs tmpfs rw",
+		"40 20 8:3 / /data rw,relatime master:3 - ext4 /dev/sda3 rw",
+		// a private mount over a shared one hides it
+		"41 20 8:3 / /data rw,relatime - ext4 /dev/sda3 rw",
+		"50 20 8:4 / /var/lib/cubefs rw,relatime shared:9 master:2 - ext4 /dev/sda4 rw",
+	}, "\n")+"\n")
+
+	tests := []struct {
+		dir     string
+		wantErr string
+	}{
+		{"/var/lib/kubelet/pods", ""},
+		{"/var/lib/kubelet/plugins/kubernetes.io/csi", ""},
+		{"/var/lib/kubelet/", ""},
+		{"/var/lib/cubefs/mnt", ""},
+		{"/var/lib/kubelet/pods/uid-1/volumes/secret/key", "mount /var/lib/kubelet/pods/uid-1/volumes/secret holding"},
+		{"/var/lib/kubeletx", "mount / holding /var/lib/kubeletx is not shared"},
+		{"/data/cubefs", "mount /data holding /data/cubefs is not shared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			err := checkSharedMount(tt.dir)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkSharedMount(%q) = %v", tt.dir, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkSharedMount(%q) = %v, want %q", tt.dir, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckFuseFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	saved := procFilesystemsPath
+	t.Cleanup(func() { procFilesystemsPath = saved })
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"loaded", "nodev\tsysfs\nnodev\ttmpfs\n\text4\nnodev\tfuse\n\tfuseblk\n", false},
+		{"not loaded", "nodev\tsysfs\n\text4\n\tfuseblk\nnodev\tfusectl\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			procFilesystemsPath = filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-"))
+			writeFile(t, procFilesystemsPath, tt.content)
+			if err := checkFuseFilesystem(); (err != nil) != tt.wantErr {
+				t.Fatalf("checkFuseFilesystem() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckClientBinary(t *testing.T) {
+	dir := useTestLayout(t)
+	layout.clientBin = filepath.Join(dir, "cfs-client")
+	if err := checkClientBinary(); err == nil {
+		t.Error("checkClientBinary() of a missing binary = nil")
+	}
+	writeFile(t, layout.clientBin, "#!/bin/sh\n")
+	if err := checkClientBinary(); err == nil || !strings.Contains(err.Error(), "not executable") {
+		t.Errorf("checkClientBinary() of a plain file = %v, want not executable", err)
+	}
+	useTestClient(t)
+	if err := checkClientBinary(); err != nil {
+		t.Errorf("checkClientBinary() = %v", err)
+	}
+}
+
+func TestRunPreflightChecks(t *testing.T) {
+	errFailed := errors.New("failed")
+	checks := []preflightCheck{
+		{name: "passing", mandatory: true, check: func() error { return nil }},
+		{name: "optional", check: func() error { return errFailed }},
+	}
+	if err := runPreflightChecks(checks); err != nil {
+		t.Fatalf("runPreflightChecks() with a failed optional check = %v, want nil", err)
+	}
+
+	checks = append(checks,
+		preflightCheck{name: "first", mandatory: true, check: func() error { return errFailed }},
+		preflightCheck{name: "second", mandatory: true, check: func() error { return errFailed }},
+	)
+	err := runPreflightChecks(checks)
+	if !errors.Is(err, errFailed) || !strings.Contains(err.Error(), "first: failed") || !strings.Contains(err.Error(), "second: failed") {
+		t.Fatalf("runPreflightChecks() = %v, want both mandatory failures", err)
+	}
+	if strings.Contains(err.Error(), "optional") {
+		t.Errorf("runPreflightChecks() = %v, want the optional failure left out", err)
+	}
+}
+
+func TestPreflightGatesRegistration(t *testing.T) {
+	n, _, _ := newTestNodeService(t)
+	failing := errors.New("fuse is not loaded")
+	n.preflightChecks = []preflightCheck{{name: "fuse module", mandatory: true, check: func() error { return failing }}}
+	identity := NewIdentityService(DriverName, "test")
+	identity.ready = n.preflight
+
+	if _, err := n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("NodeGetInfo() with a failed check = %v, want FailedPrecondition", err)
+	}
+	if resp, err := identity.Probe(context.Background(), &csi.ProbeRequest{}); err != nil || resp.GetReady().GetValue() {
+		t.Errorf("Probe() with a failed check = %v, %v, want not ready", resp, err)
+	}
+
+	failing = nil
+	resp, err := n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil || resp.NodeId != n.NodeId {
+		t.Errorf("NodeGetInfo() = %v, %v, want the node registered", resp, err)
+	}
+	if resp, err := identity.Probe(context.Background(), &csi.ProbeRequest{}); err != nil || !resp.GetReady().GetValue() {
+		t.Errorf("Probe() = %v, %v, want ready", resp, err)
+	}
+}
+
+func TestNodePreflightChecks(t *testing.T) {
+	mandatory := func(opts *Options) map[string]bool {
+		names := make(map[string]bool)
+		for _, c := range nodePreflightChecks(opts) {
+			names[c.name] = c.mandatory
+		}
+		return names
+	}
+	process := mandatory(&Options{MountMode: ProcessMountMode})
+	if !process["fuse device"] || !process["cfs-client"] || !process["staging propagation"] {
+		t.Errorf("process mode checks = %v, want the device and client mandatory", process)
+	}
+	pod := mandatory(&Options{MountMode: PodMountMode})
+	if pod["fuse device"] || pod["cfs-client"] || !pod["kubelet pods propagation"] {
+		t.Errorf("pod mode checks = %v, want only the kernel and propagation mandatory", pod)
+	}
+}
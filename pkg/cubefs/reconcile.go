@@ -0,0 +1,181 @@
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"k8s.io/klog/v2"
+	mountutils "k8s.io/mount-utils"
+)
+
+const (
+	// kubelet keeps the volume handle of every CSI volume of a pod next to its target path
+	kubeletVolDataFile = "vol_data.json"
+)
+
+// kubeletVolData is the part of kubelet's vol_data.json the driver uses
+type kubeletVolData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// reconcileSummary counts what the startup reconciliation found and did.
+type reconcileSummary struct {
+	healthy   []string
+	remounted []string
+	rebound   []string
+	removed   []string
+	failed    []string
+	orphaned  []string
+}
+
+// reconcile brings the mounts of the node back in line with the persisted
+// client configs and the target paths kubelet knows of, after the node driver
+// restarted. It must run before the gRPC server starts.
+func (n *NodeService) reconcile(ctx context.Context) {
+	// inline volumes of pods deleted while the driver was down are not remounted
+	n.sweepEphemeral(ctx)
+
+	confs, err := listClientConfs()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list client configs, skip reconciling mounts")
+		return
+	}
+	published := n.kubeletTargets()
+	mountInfos, err := mountutils.ParseMountInfo(procMountInfoPath)
+	if err != nil {
+		klog.ErrorS(err, "Failed to read mount info, bind mounts are restored from the client mount root")
+	}
+
+	summary := &reconcileSummary{}
+	for volumeId, conf := range confs {
+		targets := published[volumeId]
+		delete(published, volumeId)
+		if err := n.volumeLocks.acquire(ctx, volumeId); err != nil {
+			summary.failed = append(summary.failed, volumeId)
+			continue
+		}
+		n.reconcileVolume(ctx, volumeId, conf[KMountPoint], targets, mountInfos, summary)
+		n.volumeLocks.release(volumeId)
+	}
+	for volumeId, targets := range published {
+		klog.ErrorS(nil, "Volume is published without a client config, it cannot be remounted", "volumeId", volumeId, "targets", targets)
+		summary.orphaned = append(summary.orphaned, volumeId)
+	}
+
+	for _, ids := range [][]string{summary.healthy, summary.remounted, summary.rebound, summary.removed, summary.failed, summary.orphaned} {
+		sort.Strings(ids)
+	}
+	klog.InfoS("Reconciled mounts", "healthy", summary.healthy, "remounted", summary.remounted, "rebound", summary.rebound,
+		"removed", summary.removed, "failed", summary.failed, "orphaned", summary.orphaned)
+}
+
+func (n *NodeService) reconcileVolume(ctx context.Context, volumeId, mountPath string, targets []string,
+	mountInfos []mountutils.MountInfo, summary *reconcileSummary) {
+	if mountPath == "" {
+		klog.InfoS("Client config has no mount point, removing it", "volumeId", volumeId)
+		n.removeStaleVolume(volumeId, mountPath, summary)
+		return
+	}
+	for _, target := range targets {
+		n.refs.addTarget(volumeId, mountPath, target, bindMountOf(mountInfos, mountPath, target))
+	}
+
+	isMnt, err := n.mounter.IsMountPoint(mountPath)
+	clientAlive := err == nil && isMnt
+
+	if len(targets) == 0 {
+		if clientAlive {
+			// staged but not published yet, or about to be unstaged by kubelet
+			summary.healthy = append(summary.healthy, volumeId)
+			return
+		}
+		// kubelet removes the staging directory once it unstaged the volume,
+		// until then the next NodePublishVolume needs the client
+		if _, err := os.Lstat(mountPath); os.IsNotExist(err) {
+			klog.InfoS("Volume is no longer staged and its client is gone, removing it", "volumeId", volumeId, "mountPath", mountPath)
+			n.removeStaleVolume(volumeId, mountPath, summary)
+			return
+		}
+	}
+
+	if !clientAlive {
+		// the targets, if any, are bind mounts of the dead client, recoverVolume rebinds them all
+		if err := n.recoverVolume(ctx, volumeId, mountPath); err != nil {
+			klog.ErrorS(err, "Failed to remount volume", "volumeId", volumeId, "mountPath", mountPath)
+			summary.failed = append(summary.failed, volumeId)
+			return
+		}
+		summary.remounted = append(summary.remounted, volumeId)
+		return
+	}
+
+	var stale []string
+	for _, target := range targets {
+		if notMnt, err := n.mounter.IsLikelyNotMountPoint(target); err != nil || notMnt {
+			stale = append(stale, target)
+		}
+	}
+	if len(stale) == 0 {
+		summary.healthy = append(summary.healthy, volumeId)
+		return
+	}
+	klog.InfoS("Fixing stale bind mounts", "volumeId", volumeId, "mountPath", mountPath, "targets", stale)
+	if err := n.rebindTargets(volumeId, stale); err != nil {
+		summary.failed = append(summary.failed, volumeId)
+		return
+	}
+	summary.rebound = append(summary.rebound, volumeId)
+}
+
+// removeStaleVolume cleans up a dead client mount which no pod uses and forgets its config.
+func (n *NodeService) removeStaleVolume(volumeId, mountPath string, summary *reconcileSummary) {
+	if mountPath != "" {
+		if err := unmountStale(n.mounter, mountPath); err != nil {
+			klog.ErrorS(err, "Failed to unmount stale client mount", "volumeId", volumeId, "mountPath", mountPath)
+			summary.failed = append(summary.failed, volumeId)
+			return
+		}
+	}
+	if err := removeClientConf(volumeId); err != nil {
+		klog.ErrorS(err, "Failed to remove client config file", "volumeId", volumeId)
+		summary.failed = append(summary.failed, volumeId)
+		return
+	}
+	n.refs.remove(volumeId)
+	summary.removed = append(summary.removed, volumeId)
+}
+
+// kubeletTargets finds the target paths of the driver's volumes in the pods of
+// the node, keyed by volume ID.
+func (n *NodeService) kubeletTargets() map[string][]string {
+	pattern := filepath.Join(layout.kubeletPodsDir(), "*", "volumes", "kubernetes.io~csi", "*", kubeletVolDataFile)
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		klog.ErrorS(err, "Failed to list kubelet volumes", "pattern", pattern)
+		return nil
+	}
+
+	targets := make(map[string][]string)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			klog.ErrorS(err, "Failed to read kubelet volume data", "file", file)
+			continue
+		}
+		volData := kubeletVolData{}
+		if err = json.Unmarshal(data, &volData); err != nil {
+			klog.ErrorS(err, "Failed to decode kubelet volume data", "file", file)
+			continue
+		}
+		if volData.DriverName != n.driverName || volData.VolumeHandle == "" {
+			continue
+		}
+		target := filepath.Join(filepath.Dir(file), "mount")
+		targets[volData.VolumeHandle] = append(targets[volData.VolumeHandle], target)
+	}
+	return targets
+}
@@ -0,0 +1,115 @@
+package cubefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// writeKubeletVolData writes the vol_data.json kubelet keeps for a target of a
+// pod and returns the target path.
+func writeKubeletVolData(t *testing.T, podUID, pvName, driverName, volumeHandle string) string {
+	t.Helper()
+	dir := filepath.Join(layout.kubeletPodsDir(), podUID, "volumes", "kubernetes.io~csi", pvName)
+	writeFile(t, filepath.Join(dir, kubeletVolDataFile),
+		`{"driverName":"`+driverName+`","volumeHandle":"`+volumeHandle+`","specVolID":"`+pvName+`"}`)
+	return filepath.Join(dir, "mount")
+}
+
+func TestKubeletTargets(t *testing.T) {
+	n, _, _ := newTestNodeService(t)
+	target1 := writeKubeletVolData(t, "uid-1", "pv-a", DriverName, "pvc-a")
+	target2 := writeKubeletVolData(t, "uid-2", "pv-a", DriverName, "pvc-a")
+	target3 := writeKubeletVolData(t, "uid-2", "pv-b", DriverName, "pvc-b")
+	writeKubeletVolData(t, "uid-3", "pv-c", "other.csi.example.com", "pvc-c")
+	writeKubeletVolData(t, "uid-3", "pv-d", DriverName, "")
+
+	want := map[string][]string{"pvc-a": {target1, target2}, "pvc-b": {target3}}
+	if got := n.kubeletTargets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("kubeletTargets() = %v, want %v", got, want)
+	}
+}
+
+func TestReconcileVolume(t *testing.T) {
+	corrupted := &os.PathError{Op: "stat", Err: syscall.ENOTCONN}
+	tests := []struct {
+		name string
+		// client is the error checking the client mount, nil when it is
+		// healthy, noClient leaves it unmounted
+		client   error
+		noClient bool
+		noConf   bool
+		// unstaged removes the staging directory like kubelet after NodeUnstageVolume
+		unstaged   bool
+		targets    int
+		staleBinds bool
+		want       string
+		wantMounts int
+		wantStart  bool
+	}{
+		{name: "published", targets: 2, want: "healthy"},
+		{name: "staged", want: "healthy"},
+		{name: "staged without client", noClient: true, want: "remounted", wantStart: true},
+		{name: "staged with crashed client", client: corrupted, want: "remounted", wantStart: true},
+		{name: "unstaged without client", noClient: true, unstaged: true, want: "removed"},
+		{name: "crashed client", client: corrupted, targets: 2, want: "remounted", wantMounts: 2, wantStart: true},
+		{name: "crashed client without config", client: corrupted, noConf: true, targets: 1, want: "failed"},
+		{name: "stale bind mounts", targets: 2, staleBinds: true, want: "rebound", wantMounts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, m, runner := newTestNodeService(t)
+			mountPath := filepath.Join(t.TempDir(), "globalmount")
+			if !tt.unstaged {
+				if err := os.Mkdir(mountPath, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !tt.noClient {
+				m.mountPoints[mountPath] = tt.client
+			}
+			if !tt.noConf {
+				writeTestClientConf(t, "pvc-a", mountPath)
+			}
+			var targets []string
+			for i := 0; i < tt.targets; i++ {
+				target := writeKubeletVolData(t, "uid-"+string(rune('1'+i)), "pv-a", DriverName, "pvc-a")
+				if err := os.Mkdir(target, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if !tt.staleBinds {
+					m.mountPoints[target] = tt.client
+				}
+				targets = append(targets, target)
+			}
+
+			summary := &reconcileSummary{}
+			n.reconcileVolume(context.Background(), "pvc-a", mountPath, targets, nil, summary)
+
+			got := map[string][]string{
+				"healthy": summary.healthy, "remounted": summary.remounted, "rebound": summary.rebound,
+				"removed": summary.removed, "failed": summary.failed,
+			}
+			for outcome, ids := range got {
+				if want := outcome == tt.want; want != reflect.DeepEqual(ids, []string{"pvc-a"}) {
+					t.Errorf("summary %s = %v, want the volume %s", outcome, ids, tt.want)
+				}
+			}
+			if len(m.mounts) != tt.wantMounts {
+				t.Errorf("bind mounts = %v, want %d", m.mounts, tt.wantMounts)
+			}
+			if started := len(runner.started) > 0; started != tt.wantStart {
+				t.Errorf("client started = %v, want %v", started, tt.wantStart)
+			}
+			if _, err := os.Stat(clientConfFilePath("pvc-a")); tt.want == "removed" && !os.IsNotExist(err) {
+				t.Errorf("client config of a removed volume: %v, want it deleted", err)
+			}
+			if tt.want != "removed" && len(n.refs.targets("pvc-a")) != tt.targets {
+				t.Errorf("mount references = %v, want the %d targets", n.refs.targets("pvc-a"), tt.targets)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package cubefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/majlu/my-cubefs-csi/pkg/mounter"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Reasons of the events recorded on pods using a recovered volume
+const (
+	eventReasonMountCorrupted      = "CubeFSMountCorrupted"
+	eventReasonMountRecovered      = "CubeFSMountRecovered"
+	eventReasonMountRecoveryFailed = "CubeFSMountRecoveryFailed"
+)
+
+// kubelet target paths look like /var/lib/kubelet/pods/<uid>/volumes/kubernetes.io~csi/<pv>/mount
+var podUIDInTargetPath = regexp.MustCompile(`/pods/([^/]+)/volumes/`)
+
+// runMountChecker recovers corrupted client mounts every interval until ctx is done.
+func (n *NodeService) runMountChecker(ctx context.Context) {
+	if n.options.MountCheckInterval <= 0 {
+		klog.InfoS("Mount checker disabled")
+		return
+	}
+	klog.InfoS("Mount checker started", "interval", n.options.MountCheckInterval)
+	wait.UntilWithContext(ctx, n.checkMounts, n.options.MountCheckInterval)
+}
+
+func (n *NodeService) checkMounts(ctx context.Context) {
+	for volumeId, mountPath := range n.refs.mountPaths() {
+		// volumes busy with an operation are checked in the next round
+		if !n.volumeLocks.tryAcquire(volumeId) {
+			continue
+		}
+		if n.isCorruptedMount(mountPath) {
+			if err := n.recoverVolume(ctx, volumeId, mountPath); err != nil {
+				klog.ErrorS(err, "Failed to recover corrupted mount", "volumeId", volumeId, "mountPath", mountPath)
+			}
+		}
+		n.volumeLocks.release(volumeId)
+	}
+}
+
+// isCorruptedMount reports whether path is a mount whose client is gone, e.g.
+// "transport endpoint is not connected" after a cfs-client crash.
+func (n *NodeService) isCorruptedMount(path string) bool {
+	_, err := n.mounter.IsLikelyNotMountPoint(path)
+	return err != nil && n.mounter.IsCorruptedMnt(err)
+}
+
+// recoverVolume restarts the client of a corrupted mount from its persisted
+// config and bind mounts it again into the targets of the pods using it.
+// Containers only see the new mount if their volumeMount propagation allows it.
+func (n *NodeService) recoverVolume(ctx context.Context, volumeId, mountPath string) error {
+	targets := n.refs.targets(volumeId)
+	klog.InfoS("Recovering corrupted mount", "volumeId", volumeId, "mountPath", mountPath, "targets", targets)
+	n.recordPodEvents(ctx, targets, corev1.EventTypeWarning, eventReasonMountCorrupted,
+		fmt.Sprintf("CubeFS mount of volume %s is corrupted, recovering", volumeId))
+
+	err := n.remountClient(ctx, volumeId, mountPath)
+	if err == nil {
+		err = n.rebindTargets(volumeId, targets)
+	}
+	n.recordRecovery(ctx, volumeId, mountPath, targets, err)
+	return err
+}
+
+// clientRestarted bind mounts the volume again into its targets after the
+// supervisor restarted its crashed client.
+func (n *NodeService) clientRestarted(volumeId, mountPath string) {
+	if err := n.volumeLocks.acquire(context.Background(), volumeId); err != nil {
+		return
+	}
+	defer n.volumeLocks.release(volumeId)
+
+	targets := n.refs.targets(volumeId)
+	err := n.rebindTargets(volumeId, targets)
+	if err != nil {
+		klog.ErrorS(err, "Failed to recover targets of restarted client", "volumeId", volumeId, "mountPath", mountPath)
+	}
+	n.recordRecovery(context.Background(), volumeId, mountPath, targets, err)
+}
+
+func (n *NodeService) rebindTargets(volumeId string, targets []string) error {
+	var failed []string
+	for _, target := range targets {
+		if err := n.rebindTarget(target, n.refs.targetBind(volumeId, target)); err != nil {
+			klog.ErrorS(err, "Failed to bind mount recovered volume", "volumeId", volumeId, "targetPath", target)
+			failed = append(failed, target)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("bind mount %v failed", failed)
+	}
+	return nil
+}
+
+// recordRecovery reports the outcome of a recovery on the pods using the volume.
+func (n *NodeService) recordRecovery(ctx context.Context, volumeId, mountPath string, targets []string, err error) {
+	if err != nil {
+		n.recordPodEvents(ctx, targets, corev1.EventTypeWarning, eventReasonMountRecoveryFailed,
+			fmt.Sprintf("CubeFS mount of volume %s could not be recovered: %v", volumeId, err))
+		return
+	}
+	n.recordPodEvents(ctx, targets, corev1.EventTypeNormal, eventReasonMountRecovered,
+		fmt.Sprintf("CubeFS mount of volume %s recovered", volumeId))
+	klog.InfoS("Recovered corrupted mount", "volumeId", volumeId, "mountPath", mountPath)
+}
+
+// remountClient lazily unmounts the dead client mount and starts a new client
+// from the persisted config.
+func (n *NodeService) remountClient(ctx context.Context, volumeId, mountPath string) error {
+	confFile := clientConfFilePath(volumeId)
+	if _, err := os.Stat(confFile); err != nil {
+		return fmt.Errorf("no persisted client config for volume %s: %w", volumeId, err)
+	}
+	if err := unmountStale(n.mounter, mountPath); err != nil {
+		return err
+	}
+	if err := n.runner.stop(ctx, volumeId); err != nil {
+		return err
+	}
+	return n.runner.start(ctx, volumeId, mountPath)
+}
+
+// rebindTarget replaces the stale bind mount at target with a new one.
+func (n *NodeService) rebindTarget(target string, bind bindMount) error {
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		// the pod is gone
+		return nil
+	}
+	if err := unmountStale(n.mounter, target); err != nil {
+		return err
+	}
+	return n.mounter.Mount(bind.source, target, "", bind.options)
+}
+
+// unmountStale lazily unmounts whatever, dead or alive, is mounted at path.
+func unmountStale(m mounter.Mounter, path string) error {
+	notMnt, err := m.IsLikelyNotMountPoint(path)
+	if os.IsNotExist(err) || (err == nil && notMnt) {
+		return nil
+	}
+	if err != nil && !m.IsCorruptedMnt(err) {
+		return err
+	}
+	return m.UnmountLazy(path)
+}
+
+// recordPodEvents records an event on every pod owning one of the targets.
+func (n *NodeService) recordPodEvents(ctx context.Context, targets []string, eventType, reason, message string) {
+	uids := make(map[types.UID]struct{})
+	for _, target := range targets {
+		if match := podUIDInTargetPath.FindStringSubmatch(target); match != nil {
+			uids[types.UID(match[1])] = struct{}{}
+		}
+	}
+	if len(uids) == 0 {
+		return
+	}
+
+	pods, err := n.ClientSet.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", n.NodeId).String(),
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to list pods for events", "reason", reason)
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if _, ok := uids[pod.UID]; ok {
+			n.recorder.Event(pod, eventType, reason, message)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package cubefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeRunner pretends to start the clients, mounting them in its mounter.
+type fakeRunner struct {
+	mounter *fakeMounter
+	started []string
+	stopped []string
+	// startErr fails the starts
+	startErr error
+}
+
+func (r *fakeRunner) start(ctx context.Context, volumeId, mountPath string) error {
+	r.started = append(r.started, volumeId)
+	if r.startErr != nil {
+		return r.startErr
+	}
+	r.mounter.mountPoints[mountPath] = nil
+	return nil
+}
+
+func (r *fakeRunner) stop(ctx context.Context, volumeId string) error {
+	r.stopped = append(r.stopped, volumeId)
+	return nil
+}
+
+func TestPodInfoOfTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/var/lib/kubelet/pods/0b7a3c1e-uid/volumes/kubernetes.io~csi/pvc-a/mount", "0b7a3c1e-uid"},
+		{"/data/kubelet/pods/uid-2/volumes/kubernetes.io~csi/pvc-a/mount", "uid-2"},
+		{"/var/lib/kubelet/plugins/kubernetes.io/csi/csi.cubefs.com/abc/globalmount", ""},
+	}
+	for _, tt := range tests {
+		if got := podInfoOfTarget(tt.target).uid; got != tt.want {
+			t.Errorf("podInfoOfTarget(%q).uid = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMounts(t *testing.T) {
+	dir := useTestLayout(t)
+	corrupted := &os.PathError{Op: "stat", Err: syscall.ENOTCONN}
+	mountPath := func(volumeId string) string { return filepath.Join(dir, "mnt", volumeId) }
+	target := func(uid, volumeId string) string {
+		return filepath.Join(dir, "kubelet", "pods", uid, "volumes", "kubernetes.io~csi", volumeId, "mount")
+	}
+	for _, path := range []string{target("uid-1", "pvc-a"), target("uid-2", "pvc-b")} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, clientConfFilePath("pvc-a"), `{"mountPoint":"`+mountPath("pvc-a")+`"}`)
+
+	m := &fakeMounter{mountPoints: map[string]error{
+		// corrupted with its target, recovered
+		mountPath("pvc-a"):       corrupted,
+		target("uid-1", "pvc-a"): corrupted,
+		// corrupted without a persisted config, fails
+		mountPath("pvc-b"): corrupted,
+		// healthy
+		mountPath("pvc-c"): nil,
+		// corrupted but locked by an operation
+		mountPath("pvc-d"): corrupted,
+	}}
+	runner := &fakeRunner{mounter: m}
+	recorder := record.NewFakeRecorder(10)
+	clientSet := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default", UID: "uid-1"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-2", Namespace: "default", UID: "uid-2"}},
+	)
+	n := &NodeService{
+		NodeId:      "node-1",
+		mounter:     m,
+		ClientSet:   clientSet,
+		volumeLocks: newVolumeLocks(),
+		refs:        newMountRefs(),
+		recorder:    recorder,
+		runner:      runner,
+		options:     &Options{},
+	}
+	for _, volumeId := range []string{"pvc-a", "pvc-b", "pvc-c", "pvc-d"} {
+		n.refs.setMount(volumeId, mountPath(volumeId))
+	}
+	n.refs.addTarget("pvc-a", mountPath("pvc-a"), target("uid-1", "pvc-a"), bindMount{})
+	n.refs.addTarget("pvc-b", mountPath("pvc-b"), target("uid-2", "pvc-b"), bindMount{})
+	n.volumeLocks.tryAcquire("pvc-d")
+
+	n.checkMounts(context.Background())
+
+	if !reflect.DeepEqual(runner.started, []string{"pvc-a"}) || !reflect.DeepEqual(runner.stopped, []string{"pvc-a"}) {
+		t.Errorf("restarted clients = %v/%v, want pvc-a", runner.stopped, runner.started)
+	}
+	wantMounts := []string{mountPath("pvc-a") + " " + target("uid-1", "pvc-a")}
+	if !reflect.DeepEqual(m.mounts, wantMounts) {
+		t.Errorf("bind mounts = %v, want %v", m.mounts, wantMounts)
+	}
+	if m.mountPoints[mountPath("pvc-d")] == nil {
+		t.Error("the locked volume was recovered, want it skipped")
+	}
+	if n.volumeLocks.tryAcquire("pvc-a") == false {
+		t.Error("the volume lock of pvc-a is still held after the check")
+	}
+
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, strings.SplitN(event, " ", 3)[1])
+	}
+	want := []string{
+		eventReasonMountCorrupted, eventReasonMountRecovered,
+		eventReasonMountCorrupted, eventReasonMountRecoveryFailed,
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v in any volume order", events, want)
+	}
+	count := func(reasons []string) map[string]int {
+		counts := make(map[string]int)
+		for _, reason := range reasons {
+			counts[reason]++
+		}
+		return counts
+	}
+	if !reflect.DeepEqual(count(events), count(want)) {
+		t.Errorf("events = %v, want %v in any volume order", events, want)
+	}
+}
+
+func TestUnmountStale(t *testing.T) {
+	dir := t.TempDir()
+	m := &fakeMounter{mountPoints: map[string]error{
+		dir + "/live":      nil,
+		dir + "/corrupted": &os.PathError{Op: "stat", Err: syscall.ENOTCONN},
+		dir + "/broken":    &os.PathError{Op: "stat", Err: syscall.EINVAL},
+	}}
+	for _, path := range []string{"live", "corrupted", "missing"} {
+		if err := unmountStale(m, filepath.Join(dir, path)); err != nil {
+			t.Errorf("unmountStale(%s) = %v", path, err)
+		}
+	}
+	if err := unmountStale(m, dir); err != nil {
+		t.Errorf("unmountStale() of a plain directory = %v", err)
+	}
+	if err := unmountStale(m, dir+"/broken"); err == nil {
+		t.Error("unmountStale() of a path failing the check = nil, want the error")
+	}
+	if want := []string{dir + "/live", dir + "/corrupted"}; !reflect.DeepEqual(m.unmounted, want) {
+		t.Errorf("unmounted = %v, want %v", m.unmounted, want)
+	}
+}
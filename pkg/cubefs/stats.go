@@ -0,0 +1,88 @@
+package cubefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// volumeStatsTimeout bounds a statfs on a FUSE mount, which hangs when the
+	// client is stuck
+	volumeStatsTimeout = 10 * time.Second
+)
+
+type volumeStats struct {
+	totalBytes     int64
+	availableBytes int64
+	usedBytes      int64
+	totalInodes    int64
+	freeInodes     int64
+	usedInodes     int64
+}
+
+// errStatfsTimeout is returned when statfs did not finish in time, the mount is
+// most likely hung.
+var errStatfsTimeout = errors.New("statfs timed out")
+
+// statfsInflight guards against piling up goroutines stuck on the same hung mount.
+var statfsInflight = struct {
+	sync.Mutex
+	paths map[string]struct{}
+}{paths: make(map[string]struct{})}
+
+// statfs returns the usage of the file system at path, giving up after timeout
+// or when ctx is done. A goroutine stuck in the kernel is left behind in that
+// case, but at most one per path.
+func statfs(ctx context.Context, path string, timeout time.Duration) (*volumeStats, error) {
+	statfsInflight.Lock()
+	if _, ok := statfsInflight.paths[path]; ok {
+		statfsInflight.Unlock()
+		return nil, fmt.Errorf("%w: previous statfs of %s is still pending", errStatfsTimeout, path)
+	}
+	statfsInflight.paths[path] = struct{}{}
+	statfsInflight.Unlock()
+
+	type result struct {
+		stats *volumeStats
+		err   error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		defer func() {
+			statfsInflight.Lock()
+			delete(statfsInflight.paths, path)
+			statfsInflight.Unlock()
+		}()
+
+		buf := &unix.Statfs_t{}
+		if err := unix.Statfs(path, buf); err != nil {
+			resultCh <- result{err: err}
+			return
+		}
+		stats := &volumeStats{
+			totalBytes:     int64(buf.Blocks) * buf.Bsize,
+			availableBytes: int64(buf.Bavail) * buf.Bsize,
+			usedBytes:      int64(buf.Blocks-buf.Bfree) * buf.Bsize,
+			totalInodes:    int64(buf.Files),
+			freeInodes:     int64(buf.Ffree),
+			usedInodes:     int64(buf.Files - buf.Ffree),
+		}
+		resultCh <- result{stats: stats}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-resultCh:
+		return r.stats, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: %s did not answer in %v", errStatfsTimeout, path, timeout)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %s: %v", errStatfsTimeout, path, ctx.Err())
+	}
+}
@@ -0,0 +1,82 @@
+package cubefs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatfs(t *testing.T) {
+	dir := t.TempDir()
+	stats, err := statfs(context.Background(), dir, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.totalBytes <= 0 || stats.usedBytes < 0 || stats.availableBytes > stats.totalBytes {
+		t.Errorf("statfs() bytes = %+v, want a positive total above the available bytes", stats)
+	}
+	if stats.usedInodes != stats.totalInodes-stats.freeInodes {
+		t.Errorf("statfs() inodes = %+v, want used = total - free", stats)
+	}
+
+	// a statfs still stuck on the path is not piled up on
+	statfsInflight.Lock()
+	statfsInflight.paths[dir] = struct{}{}
+	statfsInflight.Unlock()
+	t.Cleanup(func() {
+		statfsInflight.Lock()
+		delete(statfsInflight.paths, dir)
+		statfsInflight.Unlock()
+	})
+	if _, err = statfs(context.Background(), dir, time.Second); !errors.Is(err, errStatfsTimeout) {
+		t.Errorf("statfs() with a pending statfs err = %v, want %v", err, errStatfsTimeout)
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	dir := t.TempDir()
+	hung := t.TempDir()
+	statfsInflight.Lock()
+	statfsInflight.paths[hung] = struct{}{}
+	statfsInflight.Unlock()
+	t.Cleanup(func() {
+		statfsInflight.Lock()
+		delete(statfsInflight.paths, hung)
+		statfsInflight.Unlock()
+	})
+	n := &NodeService{}
+
+	resp, err := n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc-a", VolumePath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Usage) != 2 || resp.Usage[0].Unit != csi.VolumeUsage_BYTES || resp.Usage[1].Unit != csi.VolumeUsage_INODES {
+		t.Errorf("NodeGetVolumeStats() usage = %v, want bytes and inodes", resp.Usage)
+	}
+	if resp.VolumeCondition.GetAbnormal() {
+		t.Errorf("NodeGetVolumeStats() condition = %v, want healthy", resp.VolumeCondition)
+	}
+
+	resp, err = n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc-a", VolumePath: hung})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.VolumeCondition.GetAbnormal() || len(resp.Usage) != 0 {
+		t.Errorf("NodeGetVolumeStats() of a hung mount = %v, want an abnormal condition without usage", resp)
+	}
+
+	_, err = n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc-a", VolumePath: filepath.Join(dir, "missing")})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("NodeGetVolumeStats() of a missing path err = %v, want NotFound", err)
+	}
+	_, err = n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc-a"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("NodeGetVolumeStats() without a path err = %v, want InvalidArgument", err)
+	}
+}
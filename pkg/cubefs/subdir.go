@@ -0,0 +1,125 @@
+package cubefs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Volume attributes selecting the directory of the volume a PV exposes, they
+// are handled by the driver and not passed to the cubefs client.
+const (
+	// KSubdir is the directory exposed to the pods, relative to KBaseDir
+	KSubdir = "subdir"
+	// KBaseDir is a StorageClass parameter giving every PV its own directory <baseDir>/<pv name>
+	KBaseDir = "baseDir"
+	// KCreateSubdir creates the directory on publish if it does not exist
+	KCreateSubdir = "createSubdir"
+	// KOnDelete is what DeleteVolume does with the directory of a PV sharing its volume
+	KOnDelete = "onDelete"
+)
+
+// Values of KOnDelete
+const (
+	onDeleteRetain = "retain"
+	onDeleteDelete = "delete"
+)
+
+// volumeSubdir returns the directory a PV exposes, relative to the volume
+// root, empty for the root itself. A subdir mount flag overrides the attribute.
+func volumeSubdir(volumeContext map[string]string, mountOpts *mountOptions) (string, error) {
+	subdir := volumeContext[KSubdir]
+	if flag, ok := mountOpts.attributes[KSubdir]; ok {
+		subdir = flag
+	}
+	if err := validateSubdir(volumeContext[KBaseDir]); err != nil {
+		return "", fmt.Errorf("invalid %s: %w", KBaseDir, err)
+	}
+	if err := validateSubdir(subdir); err != nil {
+		return "", fmt.Errorf("invalid %s: %w", KSubdir, err)
+	}
+	return strings.TrimPrefix(path.Join("/", volumeContext[KBaseDir], subdir), "/"), nil
+}
+
+// validateSubdir rejects paths which could leave the volume.
+func validateSubdir(dir string) error {
+	if strings.ContainsRune(dir, 0) {
+		return fmt.Errorf("%q contains a NUL byte", dir)
+	}
+	for _, elem := range strings.Split(dir, "/") {
+		if elem == ".." {
+			return fmt.Errorf("%q must not contain ..", dir)
+		}
+	}
+	return nil
+}
+
+// ensureSubdir returns the path of subdir in the client mount, creating the
+// missing directories if create is set. Symlinks are refused so the path
+// cannot lead out of the volume.
+func ensureSubdir(mountPath, subdir string, create bool) (string, error) {
+	dir := mountPath
+	for _, elem := range strings.Split(subdir, "/") {
+		dir = filepath.Join(dir, elem)
+		info, err := os.Lstat(dir)
+		switch {
+		case os.IsNotExist(err) && create:
+			if err = os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+				return "", status.Errorf(codes.Internal, "create subdir %s: %v", subdir, err)
+			}
+		case os.IsNotExist(err):
+			return "", status.Errorf(codes.NotFound, "subdir %s does not exist in the volume, set %s to create it", subdir, KCreateSubdir)
+		case err != nil:
+			return "", status.Errorf(codes.Internal, "check subdir %s: %v", subdir, err)
+		case info.Mode()&os.ModeSymlink != 0:
+			return "", status.Errorf(codes.InvalidArgument, "subdir %s must not go through the symlink %s", subdir, dir)
+		case !info.IsDir():
+			return "", status.Errorf(codes.InvalidArgument, "subdir %s: %s is not a directory", subdir, dir)
+		}
+	}
+	return dir, nil
+}
+
+// subdirOnDelete returns what DeleteVolume does with the directory of a PV,
+// the directory is retained by default.
+func subdirOnDelete(volumeContext map[string]string) (string, error) {
+	switch policy := volumeContext[KOnDelete]; policy {
+	case "", onDeleteRetain:
+		return onDeleteRetain, nil
+	case onDeleteDelete:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q, it must be %s or %s", KOnDelete, policy, onDeleteRetain, onDeleteDelete)
+	}
+}
+
+// persistentVolumeSubdir returns the directory of its volume a PV exposes,
+// empty for the root. PVs exposing a directory may share their volume.
+func persistentVolumeSubdir(pv *corev1.PersistentVolume) (string, error) {
+	mountOpts, err := parseMountFlags(pv.Spec.MountOptions)
+	if err != nil {
+		return "", err
+	}
+	return volumeSubdir(pv.Spec.CSI.VolumeAttributes, mountOpts)
+}
+
+// setVolumeSubdir gives a volume provisioned from a StorageClass with a base
+// directory its own directory <baseDir>/<name>, created on first publish.
+func setVolumeSubdir(volumeContext map[string]string, name string) error {
+	if volumeContext[KBaseDir] != "" {
+		if _, ok := volumeContext[KSubdir]; !ok {
+			volumeContext[KSubdir] = name
+		}
+		if _, ok := volumeContext[KCreateSubdir]; !ok {
+			volumeContext[KCreateSubdir] = "true"
+		}
+	}
+	_, err := volumeSubdir(volumeContext, &mountOptions{})
+	return err
+}
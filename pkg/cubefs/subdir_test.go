@@ -0,0 +1,265 @@
+package cubefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestVolumeSubdir(t *testing.T) {
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		flags         []string
+		want          string
+		wantErr       string
+	}{
+		{name: "root", want: ""},
+		{name: "subdir", volumeContext: map[string]string{KSubdir: "app/data/"}, want: "app/data"},
+		{name: "absolute subdir", volumeContext: map[string]string{KSubdir: "/app"}, want: "app"},
+		{name: "base dir", volumeContext: map[string]string{KBaseDir: "pvs", KSubdir: "pvc-a"}, want: "pvs/pvc-a"},
+		{name: "base dir only", volumeContext: map[string]string{KBaseDir: "/pvs"}, want: "pvs"},
+		{name: "mount flag overrides", volumeContext: map[string]string{KSubdir: "app"}, flags: []string{"subdir=other"}, want: "other"},
+		{name: "dot elements", volumeContext: map[string]string{KSubdir: "./app//data/."}, want: "app/data"},
+		{name: "leaving subdir", volumeContext: map[string]string{KSubdir: "app/../../etc"}, wantErr: "invalid subdir"},
+		{name: "leaving base dir", volumeContext: map[string]string{KBaseDir: ".."}, wantErr: "invalid baseDir"},
+		{name: "leaving mount flag", flags: []string{"subdir=.."}, wantErr: "invalid subdir"},
+		{name: "NUL byte", volumeContext: map[string]string{KSubdir: "app\x00"}, wantErr: "NUL byte"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountOpts, err := parseMountFlags(tt.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := volumeSubdir(tt.volumeContext, mountOpts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("volumeSubdir() err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("volumeSubdir() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPersistentVolumeSubdir(t *testing.T) {
+	pv := func(attributes map[string]string, mountOptions ...string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{
+			MountOptions: mountOptions,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeAttributes: attributes},
+			},
+		}}
+	}
+	tests := []struct {
+		name string
+		pv   *corev1.PersistentVolume
+		want string
+	}{
+		{"whole volume", pv(map[string]string{KVolumeName: "pvc-a"}), ""},
+		{"base dir", pv(map[string]string{KBaseDir: "pvs", KSubdir: "pvc-a"}), "pvs/pvc-a"},
+		{"mount option", pv(nil, "subdir=datasets"), "datasets"},
+	}
+	for _, tt := range tests {
+		if got, err := persistentVolumeSubdir(tt.pv); err != nil || got != tt.want {
+			t.Errorf("%s: persistentVolumeSubdir() = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := persistentVolumeSubdir(pv(nil, "unknown")); err == nil {
+		t.Error("persistentVolumeSubdir() with an unknown mount option = nil, want an error")
+	}
+}
+
+func TestSubdirOnDelete(t *testing.T) {
+	for value, want := range map[string]string{"": onDeleteRetain, onDeleteRetain: onDeleteRetain, onDeleteDelete: onDeleteDelete} {
+		if got, err := subdirOnDelete(map[string]string{KOnDelete: value}); err != nil || got != want {
+			t.Errorf("subdirOnDelete(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := subdirOnDelete(map[string]string{KOnDelete: "archive"}); err == nil {
+		t.Error("subdirOnDelete(archive) = nil, want an error")
+	}
+}
+
+func TestEnsureSubdir(t *testing.T) {
+	mountPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountPath, "existing", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(mountPath, "file"), "")
+	if err := os.Symlink("/etc", filepath.Join(mountPath, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		subdir   string
+		create   bool
+		wantCode codes.Code
+	}{
+		{"existing/dir", false, codes.OK},
+		{"new/dir", true, codes.OK},
+		{"missing", false, codes.NotFound},
+		{"file", false, codes.InvalidArgument},
+		{"file/dir", true, codes.InvalidArgument},
+		{"link", false, codes.InvalidArgument},
+		{"link/ssl", true, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subdir, func(t *testing.T) {
+			got, err := ensureSubdir(mountPath, tt.subdir, tt.create)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("ensureSubdir(%q, %v) err = %v, want %v", tt.subdir, tt.create, err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if want := filepath.Join(mountPath, tt.subdir); got != want {
+				t.Errorf("ensureSubdir() = %q, want %q", got, want)
+			}
+			if info, err := os.Stat(got); err != nil || !info.IsDir() {
+				t.Errorf("subdir %s is not a directory: %v", got, err)
+			}
+		})
+	}
+}
+
+func TestSetVolumeSubdir(t *testing.T) {
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		want          map[string]string
+		wantErr       bool
+	}{
+		{
+			name:          "no base dir",
+			volumeContext: map[string]string{KSubdir: "app"},
+			want:          map[string]string{KSubdir: "app"},
+		},
+		{
+			name:          "base dir",
+			volumeContext: map[string]string{KBaseDir: "pvs"},
+			want:          map[string]string{KBaseDir: "pvs", KSubdir: "pvc-a", KCreateSubdir: "true"},
+		},
+		{
+			name:          "base dir with subdir",
+			volumeContext: map[string]string{KBaseDir: "pvs", KSubdir: "shared", KCreateSubdir: "false"},
+			want:          map[string]string{KBaseDir: "pvs", KSubdir: "shared", KCreateSubdir: "false"},
+		},
+		{
+			name:          "invalid base dir",
+			volumeContext: map[string]string{KBaseDir: "../pvs"},
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := setVolumeSubdir(tt.volumeContext, "pvc-a")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("setVolumeSubdir() = nil, want an error")
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(tt.volumeContext, tt.want) {
+				t.Fatalf("setVolumeSubdir() = %v, context %v, want %v", err, tt.volumeContext, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodePublishSubdir(t *testing.T) {
+	ctx := context.Background()
+	n, m, _ := newTestNodeService(t)
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "globalmount")
+	capability := mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+	volumeContext := map[string]string{KMasterAddr: "127.0.0.1:17010", KVolumeName: "pvc-a", KBaseDir: "pvs", KSubdir: "pvc-a"}
+
+	_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-a",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  capability,
+		VolumeContext:     volumeContext,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	conf, err := os.ReadFile(clientConfFilePath("pvc-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(conf), KBaseDir) || strings.Contains(string(conf), `"`+KSubdir+`"`) {
+		t.Errorf("client config = %s, want the subdir attributes left to the driver", conf)
+	}
+
+	publish := func(target string) error {
+		_, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          "pvc-a",
+			StagingTargetPath: stagingPath,
+			TargetPath:        target,
+			VolumeCapability:  capability,
+			VolumeContext:     volumeContext,
+		})
+		return err
+	}
+	target := filepath.Join(dir, "mount")
+	if err = publish(target); status.Code(err) != codes.NotFound {
+		t.Fatalf("NodePublishVolume() of a missing subdir err = %v, want NotFound", err)
+	}
+
+	volumeContext[KCreateSubdir] = "true"
+	if err = publish(target); err != nil {
+		t.Fatalf("NodePublishVolume: %v", err)
+	}
+	source := filepath.Join(stagingPath, "pvs", "pvc-a")
+	if want := []string{source + " " + target}; !reflect.DeepEqual(m.mounts, want) {
+		t.Errorf("bind mounts = %v, want %v", m.mounts, want)
+	}
+	if got := n.refs.targetBind("pvc-a", target).source; got != source {
+		t.Errorf("recorded bind source = %q, want %q", got, source)
+	}
+}
+
+func TestNodeStageCreatesOwnedSubdir(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner needs root")
+	}
+	n, _, _ := newTestNodeService(t)
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	volumeContext := map[string]string{
+		KMasterAddr: "127.0.0.1:17010", KVolumeName: "pvc-a",
+		KBaseDir: "pvs", KSubdir: "pvc-a", KCreateSubdir: "true", KUid: "1000", KGid: "2000",
+	}
+	_, err := n.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-a",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+		VolumeContext:     volumeContext,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(stagingPath, "pvs", "pvc-a"))
+	if err != nil {
+		t.Fatalf("subdir not created on stage: %v", err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 1000 || stat.Gid != 2000 {
+		t.Errorf("subdir owner = %d:%d, want 1000:2000", stat.Uid, stat.Gid)
+	}
+	if volumeContext[KCreateSubdir] != "true" {
+		t.Errorf("volume context = %v, want the request left as is", volumeContext)
+	}
+}
@@ -0,0 +1,354 @@
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/majlu/my-cubefs-csi/pkg/mounter"
+	"github.com/majlu/my-cubefs-csi/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	clientLogMaxSize    = 10 << 20
+	clientLogBackups    = 3
+	clientMountTimeout  = time.Minute
+	clientStopTimeout   = 10 * time.Second
+	clientPollInterval  = 200 * time.Millisecond
+	clientBackoffMin    = time.Second
+	clientBackoffMax    = 5 * time.Minute
+	clientBackoffReset  = 10 * time.Minute
+	clientStateRunning  = "running"
+	clientStateBackoff  = "backoff"
+	redactedConfigValue = "******"
+)
+
+var errClientStopped = errors.New("cubefs client stopped")
+
+// clientProcessInfo is the debug view of a supervised client.
+type clientProcessInfo struct {
+	VolumeId  string            `json:"volumeId"`
+	MountPath string            `json:"mountPath"`
+	ConfFile  string            `json:"confFile"`
+	Config    map[string]string `json:"config"`
+	LogFile   string            `json:"logFile"`
+	State     string            `json:"state"`
+	PID       int               `json:"pid,omitempty"`
+	StartTime time.Time         `json:"startTime"`
+	Restarts  int               `json:"restarts"`
+	LastExit  string            `json:"lastExit,omitempty"`
+}
+
+// clientProcess is the foreground cubefs client serving one volume, fields are
+// guarded by the supervisor mutex.
+type clientProcess struct {
+	info    clientProcessInfo
+	log     *util.RotatingFile
+	cmd     *exec.Cmd
+	exited  chan struct{} // closed when cmd exits, exitErr is set then
+	exitErr error
+	stopCh  chan struct{}
+	stopped bool
+	done    chan struct{} // closed when the watch goroutine returns
+	backoff time.Duration
+}
+
+// clientSupervisor runs the cubefs clients of the node in the foreground and
+// restarts the ones that crash, with an exponential backoff.
+type clientSupervisor struct {
+	mounter mounter.Mounter
+	mutex   sync.Mutex
+	clients map[string]*clientProcess
+	// onRestart is called in its own goroutine once a restarted client mounted the volume again.
+	onRestart func(volumeId, mountPath string)
+}
+
+func newClientSupervisor(onRestart func(volumeId, mountPath string)) *clientSupervisor {
+	return &clientSupervisor{
+		mounter:   mounter.NewNodeMounter(),
+		clients:   make(map[string]*clientProcess),
+		onRestart: onRestart,
+	}
+}
+
+// start replaces the client of the volume, if any, with a new one and waits for its mount.
+func (s *clientSupervisor) start(ctx context.Context, volumeId, mountPath string) error {
+	if err := s.stop(ctx, volumeId); err != nil {
+		return err
+	}
+
+	confFile := clientConfFilePath(volumeId)
+	logFile := filepath.Join(layout.clientProcessLogDir(), volumeId+".log")
+	log, err := util.NewRotatingFile(logFile, clientLogMaxSize, clientLogBackups)
+	if err != nil {
+		return fmt.Errorf("open client log file: %w", err)
+	}
+	p := &clientProcess{
+		info: clientProcessInfo{
+			VolumeId:  volumeId,
+			MountPath: mountPath,
+			ConfFile:  confFile,
+			Config:    readClientConfForDebug(confFile),
+			LogFile:   logFile,
+		},
+		log:     log,
+		stopCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+		backoff: clientBackoffMin,
+	}
+
+	s.mutex.Lock()
+	if err = s.launchLocked(p); err != nil {
+		s.mutex.Unlock()
+		_ = log.Close()
+		return err
+	}
+	s.clients[volumeId] = p
+	exited := p.exited
+	s.mutex.Unlock()
+	go s.watch(p)
+
+	if err = s.waitMounted(ctx, p, exited); err != nil {
+		if stopErr := s.stop(ctx, volumeId); stopErr != nil {
+			klog.ErrorS(stopErr, "Failed to stop cubefs client", "volumeId", volumeId)
+		}
+		return err
+	}
+	return nil
+}
+
+// stop terminates the client of the volume and forgets it, the client is
+// killed if it does not exit in time or ctx is done.
+func (s *clientSupervisor) stop(ctx context.Context, volumeId string) error {
+	s.mutex.Lock()
+	p, ok := s.clients[volumeId]
+	if !ok {
+		s.mutex.Unlock()
+		return nil
+	}
+	delete(s.clients, volumeId)
+	p.stopped = true
+	close(p.stopCh)
+	cmd, exited := p.cmd, p.exited
+	s.mutex.Unlock()
+
+	select {
+	case <-exited:
+	default:
+		klog.InfoS("Stopping cubefs client", "volumeId", volumeId, "pid", cmd.Process.Pid)
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(clientStopTimeout):
+		case <-ctx.Done():
+		}
+		select {
+		case <-exited:
+		default:
+			klog.InfoS("Killing cubefs client", "volumeId", volumeId, "pid", cmd.Process.Pid)
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+	}
+	<-p.done
+	return p.log.Close()
+}
+
+// launchLocked starts the client process of p.
+func (s *clientSupervisor) launchLocked(p *clientProcess) error {
+	cmd := clientCommand(p.info.ConfFile)
+	cmd.Stdout = p.log
+	cmd.Stderr = p.log
+	// the clients run in a session of their own, so neither signals sent to
+	// the driver's process group nor its exit stop them. They still belong
+	// to the driver container and stop with it, see the mount pod mode.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start cubefs client: %w", err)
+	}
+
+	exited := make(chan struct{})
+	p.cmd, p.exited = cmd, exited
+	p.info.PID = cmd.Process.Pid
+	p.info.StartTime = time.Now()
+	p.info.State = clientStateRunning
+	go func() {
+		err := cmd.Wait()
+		s.mutex.Lock()
+		p.exitErr = err
+		s.mutex.Unlock()
+		close(exited)
+	}()
+	klog.InfoS("Started cubefs client", "volumeId", p.info.VolumeId, "pid", p.info.PID, "logFile", p.info.LogFile)
+	return nil
+}
+
+// watch restarts the client of p whenever it exits, until p is stopped.
+func (s *clientSupervisor) watch(p *clientProcess) {
+	defer close(p.done)
+	for {
+		s.mutex.Lock()
+		exited := p.exited
+		s.mutex.Unlock()
+		select {
+		case <-p.stopCh:
+			return
+		case <-exited:
+		}
+
+		s.mutex.Lock()
+		if p.stopped {
+			s.mutex.Unlock()
+			return
+		}
+		ran := time.Since(p.info.StartTime)
+		if ran > clientBackoffReset {
+			p.backoff = clientBackoffMin
+		}
+		p.info.State = clientStateBackoff
+		p.info.PID = 0
+		p.info.LastExit = describeExit(p.exitErr, p.info.StartTime)
+		klog.ErrorS(p.exitErr, "Cubefs client exited, restarting", "volumeId", p.info.VolumeId,
+			"ran", ran, "backoff", p.backoff, "logFile", p.info.LogFile)
+		s.mutex.Unlock()
+
+		for {
+			s.mutex.Lock()
+			delay := p.backoff
+			p.backoff = min(2*p.backoff, clientBackoffMax)
+			s.mutex.Unlock()
+			select {
+			case <-p.stopCh:
+				return
+			case <-time.After(delay):
+			}
+			err := s.restart(p)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, errClientStopped) {
+				return
+			}
+			klog.ErrorS(err, "Failed to restart cubefs client", "volumeId", p.info.VolumeId)
+		}
+	}
+}
+
+// restart starts the client of p again on its mount point, which is left
+// corrupted by the crashed client.
+func (s *clientSupervisor) restart(p *clientProcess) error {
+	mountPath := p.info.MountPath
+	if err := unmountStale(s.mounter, mountPath); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	if p.stopped {
+		s.mutex.Unlock()
+		return errClientStopped
+	}
+	if err := s.launchLocked(p); err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	p.info.Restarts++
+	cmd, exited := p.cmd, p.exited
+	s.mutex.Unlock()
+
+	if err := s.waitMounted(context.Background(), p, exited); err != nil {
+		_ = cmd.Process.Kill()
+		<-exited
+		s.mutex.Lock()
+		p.info.State = clientStateBackoff
+		p.info.PID = 0
+		p.info.LastExit = describeExit(p.exitErr, p.info.StartTime)
+		s.mutex.Unlock()
+		return err
+	}
+	klog.InfoS("Restarted cubefs client", "volumeId", p.info.VolumeId, "mountPath", mountPath)
+	if s.onRestart != nil {
+		go s.onRestart(p.info.VolumeId, mountPath)
+	}
+	return nil
+}
+
+// waitMounted waits for the client to mount the volume until ctx is done or
+// clientMountTimeout, failing as soon as the client exits.
+func (s *clientSupervisor) waitMounted(ctx context.Context, p *clientProcess, exited chan struct{}) error {
+	start := time.Now()
+	err := wait.PollUntilContextTimeout(ctx, clientPollInterval, clientMountTimeout, true, func(ctx context.Context) (bool, error) {
+		select {
+		case <-exited:
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return false, status.Errorf(codes.Internal, "cubefs client exited before mounting: %v, see %s", p.exitErr, p.info.LogFile)
+		default:
+		}
+		isMnt, err := isClientMounted(p.info.MountPath)
+		return err == nil && isMnt, nil
+	})
+	if wait.Interrupted(err) {
+		return status.Errorf(codes.DeadlineExceeded, "volume not mounted at %s by cubefs client after %v, see %s",
+			p.info.MountPath, time.Since(start).Round(time.Second), p.info.LogFile)
+	}
+	return err
+}
+
+func describeExit(err error, startTime time.Time) string {
+	if err == nil {
+		err = errors.New("exit status 0")
+	}
+	return fmt.Sprintf("%v at %s after %v", err, time.Now().Format(time.RFC3339), time.Since(startTime).Round(time.Second))
+}
+
+// processes returns the debug view of every supervised client.
+func (s *clientSupervisor) processes() []clientProcessInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	infos := make([]clientProcessInfo, 0, len(s.clients))
+	for _, p := range s.clients {
+		infos = append(infos, p.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].VolumeId < infos[j].VolumeId })
+	return infos
+}
+
+func (s *clientSupervisor) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.processes()); err != nil {
+		klog.ErrorS(err, "Failed to write client process table")
+	}
+}
+
+// readClientConfForDebug reads a client config with the owner, which is the
+// volume's credential, redacted.
+func readClientConfForDebug(confFile string) map[string]string {
+	data, err := os.ReadFile(confFile)
+	if err != nil {
+		return nil
+	}
+	conf := make(map[string]string)
+	if err = json.Unmarshal(data, &conf); err != nil {
+		return nil
+	}
+	if _, ok := conf[KOwner]; ok {
+		conf[KOwner] = redactedConfigValue
+	}
+	return conf
+}
@@ -0,0 +1,268 @@
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testClientScript stands in for cfs-client: it records a mount of its mount
+// point in the test mount table and runs until it is signaled. Clients of
+// mount points named "broken" exit at once, "hung" ones never mount and
+// "stubborn" ones ignore SIGTERM.
+const testClientScript = `#!/bin/sh
+mp=$(sed -n 's/.*"mountPoint": *"\([^"]*\)".*/\1/p' "$3")
+echo "client starting on $mp"
+case "$(basename "$mp")" in
+broken) exit 1 ;;
+hung) exec sleep 600 ;;
+stubborn) trap '' TERM ;;
+esac
+echo "1 0 0:1 / $mp rw - fuse.cubefs cubefs rw" >> "$MOUNTINFO"
+while true; do sleep 0.1; done
+`
+
+// useTestClient runs the test client script instead of cfs-client and points
+// the mount table at the one the script writes.
+func useTestClient(t *testing.T) {
+	t.Helper()
+	dir := useTestLayout(t)
+	layout.clientBin = filepath.Join(dir, "cfs-client")
+	writeFile(t, layout.clientBin, testClientScript)
+	if err := os.Chmod(layout.clientBin, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mountInfo := filepath.Join(dir, "mountinfo")
+	writeFile(t, mountInfo, "")
+	saved := procMountInfoPath
+	procMountInfoPath = mountInfo
+	t.Cleanup(func() { procMountInfoPath = saved })
+	t.Setenv("MOUNTINFO", mountInfo)
+}
+
+func newTestSupervisor(t *testing.T, onRestart func(volumeId, mountPath string)) *clientSupervisor {
+	t.Helper()
+	s := newClientSupervisor(onRestart)
+	s.mounter = &fakeMounter{mountPoints: make(map[string]error)}
+	t.Cleanup(func() {
+		for _, info := range s.processes() {
+			_ = s.stop(context.Background(), info.VolumeId)
+		}
+	})
+	return s
+}
+
+// writeTestClientConf persists the client config of a volume mounted at mountPath.
+func writeTestClientConf(t *testing.T, volumeId, mountPath string) {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{KMountPoint: mountPath, KVolumeName: volumeId, KOwner: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, clientConfFilePath(volumeId), string(data))
+}
+
+func TestClientSupervisorStartStop(t *testing.T) {
+	useTestClient(t)
+	s := newTestSupervisor(t, nil)
+	mountPath := filepath.Join(t.TempDir(), "pvc-a")
+	writeTestClientConf(t, "pvc-a", mountPath)
+
+	if err := s.start(context.Background(), "pvc-a", mountPath); err != nil {
+		t.Fatalf("start() = %v", err)
+	}
+	infos := s.processes()
+	if len(infos) != 1 || infos[0].State != clientStateRunning || infos[0].PID == 0 {
+		t.Fatalf("processes() = %+v, want one running client", infos)
+	}
+	if infos[0].Config[KOwner] != redactedConfigValue {
+		t.Errorf("process config owner = %q, want it redacted", infos[0].Config[KOwner])
+	}
+	pid := infos[0].PID
+	// the client outlives the driver process and its process group
+	if sid, err := unix.Getsid(pid); err != nil || sid != pid {
+		t.Errorf("session of client %d = %d, %v, want a session of its own", pid, sid, err)
+	}
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest("GET", "/clients", nil))
+	var served []clientProcessInfo
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil || len(served) != 1 || served[0].VolumeId != "pvc-a" {
+		t.Errorf("ServeHTTP() = %s, %v, want the client of pvc-a", recorder.Body.String(), err)
+	}
+
+	if err := s.stop(context.Background(), "pvc-a"); err != nil {
+		t.Fatalf("stop() = %v", err)
+	}
+	if infos = s.processes(); len(infos) != 0 {
+		t.Errorf("processes() after stop = %+v, want none", infos)
+	}
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Errorf("client %d still running after stop", pid)
+	}
+	// stopping an unknown client does nothing
+	if err := s.stop(context.Background(), "pvc-a"); err != nil {
+		t.Errorf("stop() again = %v", err)
+	}
+}
+
+func TestClientSupervisorStartFails(t *testing.T) {
+	useTestClient(t)
+	s := newTestSupervisor(t, nil)
+	mountPath := filepath.Join(t.TempDir(), "broken")
+	writeTestClientConf(t, "pvc-broken", mountPath)
+
+	err := s.start(context.Background(), "pvc-broken", mountPath)
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("start() of a client exiting before the mount = %v, want Internal", err)
+	}
+	if infos := s.processes(); len(infos) != 0 {
+		t.Errorf("processes() after a failed start = %+v, want none", infos)
+	}
+}
+
+func TestClientSupervisorRestartsCrashedClient(t *testing.T) {
+	useTestClient(t)
+	restarted := make(chan string, 1)
+	s := newTestSupervisor(t, func(volumeId, mountPath string) { restarted <- volumeId })
+	mountPath := filepath.Join(t.TempDir(), "pvc-a")
+	writeTestClientConf(t, "pvc-a", mountPath)
+
+	if err := s.start(context.Background(), "pvc-a", mountPath); err != nil {
+		t.Fatalf("start() = %v", err)
+	}
+	if err := syscall.Kill(s.processes()[0].PID, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case volumeId := <-restarted:
+		if volumeId != "pvc-a" {
+			t.Errorf("restarted volume = %q, want pvc-a", volumeId)
+		}
+	case <-time.After(clientBackoffMin + 10*time.Second):
+		t.Fatal("crashed client not restarted")
+	}
+	info := s.processes()[0]
+	if info.Restarts != 1 || info.State != clientStateRunning || info.LastExit == "" {
+		t.Errorf("process after restart = %+v, want running with one restart and the last exit", info)
+	}
+}
+
+func TestClientSupervisorStopDuringBackoff(t *testing.T) {
+	useTestClient(t)
+	var restarts atomic.Int32
+	s := newTestSupervisor(t, func(volumeId, mountPath string) { restarts.Add(1) })
+	mountPath := filepath.Join(t.TempDir(), "pvc-a")
+	writeTestClientConf(t, "pvc-a", mountPath)
+
+	if err := s.start(context.Background(), "pvc-a", mountPath); err != nil {
+		t.Fatalf("start() = %v", err)
+	}
+	if err := syscall.Kill(s.processes()[0].PID, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	// the client is waiting for its restart
+	if err := waitFor(func() bool { return s.processes()[0].State == clientStateBackoff }); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.stop(context.Background(), "pvc-a"); err != nil {
+		t.Fatalf("stop() = %v", err)
+	}
+	time.Sleep(clientBackoffMin + 500*time.Millisecond)
+	if n := restarts.Load(); n != 0 {
+		t.Errorf("stopped client restarted %d times", n)
+	}
+}
+
+// waitFor polls condition for a few seconds.
+func waitFor(condition func() bool) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return context.DeadlineExceeded
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestClientSupervisorStartTimesOut(t *testing.T) {
+	useTestClient(t)
+	s := newTestSupervisor(t, nil)
+	mountPath := filepath.Join(t.TempDir(), "hung")
+	writeTestClientConf(t, "pvc-hung", mountPath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.start(ctx, "pvc-hung", mountPath)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("start() of a client which never mounts = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > clientStopTimeout {
+		t.Errorf("start() returned after %v, want it bound by the request deadline", elapsed)
+	}
+	if infos := s.processes(); len(infos) != 0 {
+		t.Errorf("processes() after the timeout = %+v, want the client stopped", infos)
+	}
+}
+
+func TestClientSupervisorStopKillsOnCancel(t *testing.T) {
+	useTestClient(t)
+	s := newTestSupervisor(t, nil)
+	mountPath := filepath.Join(t.TempDir(), "stubborn")
+	writeTestClientConf(t, "pvc-stubborn", mountPath)
+	if err := s.start(context.Background(), "pvc-stubborn", mountPath); err != nil {
+		t.Fatalf("start() = %v", err)
+	}
+	pid := s.processes()[0].PID
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.stop(ctx, "pvc-stubborn"); err != nil {
+		t.Fatalf("stop() = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > clientStopTimeout/2 {
+		t.Errorf("stop() returned after %v, want the client killed once ctx is done", elapsed)
+	}
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Errorf("client %d still running after stop", pid)
+	}
+}
+
+func TestIsClientMounted(t *testing.T) {
+	useTestClient(t)
+	writeFile(t, procMountInfoPath, "1 0 0:1 / /var/lib/cubefs/mnt/pvc-a rw - fuse.cubefs cubefs rw\n")
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/var/lib/cubefs/mnt/pvc-a", true},
+		{"/var/lib/cubefs/mnt/pvc-a/", true},
+		{"/var/lib/cubefs/mnt/pvc-b", false},
+		{"/var/lib/cubefs/mnt", false},
+	}
+	for _, tt := range tests {
+		if got, err := isClientMounted(tt.path); err != nil || got != tt.want {
+			t.Errorf("isClientMounted(%q) = %v, %v, want %v", tt.path, got, err, tt.want)
+		}
+	}
+
+	procMountInfoPath = filepath.Join(t.TempDir(), "missing")
+	if _, err := isClientMounted("/var/lib/cubefs/mnt/pvc-a"); err == nil {
+		t.Error("isClientMounted() without a mount table = nil error")
+	}
+}
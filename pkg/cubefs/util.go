@@ -2,17 +2,35 @@ package cubefs
 
 import (
 	"os/exec"
+	"path/filepath"
 
-	"k8s.io/klog/v2"
+	mountutils "k8s.io/mount-utils"
 )
 
 const (
+	// CfsClientBin is the default cubefs client of the node and the client of the mount pod images
 	CfsClientBin = "/cfs/bin/cfs-client"
 )
 
-func MountVolume(configFilePath string) error {
-	cmd := exec.Command(CfsClientBin, "-c", configFilePath)
-	output, err := cmd.CombinedOutput()
-	klog.InfoS("Cfs Client bin run output", "output", output)
-	return err
+// clientCommand runs the cubefs client in the foreground, it exits when the
+// volume is unmounted. The client outlives the request which launched it, so
+// the command is not bound to a context, callers stop it on timeout.
+func clientCommand(configFilePath string) *exec.Cmd {
+	return exec.Command(layout.clientBin, "-f", "-c", configFilePath)
+}
+
+// isClientMounted reports whether something is mounted at mountPath. It reads
+// the mount table rather than stat the path, which blocks on a hung client.
+func isClientMounted(mountPath string) (bool, error) {
+	mountInfos, err := mountutils.ParseMountInfo(procMountInfoPath)
+	if err != nil {
+		return false, err
+	}
+	mountPath = filepath.Clean(mountPath)
+	for _, info := range mountInfos {
+		if info.MountPoint == mountPath {
+			return true, nil
+		}
+	}
+	return false, nil
 }
@@ -7,6 +7,42 @@ func ValidateDriverOptions(options *Options) error {
 		return fmt.Errorf("Invalid mode: %w", err)
 	}
 
+	if err := validateMasterLimits(options.MasterLimits); err != nil {
+		return fmt.Errorf("Invalid master limits: %w", err)
+	}
+
+	if options.VolumeReadyTimeout > 0 && options.MinWritableDataPartitions < 1 {
+		return fmt.Errorf("Invalid min writable data partitions: must be at least 1 (actual: %d)", options.MinWritableDataPartitions)
+	}
+
+	if err := validateMountMode(options); err != nil {
+		return fmt.Errorf("Invalid mount mode: %w", err)
+	}
+
+	if err := validateVolumeLimitOptions(options); err != nil {
+		return fmt.Errorf("Invalid volume limit: %w", err)
+	}
+
+	if err := validateLayoutOptions(options); err != nil {
+		return fmt.Errorf("Invalid node layout: %w", err)
+	}
+
+	if _, err := loadNodeClientConfig(options.ClientConfigFile); err != nil {
+		return fmt.Errorf("Invalid client config: %w", err)
+	}
+
+	if _, err := parseNamespaces("ephemeral allowed namespaces", options.EphemeralAllowedNamespaces); err != nil {
+		return fmt.Errorf("Invalid ephemeral allowed namespaces: %w", err)
+	}
+
+	if options.ShutdownGracePeriod <= 0 {
+		return fmt.Errorf("Invalid shutdown grace period: must be positive (actual: %v)", options.ShutdownGracePeriod)
+	}
+
+	if options.NodeMaxConcurrentOperations < 1 {
+		return fmt.Errorf("Invalid node max concurrent operations: must be at least 1 (actual: %d)", options.NodeMaxConcurrentOperations)
+	}
+
 	return nil
 }
 
@@ -17,3 +53,28 @@ func validateMode(mode Mode) error {
 
 	return nil
 }
+
+func validateMasterLimits(limits MasterLimits) error {
+	if limits.QPS > 0 && limits.Burst < 1 {
+		return fmt.Errorf("Burst must be at least 1 when QPS is limited (actual: %d)", limits.Burst)
+	}
+
+	return nil
+}
+
+func validateMountMode(options *Options) error {
+	switch options.MountMode {
+	case ProcessMountMode:
+	case PodMountMode:
+		if options.MountPodImage == "" || options.MountPodNamespace == "" {
+			return fmt.Errorf("Mount pod image and namespace are required in %s mode", PodMountMode)
+		}
+		if options.MountPodTimeout <= 0 {
+			return fmt.Errorf("Mount pod timeout must be positive (actual: %v)", options.MountPodTimeout)
+		}
+	default:
+		return fmt.Errorf("Mount mode is not supported (actual: %s, supported: %v)", options.MountMode, []MountMode{ProcessMountMode, PodMountMode})
+	}
+
+	return nil
+}
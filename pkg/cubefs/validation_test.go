@@ -0,0 +1,51 @@
+package cubefs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func validOptions() *Options {
+	return &Options{
+		Mode:                        NodeMode,
+		MountMode:                   ProcessMountMode,
+		ShutdownGracePeriod:         20 * time.Second,
+		NodeMaxConcurrentOperations: 16,
+	}
+}
+
+func TestValidateDriverOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(o *Options)
+		wantErr string
+	}{
+		{"valid", func(o *Options) {}, ""},
+		{"unknown mode", func(o *Options) { o.Mode = "edge" }, "Invalid mode"},
+		{"burst without qps", func(o *Options) { o.MasterLimits = MasterLimits{QPS: 10} }, "Invalid master limits"},
+		{"pod mode without image", func(o *Options) { o.MountMode = PodMountMode }, "Invalid mount mode"},
+		{"negative volume limit", func(o *Options) { o.NodeMaxVolumes = -1 }, "Invalid volume limit"},
+		{"relative kubelet dir", func(o *Options) { o.KubeletDir = "kubelet" }, "Invalid node layout"},
+		{"bad inline namespace", func(o *Options) { o.EphemeralAllowedNamespaces = []string{"Team-A"} }, "Invalid ephemeral allowed namespaces"},
+		{"zero grace period", func(o *Options) { o.ShutdownGracePeriod = 0 }, "Invalid shutdown grace period"},
+		{"negative grace period", func(o *Options) { o.ShutdownGracePeriod = -time.Second }, "Invalid shutdown grace period"},
+		{"no concurrent operations", func(o *Options) { o.NodeMaxConcurrentOperations = 0 }, "Invalid node max concurrent operations"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := validOptions()
+			tt.modify(opts)
+			err := ValidateDriverOptions(opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ValidateDriverOptions() err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package cubefs
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	// KReadOnly is the cubefs client option mounting the volume read-only
+	KReadOnly = "rdonly"
+)
+
+// volumeAccessModes are the access modes of the driver's volumes, a CubeFS
+// volume can be mounted read-write on any number of nodes.
+var volumeAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+}
+
+// validateVolumeCapabilities checks that the volume capabilities only ask for
+// filesystem volumes in a supported access mode.
+func validateVolumeCapabilities(caps []*csi.VolumeCapability) error {
+	if len(caps) == 0 {
+		return fmt.Errorf("volume capabilities missing")
+	}
+	for _, c := range caps {
+		if err := validateVolumeCapability(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateVolumeCapability(c *csi.VolumeCapability) error {
+	if c.GetBlock() != nil {
+		return fmt.Errorf("block volumes are not supported")
+	}
+	if c.GetMount() == nil {
+		return fmt.Errorf("volume capability has no mount access type")
+	}
+	if _, err := parseMountFlags(c.GetMount().GetMountFlags()); err != nil {
+		return err
+	}
+	mode := c.GetAccessMode().GetMode()
+	for _, supported := range volumeAccessModes {
+		if mode == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("access mode %s is not supported", mode)
+}
+
+// isReadOnlyAccessMode reports whether the volume capability only allows reads.
+func isReadOnlyAccessMode(c *csi.VolumeCapability) bool {
+	switch c.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	badFlags := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	badFlags.GetMount().MountFlags = []string{"unknownflag"}
+
+	tests := []struct {
+		name    string
+		caps    []*csi.VolumeCapability
+		wantErr string
+	}{
+		{"multi node writer", []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}, ""},
+		{"read only many", []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)}, ""},
+		{"none", nil, "volume capabilities missing"},
+		{"block", []*csi.VolumeCapability{block}, "block volumes are not supported"},
+		{"no access type", []*csi.VolumeCapability{{AccessMode: block.AccessMode}}, "no mount access type"},
+		{"unknown access mode", []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_UNKNOWN)}, "access mode UNKNOWN is not supported"},
+		{"bad mount flags", []*csi.VolumeCapability{badFlags}, "unknownflag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateVolumeCapabilities(tt.caps)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateVolumeCapabilities() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateVolumeCapabilities() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsReadOnlyAccessMode(t *testing.T) {
+	for _, mode := range volumeAccessModes {
+		want := mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+			mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+		if got := isReadOnlyAccessMode(mountCapability(mode)); got != want {
+			t.Errorf("isReadOnlyAccessMode(%s) = %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestNodeReadOnlyVolume(t *testing.T) {
+	ctx := context.Background()
+	n, _, _ := newTestNodeService(t)
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "globalmount")
+	volumeContext := map[string]string{KMasterAddr: "127.0.0.1:17010", KVolumeName: "pvc-a"}
+
+	_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-a",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+		VolumeContext:     volumeContext,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	data, err := os.ReadFile(clientConfFilePath("pvc-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := make(map[string]string)
+	if err = json.Unmarshal(data, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf[KReadOnly] != "true" {
+		t.Errorf("client config %s = %q, want the client mounting read-only", KReadOnly, conf[KReadOnly])
+	}
+
+	// either way of asking for a read-only publish makes the bind mount read-only
+	tests := []struct {
+		name     string
+		mode     csi.VolumeCapability_AccessMode_Mode
+		readonly bool
+	}{
+		{"read only access mode", csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, false},
+		{"readonly flag", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-"))
+			_, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+				VolumeId:          "pvc-a",
+				StagingTargetPath: stagingPath,
+				TargetPath:        target,
+				VolumeCapability:  mountCapability(tt.mode),
+				Readonly:          tt.readonly,
+				VolumeContext:     volumeContext,
+			})
+			if err != nil {
+				t.Fatalf("NodePublishVolume: %v", err)
+			}
+			if options := n.refs.targetBind("pvc-a", target).options; !slices.Contains(options, "ro") {
+				t.Errorf("bind mount options = %v, want ro", options)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package cubefs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// nodeVolumeLimit is the most volumes the node stages, every one costs a cubefs
+// client. It is the configured limit, or the allocatable memory of the node
+// divided by the memory a client is estimated to use, whichever is lower.
+type nodeVolumeLimit struct {
+	mutex sync.Mutex
+	// limit is set once it is computed, zero is no limit
+	limit *int64
+}
+
+// volumeLimit returns the volume limit of the node, computing it on first use.
+func (n *NodeService) volumeLimit(ctx context.Context) (int64, error) {
+	n.maxVolumes.mutex.Lock()
+	defer n.maxVolumes.mutex.Unlock()
+	if n.maxVolumes.limit != nil {
+		return *n.maxVolumes.limit, nil
+	}
+
+	limit := n.options.NodeMaxVolumes
+	if n.options.ClientMemoryEstimate != "" {
+		estimate, err := resource.ParseQuantity(n.options.ClientMemoryEstimate)
+		if err != nil {
+			return 0, err
+		}
+		node, err := n.ClientSet.CoreV1().Nodes().Get(ctx, n.NodeId, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("get node %s: %w", n.NodeId, err)
+		}
+		allocatable := node.Status.Allocatable.Memory()
+		// a node too small for one client still gets one, zero would be no limit
+		byMemory := max(allocatable.Value()/estimate.Value(), 1)
+		if limit == 0 || byMemory < limit {
+			limit = byMemory
+		}
+		klog.InfoS("Computed the volume limit of the node", "allocatableMemory", allocatable, "clientMemory", estimate, "limit", limit)
+	}
+	n.maxVolumes.limit = &limit
+	return limit, nil
+}
+
+// reserveClient counts a volume about to be mounted against the volume limit
+// of the node, it fails with ResourceExhausted when the node is full. The
+// reservation ends when the volume is mounted or with unreserve.
+func (n *NodeService) reserveClient(ctx context.Context, volumeId string) error {
+	limit, err := n.volumeLimit(ctx)
+	if err != nil {
+		// the configured limit still applies until the node limit can be computed
+		klog.ErrorS(err, "Failed to compute the volume limit of the node, using the configured one")
+		limit = n.options.NodeMaxVolumes
+	}
+	if !n.refs.reserve(volumeId, limit) {
+		return status.Errorf(codes.ResourceExhausted, "node %s already mounts %d volumes, the most it may", n.NodeId, limit)
+	}
+	return nil
+}
+
+// validateVolumeLimitOptions checks the per node volume limit options.
+func validateVolumeLimitOptions(opts *Options) error {
+	if opts.NodeMaxVolumes < 0 {
+		return fmt.Errorf("max volumes per node must not be negative (actual: %d)", opts.NodeMaxVolumes)
+	}
+	if opts.ClientMemoryEstimate == "" {
+		return nil
+	}
+	estimate, err := resource.ParseQuantity(opts.ClientMemoryEstimate)
+	if err != nil {
+		return fmt.Errorf("invalid client memory estimate %q: %w", opts.ClientMemoryEstimate, err)
+	}
+	if estimate.Sign() <= 0 {
+		return fmt.Errorf("client memory estimate must be positive (actual: %s)", opts.ClientMemoryEstimate)
+	}
+	return nil
+}
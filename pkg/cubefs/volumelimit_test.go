@@ -0,0 +1,153 @@
+package cubefs
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testNode(name, memory string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse(memory)},
+		},
+	}
+}
+
+func TestVolumeLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxVolumes int64
+		estimate   string
+		memory     string
+		want       int64
+		wantErr    bool
+	}{
+		{name: "no limit", want: 0},
+		{name: "configured", maxVolumes: 20, want: 20},
+		{name: "by memory", estimate: "512Mi", memory: "8Gi", want: 16},
+		{name: "configured is lower", maxVolumes: 10, estimate: "512Mi", memory: "8Gi", want: 10},
+		{name: "memory is lower", maxVolumes: 100, estimate: "1Gi", memory: "8Gi", want: 8},
+		{name: "small node", estimate: "1Gi", memory: "512Mi", want: 1},
+		{name: "node not found", estimate: "1Gi", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, _, _ := newTestNodeService(t)
+			if tt.memory != "" {
+				n.ClientSet = fake.NewSimpleClientset(testNode(n.NodeId, tt.memory))
+			}
+			n.options.NodeMaxVolumes = tt.maxVolumes
+			n.options.ClientMemoryEstimate = tt.estimate
+
+			got, err := n.volumeLimit(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("volumeLimit() = %d, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("volumeLimit() = %d, %v, want %d", got, err, tt.want)
+			}
+			// the limit is computed once
+			n.ClientSet = fake.NewSimpleClientset()
+			if again, err := n.volumeLimit(context.Background()); err != nil || again != got {
+				t.Errorf("volumeLimit() again = %d, %v, want %d", again, err, got)
+			}
+		})
+	}
+}
+
+func TestNodeGetInfoMaxVolumes(t *testing.T) {
+	n, _, _ := newTestNodeService(t)
+	n.ClientSet = fake.NewSimpleClientset(testNode(n.NodeId, "4Gi"))
+	n.options.ClientMemoryEstimate = "1Gi"
+
+	resp, err := n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MaxVolumesPerNode != 4 {
+		t.Errorf("NodeGetInfo() MaxVolumesPerNode = %d, want 4", resp.MaxVolumesPerNode)
+	}
+
+	// the node is not registered until the limit is known
+	n, _, _ = newTestNodeService(t)
+	n.options.ClientMemoryEstimate = "1Gi"
+	if _, err = n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("NodeGetInfo() without the node = %v, want Unavailable", err)
+	}
+}
+
+func TestNodeStageVolumeLimit(t *testing.T) {
+	ctx := context.Background()
+	n, _, _ := newTestNodeService(t)
+	n.options.NodeMaxVolumes = 1
+	dir := t.TempDir()
+	stage := func(volumeId string) error {
+		_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeId,
+			StagingTargetPath: filepath.Join(dir, volumeId),
+			VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			VolumeContext:     map[string]string{KMasterAddr: "127.0.0.1:17010"},
+		})
+		return err
+	}
+
+	if err := stage("pvc-a"); err != nil {
+		t.Fatalf("NodeStageVolume(pvc-a) = %v", err)
+	}
+	// staging a staged volume again does not need another client
+	if err := stage("pvc-a"); err != nil {
+		t.Fatalf("NodeStageVolume(pvc-a) again = %v", err)
+	}
+	if err := stage("pvc-b"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("NodeStageVolume(pvc-b) over the limit = %v, want ResourceExhausted", err)
+	}
+
+	if _, err := n.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "pvc-a", StagingTargetPath: filepath.Join(dir, "pvc-a")}); err != nil {
+		t.Fatalf("NodeUnstageVolume(pvc-a) = %v", err)
+	}
+	if err := stage("pvc-b"); err != nil {
+		t.Fatalf("NodeStageVolume(pvc-b) after unstaging pvc-a = %v", err)
+	}
+}
+
+func TestValidateVolumeLimitOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr string
+	}{
+		{name: "defaults", opts: Options{}},
+		{name: "valid", opts: Options{NodeMaxVolumes: 50, ClientMemoryEstimate: "512Mi"}},
+		{name: "negative", opts: Options{NodeMaxVolumes: -1}, wantErr: "must not be negative"},
+		{name: "invalid estimate", opts: Options{ClientMemoryEstimate: "lots"}, wantErr: "invalid client memory estimate"},
+		{name: "zero estimate", opts: Options{ClientMemoryEstimate: "0"}, wantErr: "must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateVolumeLimitOptions(&tt.opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateVolumeLimitOptions() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateVolumeLimitOptions() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
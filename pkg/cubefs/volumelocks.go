@@ -0,0 +1,60 @@
+package cubefs
+
+import (
+	"context"
+	"sync"
+)
+
+// volumeLocks serializes the operations on each volume of the node, while
+// operations on different volumes run concurrently.
+type volumeLocks struct {
+	mutex sync.Mutex
+	// locks holds a channel per locked volume, closed when the lock is released
+	locks map[string]chan struct{}
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{
+		locks: make(map[string]chan struct{}),
+	}
+}
+
+// tryAcquire locks the volume unless an operation already holds it.
+func (l *volumeLocks) tryAcquire(volumeId string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.locks[volumeId]; ok {
+		return false
+	}
+	l.locks[volumeId] = make(chan struct{})
+	return true
+}
+
+// acquire waits for the volume lock, for background work which must not be dropped.
+func (l *volumeLocks) acquire(ctx context.Context, volumeId string) error {
+	for {
+		l.mutex.Lock()
+		released, ok := l.locks[volumeId]
+		if !ok {
+			l.locks[volumeId] = make(chan struct{})
+			l.mutex.Unlock()
+			return nil
+		}
+		l.mutex.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *volumeLocks) release(volumeId string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if released, ok := l.locks[volumeId]; ok {
+		close(released)
+		delete(l.locks, volumeId)
+	}
+}
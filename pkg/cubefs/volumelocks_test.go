@@ -0,0 +1,93 @@
+package cubefs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeLocksTryAcquire(t *testing.T) {
+	l := newVolumeLocks()
+	if !l.tryAcquire("pvc-a") {
+		t.Fatal("tryAcquire() of a free volume = false")
+	}
+	if l.tryAcquire("pvc-a") {
+		t.Error("tryAcquire() of a locked volume = true")
+	}
+	if !l.tryAcquire("pvc-b") {
+		t.Error("tryAcquire() of another volume = false, want volumes locked independently")
+	}
+	l.release("pvc-a")
+	if !l.tryAcquire("pvc-a") {
+		t.Error("tryAcquire() after release = false")
+	}
+	// releasing an unlocked volume does nothing
+	l.release("pvc-c")
+}
+
+func TestVolumeLocksAcquire(t *testing.T) {
+	l := newVolumeLocks()
+	l.tryAcquire("pvc-a")
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- l.acquire(context.Background(), "pvc-a") }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquire() of a locked volume returned %v before the release", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.release("pvc-a")
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("acquire() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire() did not return after the release")
+	}
+	if l.tryAcquire("pvc-a") {
+		t.Error("tryAcquire() after acquire = true, want the volume locked")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx, "pvc-a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire() until the deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestBeginOperation(t *testing.T) {
+	n, _, _ := newTestNodeService(t)
+	n.opSlots = make(chan struct{}, 1)
+	n.options.NodeOperationTimeout = 100 * time.Millisecond
+
+	ctx, done, err := n.beginOperation(context.Background(), "pvc-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		t.Error("operation context has no deadline, want the node operation timeout")
+	}
+	if _, _, err = n.beginOperation(context.Background(), "pvc-a"); status.Code(err) != codes.Aborted {
+		t.Errorf("beginOperation() on a busy volume = %v, want Aborted", err)
+	}
+	// the only slot is taken, the operation gives up at the timeout and unlocks its volume
+	if _, _, err = n.beginOperation(context.Background(), "pvc-b"); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("beginOperation() without a free slot = %v, want DeadlineExceeded", err)
+	}
+	if !n.volumeLocks.tryAcquire("pvc-b") {
+		t.Error("volume of the timed out operation is still locked")
+	}
+	n.volumeLocks.release("pvc-b")
+
+	done()
+	_, done, err = n.beginOperation(context.Background(), "pvc-b")
+	if err != nil {
+		t.Fatalf("beginOperation() after done = %v", err)
+	}
+	done()
+}
@@ -0,0 +1,483 @@
+package fakemaster
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Reply codes, the subset of proto/admin_proto.go the emulator produces.
+const (
+	CodeSuccess              = 0
+	CodeParamError           = 2
+	CodeVolNotExists         = 7
+	CodeDuplicateVol         = 12
+	CodeNoDataNodeToCreateDp = 24
+	CodeVolAuthKeyNotMatch   = 32
+)
+
+const (
+	defaultDataPartitionCount = 10
+	defaultMetaPartitionCount = 3
+	defaultClusterCapacityGB  = 1024
+	shutdownGracePeriod       = 5 * time.Second
+	volNameRegexp             = "^[a-zA-Z0-9][a-zA-Z0-9_.-]{1,61}[a-zA-Z0-9]$"
+	volStatusNormal           = 0
+	stateFileMode             = 0644
+	faultPath                 = "/fake/faults"
+	// a CubeFS follower answers 403 with the leader address as body
+	leaderRedirectStatus = http.StatusForbidden
+)
+
+var volNameRe = regexp.MustCompile(volNameRegexp)
+
+// Config of the emulator.
+type Config struct {
+	// Addrs are the listen addresses, the first one acts as the leader.
+	Addrs []string
+	// CapacityGB is the total space volumes can be created with.
+	CapacityGB uint64
+	// StateFile, if set, keeps the volumes across restarts.
+	StateFile string
+	// Version is reported on /version, a 2.x version disables the 3.x only
+	// endpoints and parameters, empty disables the endpoint like old masters.
+	Version string
+	// ReadyDelay is how long a new volume reports no writable data partitions.
+	ReadyDelay time.Duration
+	// Faults is the initial fault injection setting.
+	Faults Faults
+}
+
+// Faults controls the fault injection, it can be changed at runtime through
+// the /fake/faults endpoint.
+type Faults struct {
+	// Latency is added to every request.
+	Latency time.Duration `json:"latency"`
+	// ErrorCode is returned instead of serving the request, with ErrorRate probability.
+	ErrorCode int     `json:"errorCode"`
+	ErrorRate float64 `json:"errorRate"`
+	// Paths restricts the injected errors to these endpoints, empty means all.
+	Paths []string `json:"paths,omitempty"`
+	// RedirectFollowers makes the non-leader addresses answer with the leader
+	// address like a CubeFS follower does, instead of serving the request.
+	RedirectFollowers bool `json:"redirectFollowers"`
+}
+
+type reply struct {
+	Code int         `json:"code"`
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Volume is the state kept for every created volume.
+type Volume struct {
+	Name       string `json:"Name"`
+	Owner      string `json:"Owner"`
+	Capacity   uint64 `json:"Capacity"`
+	VolType    int    `json:"VolType"`
+	Status     uint8  `json:"Status"`
+	DpCnt      int    `json:"DpCnt"`
+	RwDpCnt    int    `json:"RwDpCnt"`
+	MpCnt      int    `json:"MpCnt"`
+	CreateTime string `json:"CreateTime"`
+}
+
+type volInfo struct {
+	Name       string `json:"Name"`
+	Owner      string `json:"Owner"`
+	CreateTime int64  `json:"CreateTime"`
+	Status     uint8  `json:"Status"`
+	TotalSize  uint64 `json:"TotalSize"`
+	UsedSize   uint64 `json:"UsedSize"`
+}
+
+type nodeStatInfo struct {
+	TotalGB   uint64 `json:"TotalGB"`
+	UsedGB    uint64 `json:"UsedGB"`
+	UsedRatio string `json:"UsedRatio"`
+}
+
+type clusterStatInfo struct {
+	DataNodeStatInfo *nodeStatInfo `json:"DataNodeStatInfo"`
+	MetaNodeStatInfo *nodeStatInfo `json:"MetaNodeStatInfo"`
+}
+
+type Server struct {
+	cfg     Config
+	mutex   sync.Mutex
+	faults  Faults
+	volumes map[string]*Volume
+	servers []*http.Server
+}
+
+func NewServer(cfg Config) (*Server, error) {
+	if len(cfg.Addrs) == 0 {
+		return nil, fmt.Errorf("at least one listen address is required")
+	}
+	if cfg.CapacityGB == 0 {
+		cfg.CapacityGB = defaultClusterCapacityGB
+	}
+
+	s := &Server{
+		cfg:     cfg,
+		faults:  cfg.Faults,
+		volumes: make(map[string]*Volume),
+	}
+	if err := s.loadState(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run serves every configured address until ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	leader := s.cfg.Addrs[0]
+	errCh := make(chan error, len(s.cfg.Addrs))
+	for _, addr := range s.cfg.Addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.shutdown()
+			return err
+		}
+		srv := &http.Server{Handler: s.handler(addr == leader, leader)}
+		s.servers = append(s.servers, srv)
+		klog.InfoS("Fake master listening", "address", listener.Addr(), "leader", addr == leader)
+		go func() {
+			if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		s.shutdown()
+		return nil
+	case err := <-errCh:
+		s.shutdown()
+		return err
+	}
+}
+
+func (s *Server) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	for _, srv := range s.servers {
+		_ = srv.Shutdown(ctx)
+	}
+}
+
+// Handler serves the requests as the leader, for tests serving the emulator
+// themselves.
+func (s *Server) Handler() http.Handler {
+	return s.handler(true, "")
+}
+
+func (s *Server) handler(isLeader bool, leader string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/createVol", s.createVol)
+	mux.HandleFunc("/vol/delete", s.deleteVol)
+	mux.HandleFunc("/admin/getVol", s.getVol)
+	if s.isV2() {
+		mux.HandleFunc("/vol/update", s.expandVol)
+	} else {
+		mux.HandleFunc("/vol/expand", s.expandVol)
+	}
+	if s.cfg.Version != "" {
+		mux.HandleFunc("/version", s.version)
+	}
+	mux.HandleFunc("/vol/list", s.listVols)
+	mux.HandleFunc("/cluster/stat", s.clusterStat)
+	mux.HandleFunc(faultPath, s.handleFaults)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		klog.V(4).InfoS("Fake master request", "leader", isLeader, "url", r.URL.String())
+		if r.URL.Path == faultPath {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		faults := s.currentFaults()
+		if faults.Latency > 0 {
+			time.Sleep(faults.Latency)
+		}
+		if !isLeader && faults.RedirectFollowers {
+			w.WriteHeader(leaderRedirectStatus)
+			_, _ = w.Write([]byte(leader))
+			return
+		}
+		if faults.ErrorCode != CodeSuccess && faults.matches(r.URL.Path) && rand.Float64() < faults.ErrorRate {
+			writeReply(w, faults.ErrorCode, "injected fault", nil)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (f Faults) matches(path string) bool {
+	if len(f.Paths) == 0 {
+		return true
+	}
+	for _, p := range f.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) currentFaults() Faults {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.faults
+}
+
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		faults := Faults{}
+		if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+			writeReply(w, CodeParamError, err.Error(), nil)
+			return
+		}
+		s.mutex.Lock()
+		s.faults = faults
+		s.mutex.Unlock()
+		klog.InfoS("Fake master faults updated", "faults", faults)
+	}
+	writeReply(w, CodeSuccess, "success", s.currentFaults())
+}
+
+func (s *Server) createVol(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name, owner := query.Get("name"), query.Get("owner")
+	if !volNameRe.MatchString(name) {
+		writeReply(w, CodeParamError, fmt.Sprintf("name can only be number and letters, invalid name[%v]", name), nil)
+		return
+	}
+	if owner == "" {
+		writeReply(w, CodeParamError, "parameter owner not found", nil)
+		return
+	}
+	capacity, err := strconv.ParseUint(query.Get("capacity"), 10, 64)
+	if err != nil || capacity == 0 {
+		writeReply(w, CodeParamError, fmt.Sprintf("invalid capacity[%v]", query.Get("capacity")), nil)
+		return
+	}
+	volType, _ := strconv.Atoi(query.Get("volType"))
+	if s.isV2() && query.Has("volType") {
+		writeReply(w, CodeParamError, "unknown parameter volType", nil)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.volumes[name]; ok {
+		writeReply(w, CodeDuplicateVol, "duplicate vol", nil)
+		return
+	}
+	if s.usedCapacityLocked()+capacity > s.cfg.CapacityGB {
+		writeReply(w, CodeNoDataNodeToCreateDp, "no enough data node for creating data partition", nil)
+		return
+	}
+
+	s.volumes[name] = &Volume{
+		Name:       name,
+		Owner:      owner,
+		Capacity:   capacity,
+		VolType:    volType,
+		Status:     volStatusNormal,
+		DpCnt:      defaultDataPartitionCount,
+		RwDpCnt:    defaultDataPartitionCount,
+		MpCnt:      defaultMetaPartitionCount,
+		CreateTime: time.Now().Format(time.DateTime),
+	}
+	s.saveStateLocked()
+	writeReply(w, CodeSuccess, "success",
+		fmt.Sprintf("create vol[%v] successfully, has allocate [%v] data partitions", name, defaultDataPartitionCount))
+}
+
+func (s *Server) deleteVol(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	vol, ok := s.authVolLocked(w, name, query.Get("authKey"))
+	if !ok {
+		return
+	}
+	delete(s.volumes, vol.Name)
+	s.saveStateLocked()
+	writeReply(w, CodeSuccess, "success", fmt.Sprintf("delete vol[%v] successfully,from[%v]", name, r.RemoteAddr))
+}
+
+func (s *Server) getVol(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	vol, ok := s.volumes[name]
+	if !ok {
+		writeReply(w, CodeVolNotExists, "vol not exists", nil)
+		return
+	}
+	view := *vol
+	createTime, _ := time.ParseInLocation(time.DateTime, vol.CreateTime, time.Local)
+	if time.Since(createTime) < s.cfg.ReadyDelay {
+		view.RwDpCnt = 0
+	}
+	writeReply(w, CodeSuccess, "success", &view)
+}
+
+func (s *Server) expandVol(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	capacity, err := strconv.ParseUint(query.Get("capacity"), 10, 64)
+	if err != nil {
+		writeReply(w, CodeParamError, fmt.Sprintf("invalid capacity[%v]", query.Get("capacity")), nil)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	vol, ok := s.authVolLocked(w, query.Get("name"), query.Get("authKey"))
+	if !ok {
+		return
+	}
+	if capacity <= vol.Capacity {
+		writeReply(w, CodeParamError,
+			fmt.Sprintf("expand capacity[%v] must be larger than current capacity[%v]", capacity, vol.Capacity), nil)
+		return
+	}
+	if s.usedCapacityLocked()-vol.Capacity+capacity > s.cfg.CapacityGB {
+		writeReply(w, CodeNoDataNodeToCreateDp, "no enough data node for creating data partition", nil)
+		return
+	}
+	vol.Capacity = capacity
+	s.saveStateLocked()
+	writeReply(w, CodeSuccess, "success", fmt.Sprintf("update vol[%v] successfully", vol.Name))
+}
+
+func (s *Server) listVols(w http.ResponseWriter, r *http.Request) {
+	keywords := r.URL.Query().Get("keywords")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	infos := make([]*volInfo, 0, len(s.volumes))
+	for _, vol := range s.volumes {
+		if !strings.Contains(vol.Name, keywords) {
+			continue
+		}
+		createTime, _ := time.ParseInLocation(time.DateTime, vol.CreateTime, time.Local)
+		infos = append(infos, &volInfo{
+			Name:       vol.Name,
+			Owner:      vol.Owner,
+			CreateTime: createTime.Unix(),
+			Status:     vol.Status,
+			TotalSize:  vol.Capacity << 30,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	writeReply(w, CodeSuccess, "success", infos)
+}
+
+// version answers like a CubeFS master, with the bare version info and no
+// reply envelope.
+func (s *Server) version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	body, _ := json.Marshal(map[string]string{
+		"Model":      "master",
+		"Version":    s.cfg.Version,
+		"CommitID":   "fake",
+		"BranchName": "fake",
+		"BuildTime":  "",
+	})
+	_, _ = w.Write(body)
+}
+
+func (s *Server) isV2() bool {
+	return s.cfg.Version == "" || strings.HasPrefix(strings.TrimPrefix(s.cfg.Version, "v"), "2.")
+}
+
+func (s *Server) clusterStat(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	used := s.usedCapacityLocked()
+	s.mutex.Unlock()
+
+	dataStat := &nodeStatInfo{TotalGB: s.cfg.CapacityGB, UsedGB: used}
+	dataStat.UsedRatio = strconv.FormatFloat(float64(used)/float64(s.cfg.CapacityGB), 'f', 3, 64)
+	writeReply(w, CodeSuccess, "success", &clusterStatInfo{
+		DataNodeStatInfo: dataStat,
+		MetaNodeStatInfo: &nodeStatInfo{TotalGB: s.cfg.CapacityGB, UsedRatio: "0.000"},
+	})
+}
+
+// authVolLocked looks the volume up and checks the authKey is the md5 of its
+// owner, writing the error reply if not.
+func (s *Server) authVolLocked(w http.ResponseWriter, name, authKey string) (*Volume, bool) {
+	vol, ok := s.volumes[name]
+	if !ok {
+		writeReply(w, CodeVolNotExists, "vol not exists", nil)
+		return nil, false
+	}
+	sum := md5.Sum([]byte(vol.Owner))
+	if authKey != hex.EncodeToString(sum[:]) {
+		writeReply(w, CodeVolAuthKeyNotMatch, "client and server auth key do not match", nil)
+		return nil, false
+	}
+	return vol, true
+}
+
+func (s *Server) usedCapacityLocked() (used uint64) {
+	for _, vol := range s.volumes {
+		used += vol.Capacity
+	}
+	return used
+}
+
+func (s *Server) loadState() error {
+	if s.cfg.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.cfg.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read state file: %w", err)
+	}
+	if err = json.Unmarshal(data, &s.volumes); err != nil {
+		return fmt.Errorf("decode state file %s: %w", s.cfg.StateFile, err)
+	}
+	klog.InfoS("Fake master state loaded", "stateFile", s.cfg.StateFile, "volumes", len(s.volumes))
+	return nil
+}
+
+func (s *Server) saveStateLocked() {
+	if s.cfg.StateFile == "" {
+		return
+	}
+	data, _ := json.Marshal(s.volumes)
+	if err := os.WriteFile(s.cfg.StateFile, data, stateFileMode); err != nil {
+		klog.ErrorS(err, "Failed to save fake master state", "stateFile", s.cfg.StateFile)
+	}
+}
+
+func writeReply(w http.ResponseWriter, code int, msg string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	body, _ := json.Marshal(&reply{Code: code, Msg: msg, Data: data})
+	_, _ = w.Write(body)
+}
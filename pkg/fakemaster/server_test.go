@@ -0,0 +1,204 @@
+package fakemaster
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func authKey(owner string) string {
+	sum := md5.Sum([]byte(owner))
+	return hex.EncodeToString(sum[:])
+}
+
+// call requests path on the server and decodes the reply envelope.
+func call(t *testing.T, ts *httptest.Server, path string, query url.Values) reply {
+	t.Helper()
+	resp, err := http.Get(ts.URL + path + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s status = %s", path, resp.Status)
+	}
+	r := reply{}
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return r
+}
+
+func newTestServer(t *testing.T, cfg Config) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg.Addrs = []string{"127.0.0.1:0"}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	_, ts := newTestServer(t, Config{Version: "3.3.0", CapacityGB: 100})
+	create := url.Values{"name": {"pvc-a"}, "owner": {"csi"}, "capacity": {"10"}, "volType": {"0"}}
+
+	if r := call(t, ts, "/admin/createVol", create); r.Code != CodeSuccess {
+		t.Fatalf("createVol = %+v", r)
+	}
+	if r := call(t, ts, "/admin/createVol", create); r.Code != CodeDuplicateVol {
+		t.Errorf("createVol again = %+v, want CodeDuplicateVol", r)
+	}
+	r := call(t, ts, "/admin/getVol", url.Values{"name": {"pvc-a"}})
+	vol := r.Data.(map[string]interface{})
+	if r.Code != CodeSuccess || vol["Capacity"] != float64(10) || vol["RwDpCnt"] != float64(defaultDataPartitionCount) {
+		t.Errorf("getVol = %+v", r)
+	}
+
+	expand := url.Values{"name": {"pvc-a"}, "authKey": {authKey("csi")}, "capacity": {"20"}}
+	if r := call(t, ts, "/vol/expand", expand); r.Code != CodeSuccess {
+		t.Errorf("expand = %+v", r)
+	}
+	if r := call(t, ts, "/vol/expand", expand); r.Code != CodeParamError {
+		t.Errorf("expand to the same capacity = %+v, want CodeParamError", r)
+	}
+	expand.Set("capacity", "200")
+	if r := call(t, ts, "/vol/expand", expand); r.Code != CodeNoDataNodeToCreateDp {
+		t.Errorf("expand over the cluster capacity = %+v, want CodeNoDataNodeToCreateDp", r)
+	}
+
+	r = call(t, ts, "/vol/list", url.Values{"keywords": {"pvc"}})
+	if vols := r.Data.([]interface{}); len(vols) != 1 || vols[0].(map[string]interface{})["TotalSize"] != float64(20<<30) {
+		t.Errorf("list = %+v, want pvc-a with 20GB", r)
+	}
+
+	if r := call(t, ts, "/vol/delete", url.Values{"name": {"pvc-a"}, "authKey": {authKey("other")}}); r.Code != CodeVolAuthKeyNotMatch {
+		t.Errorf("delete with another owner = %+v, want CodeVolAuthKeyNotMatch", r)
+	}
+	if r := call(t, ts, "/vol/delete", url.Values{"name": {"pvc-a"}, "authKey": {authKey("csi")}}); r.Code != CodeSuccess {
+		t.Errorf("delete = %+v", r)
+	}
+	if r := call(t, ts, "/admin/getVol", url.Values{"name": {"pvc-a"}}); r.Code != CodeVolNotExists {
+		t.Errorf("getVol after delete = %+v, want CodeVolNotExists", r)
+	}
+}
+
+func TestCreateVolErrors(t *testing.T) {
+	_, ts := newTestServer(t, Config{Version: "3.3.0", CapacityGB: 10})
+	tests := []struct {
+		name  string
+		query url.Values
+		want  int
+	}{
+		{"invalid name", url.Values{"name": {"a"}, "owner": {"csi"}, "capacity": {"1"}}, CodeParamError},
+		{"no owner", url.Values{"name": {"pvc-a"}, "capacity": {"1"}}, CodeParamError},
+		{"no capacity", url.Values{"name": {"pvc-a"}, "owner": {"csi"}}, CodeParamError},
+		{"cluster full", url.Values{"name": {"pvc-a"}, "owner": {"csi"}, "capacity": {"11"}}, CodeNoDataNodeToCreateDp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if r := call(t, ts, "/admin/createVol", tt.query); r.Code != tt.want {
+				t.Errorf("createVol = %+v, want code %d", r, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersions(t *testing.T) {
+	tests := []struct {
+		version     string
+		expandPath  string
+		wantVolType int
+	}{
+		{"3.3.0", "/vol/expand", CodeSuccess},
+		{"v2.4.0", "/vol/update", CodeParamError},
+		{"", "/vol/update", CodeParamError},
+	}
+	for _, tt := range tests {
+		t.Run("version "+tt.version, func(t *testing.T) {
+			_, ts := newTestServer(t, Config{Version: tt.version})
+			resp, err := http.Get(ts.URL + "/version")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if tt.version == "" {
+				if resp.StatusCode != http.StatusNotFound {
+					t.Errorf("/version status = %s, want 404 like an old master", resp.Status)
+				}
+			} else if !strings.Contains(string(body), `"Version":"`+tt.version+`"`) || strings.Contains(string(body), `"code"`) {
+				t.Errorf("/version = %s, want the bare version info", body)
+			}
+
+			r := call(t, ts, "/admin/createVol", url.Values{"name": {"pvc-a"}, "owner": {"csi"}, "capacity": {"1"}, "volType": {"1"}})
+			if r.Code != tt.wantVolType {
+				t.Errorf("createVol with volType = %+v, want code %d", r, tt.wantVolType)
+			}
+			call(t, ts, "/admin/createVol", url.Values{"name": {"pvc-b"}, "owner": {"csi"}, "capacity": {"1"}})
+			r = call(t, ts, tt.expandPath, url.Values{"name": {"pvc-b"}, "authKey": {authKey("csi")}, "capacity": {"2"}})
+			if r.Code != CodeSuccess {
+				t.Errorf("%s = %+v", tt.expandPath, r)
+			}
+		})
+	}
+}
+
+func TestFaults(t *testing.T) {
+	_, ts := newTestServer(t, Config{Version: "3.3.0"})
+	faults := `{"errorCode":7,"errorRate":1,"paths":["/admin/getVol"]}`
+	resp, err := http.Post(ts.URL+faultPath, "application/json", strings.NewReader(faults))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if r := call(t, ts, "/admin/getVol", url.Values{"name": {"pvc-a"}}); r.Code != CodeVolNotExists || r.Msg != "injected fault" {
+		t.Errorf("getVol with a fault = %+v, want the injected fault", r)
+	}
+	if r := call(t, ts, "/cluster/stat", nil); r.Code != CodeSuccess {
+		t.Errorf("cluster/stat = %+v, want the faults restricted to their paths", r)
+	}
+	if r := call(t, ts, faultPath, nil); r.Data.(map[string]interface{})["errorRate"] != float64(1) {
+		t.Errorf("GET %s = %+v, want the current faults", faultPath, r)
+	}
+}
+
+func TestFollowerRedirect(t *testing.T) {
+	s, err := NewServer(Config{Addrs: []string{"127.0.0.1:0"}, Faults: Faults{RedirectFollowers: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower := httptest.NewServer(s.handler(false, "10.0.0.1:17010"))
+	defer follower.Close()
+
+	resp, err := http.Get(follower.URL + "/admin/getVol?name=pvc-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != leaderRedirectStatus || string(body) != "10.0.0.1:17010" {
+		t.Errorf("follower reply = %s %s, want %d with the leader address", resp.Status, body, leaderRedirectStatus)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	_, ts := newTestServer(t, Config{Version: "3.3.0", StateFile: stateFile})
+	call(t, ts, "/admin/createVol", url.Values{"name": {"pvc-a"}, "owner": {"csi"}, "capacity": {"1"}})
+
+	_, restarted := newTestServer(t, Config{Version: "3.3.0", StateFile: stateFile})
+	if r := call(t, restarted, "/admin/getVol", url.Values{"name": {"pvc-a"}}); r.Code != CodeSuccess {
+		t.Errorf("getVol after a restart = %+v, want the volume kept", r)
+	}
+}
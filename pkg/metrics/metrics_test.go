@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerEscapesLabelValues(t *testing.T) {
+	v := NewCounterVec("test_escaped_total", "Counter with odd label values.", "cluster")
+	v.WithLabelValues("a\"b\\c\nd").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	want := `cubefs_csi_test_escaped_total{cluster="a\"b\\c\nd"} 1`
+	if !strings.Contains(string(body), want) {
+		t.Fatalf("metrics output misses %s:\n%s", want, body)
+	}
+}
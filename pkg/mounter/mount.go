@@ -1,6 +1,7 @@
 package mounter
 
 import (
+	"fmt"
 	"os"
 
 	mountutils "k8s.io/mount-utils"
@@ -22,6 +23,7 @@ type Mounter interface {
 	MakeDir(path string) error
 	PathExists(path string) (bool, error)
 	NeedResize(devicePath string, deviceMountPath string) (bool, error)
+	UnmountLazy(path string) error
 }
 
 // NodeMounter implements Mounter.
@@ -59,6 +61,16 @@ func (nm *NodeMounter) NeedResize(devicePath string, deviceMountPath string) (bo
 	return false, nil
 }
 
+// UnmountLazy detaches the mount at path right away and cleans it up once it is
+// no longer busy, which is the only way to get rid of a hung FUSE mount.
+func (nm *NodeMounter) UnmountLazy(path string) error {
+	output, err := nm.Exec.Command("umount", "-l", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lazy unmount %s failed: %v, output: %s", path, err, string(output))
+	}
+	return nil
+}
+
 // NewNodeMounter returns a new intsance of NodeMounter.
 func NewNodeMounter() Mounter {
 	safeMounter := NewSafeMounter()
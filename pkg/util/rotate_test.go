@@ -0,0 +1,93 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "client.log")
+	r, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err = r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+	for file, content := range want {
+		if got := readFile(t, file); got != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), got, content)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("third backup kept: %v", err)
+	}
+
+	if _, err = r.Write([]byte("closed\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write() after Close() = %v, want %v", err, os.ErrClosed)
+	}
+	if err = r.Close(); err != nil {
+		t.Errorf("Close() again = %v", err)
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.log")
+	if err := os.WriteFile(path, []byte("before\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRotatingFile(path, 12, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// the size of the existing file counts
+	if _, err = r.Write([]byte("after\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path+".1"); got != "before\n" {
+		t.Errorf("backup = %q, want the existing content", got)
+	}
+	if got := readFile(t, path); got != "after\n" {
+		t.Errorf("file = %q, want the new write", got)
+	}
+}
+
+func TestRotatingFileWithoutBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.log")
+	r, err := NewRotatingFile(path, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// a write larger than the limit goes to an empty file
+	for _, data := range []string{"large write\n", "next\n"} {
+		if _, err = r.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readFile(t, path); got != "next\n" {
+		t.Errorf("file = %q, want only the last write", got)
+	}
+	if _, err = os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("backup kept without backups: %v", err)
+	}
+}